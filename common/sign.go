@@ -0,0 +1,60 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Requests the Manager sends to workers, and pull replies it sends back
+// to them, are signed with the worker's key so the key itself never has
+// to be sent. A timestamp and a random nonce are included in the
+// signature so the worker can reject old or repeated messages, and the
+// name of the worker the message is for so that a message can't be
+// replayed to another worker with the same key.
+const (
+	HEADER_TIMESTAMP = "X-Obdi-Timestamp"
+	HEADER_NONCE     = "X-Obdi-Nonce"
+	HEADER_WORKER    = "X-Obdi-Worker"
+	HEADER_SIGNATURE = "X-Obdi-Signature"
+)
+
+// Signature returns the hex encoded HMAC-SHA256 of a message, keyed
+// with the worker's key. worker is the name of the worker the message
+// is for, and uri is the request URI, the path and any query string.
+func Signature(key, worker, method, uri, timestamp, nonce string,
+	body []byte) string {
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(worker + "\n" + method + "\n" + apiPath(uri) + "\n" +
+		timestamp + "\n" + nonce + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// apiPath returns uri from "/api/" onwards. A proxy in front of the
+// Manager or a worker may add or strip a path prefix, so only the part
+// both sides see the same is signed.
+func apiPath(uri string) string {
+	if i := strings.Index(uri, "/api/"); i > 0 {
+		return uri[i:]
+	}
+	return uri
+}
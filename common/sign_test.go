@@ -0,0 +1,36 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"testing"
+)
+
+func TestSignaturePathPrefix(t *testing.T) {
+
+	sig := func(uri string) string {
+		return Signature("key", "worker1", "POST", uri, "1", "nonce",
+			[]byte("{}"))
+	}
+
+	if sig("/obdi/api/jobs") != sig("/api/jobs") {
+		t.Errorf("a proxy path prefix changed the signature")
+	}
+	if sig("/api/jobs") == sig("/api/jobs?id=1") {
+		t.Errorf("the query string is not signed")
+	}
+}
@@ -0,0 +1,97 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package common holds code used by both the Manager and obdi-worker.
+package common
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// CertPin returns the pin for a certificate. This is the base64 encoded
+// SHA-256 hash of the certificate's public key, the same as used for
+// HTTP public key pinning, so it can be made with:
+//
+//	openssl x509 -in cert.pem -pubkey -noout | openssl pkey -pubin \
+//	  -outform der | openssl dgst -sha256 -binary | base64
+func CertPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// LoadCertPool reads a file of PEM encoded CA certificates
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in '%s'", file)
+	}
+	return pool, nil
+}
+
+// CheckPins returns an error unless the peer's certificate matches one
+// of the pins. It's used as a tls.Config's VerifyPeerCertificate.
+//
+// When the certificate was checked against a CA, any certificate in the
+// verified chains can match, so a CA can be pinned. Otherwise only the
+// leaf is checked. That's the only certificate the peer has proved it
+// has the key for, anyone can send other certificates after it.
+func CheckPins(pins []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+
+		certs := []*x509.Certificate{}
+		for _, chain := range chains {
+			certs = append(certs, chain...)
+		}
+		if len(chains) == 0 && len(rawCerts) > 0 {
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+
+		for _, cert := range certs {
+			pin := CertPin(cert)
+			for _, p := range pins {
+				if strings.TrimSpace(p) == pin {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("Certificate does not match any pinned key")
+	}
+}
+
+// CertNames returns the names a certificate was issued to, its common
+// name and its DNS and email subject alternative names
+func CertNames(cert *x509.Certificate) []string {
+	names := []string{}
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	return names
+}
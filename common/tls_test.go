@@ -0,0 +1,105 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newCert makes a certificate signed by parent, or a self-signed one if
+// parent is nil
+func newCert(t *testing.T, name string, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageDigitalSignature |
+			x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent,
+		&key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestCheckPinsLeafOnly(t *testing.T) {
+
+	pinned, _ := newCert(t, "worker1", nil, nil)
+	other, _ := newCert(t, "attacker", nil, nil)
+	check := CheckPins([]string{CertPin(pinned)})
+
+	if err := check([][]byte{pinned.Raw}, nil); err != nil {
+		t.Errorf("pinned leaf rejected: %s", err)
+	}
+	if err := check([][]byte{other.Raw}, nil); err == nil {
+		t.Errorf("unpinned leaf accepted")
+	}
+
+	// The peer only proves it has the key for the first certificate
+	if err := check([][]byte{other.Raw, pinned.Raw}, nil); err == nil {
+		t.Errorf("unpinned leaf followed by the pinned certificate " +
+			"accepted")
+	}
+}
+
+func TestCheckPinsVerifiedChains(t *testing.T) {
+
+	ca, caKey := newCert(t, "ca", nil, nil)
+	leaf, _ := newCert(t, "worker1", ca, caKey)
+	extra, _ := newCert(t, "extra", nil, nil)
+	chains := [][]*x509.Certificate{{leaf, ca}}
+
+	if err := CheckPins([]string{CertPin(ca)})([][]byte{leaf.Raw},
+		chains); err != nil {
+		t.Errorf("pinned CA rejected: %s", err)
+	}
+	if err := CheckPins([]string{CertPin(leaf)})([][]byte{leaf.Raw},
+		chains); err != nil {
+		t.Errorf("pinned leaf rejected: %s", err)
+	}
+
+	// Certificates sent that aren't in a verified chain don't count
+	if err := CheckPins([]string{CertPin(extra)})([][]byte{leaf.Raw,
+		extra.Raw}, chains); err == nil {
+		t.Errorf("pinned certificate outside the chain accepted")
+	}
+}
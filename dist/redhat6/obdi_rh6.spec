@@ -70,13 +70,17 @@ export GOPATH=$PWD
 # Fix include paths
 mkdir -p src/github.com/mclarkson/obdi
 ln -s ../../../../external src/github.com/mclarkson/obdi/external 
+ln -s ../../../../common src/github.com/mclarkson/obdi/common
 
 # Build
 cd obdi
 go build -ldflags "-X main.VERSION %{version}" -o obdi
 cd ..
 cd obdi-worker
-go build -o obdi-worker
+go build -ldflags "-X main.VERSION %{version}" -o obdi-worker
+cd ..
+cd obdi-sign
+go build -o obdi-sign
 
 %install
 
@@ -90,6 +94,7 @@ install -D -m 640 conf/obdi-worker.conf ${RPM_BUILD_ROOT}/%_sysconfdir/obdi-work
 # Golang single binary (/usr/sbin)
 install -D -m 755 obdi/obdi ${RPM_BUILD_ROOT}%{_sbindir}/obdi
 install -D -m 755 obdi-worker/obdi-worker ${RPM_BUILD_ROOT}/%{_sbindir}/obdi-worker
+install -D -m 755 obdi-sign/obdi-sign ${RPM_BUILD_ROOT}/%{_bindir}/obdi-sign
 
 # Initrd
 install -D -m 755 init/obdi ${RPM_BUILD_ROOT}/%{_initrddir}/obdi
@@ -116,6 +121,7 @@ cp -r static ${RPM_BUILD_ROOT}/%{_datarootdir}/obdi/
 %files
 %defattr(755,root,root,755)
 %_sbindir/obdi
+%_bindir/obdi-sign
 %_initrddir/obdi
 %defattr(644,root,root,755)
 %dir %{_sharedstatedir}/obdi
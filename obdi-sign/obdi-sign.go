@@ -0,0 +1,219 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// obdi-sign makes the key pair used to sign scripts and signs them.
+// Workers with the public key in trusted_keys only run scripts signed
+// with the private key. Keep the private key off the Manager.
+//
+// Make a key pair. The public key is printed:
+//
+//	obdi-sign -genkey -key /root/obdi-sign.key
+//
+// Sign scripts. The signature for 'name.sh' is written to 'name.sh.sig',
+// where a script sync picks it up, and printed for pasting into the GUI:
+//
+//	obdi-sign -key /root/obdi-sign.key [-interpreter bash] name.sh
+//
+// The interpreter is part of the signature. It's read from the script's
+// 'obdi-interpreter' header, or its 'name.sh.obdi.toml' manifest, if
+// -interpreter isn't given.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/mclarkson/obdi/external/BurntSushi/toml"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// scriptSignedData returns what a script signature covers. Workers
+// have the same function.
+func scriptSignedData(hash, interpreter string) []byte {
+	return []byte("obdi-script-v1\n" + hash + "\n" + interpreter + "\n")
+}
+
+// scriptHash returns the hex encoded SHA-256 of a script's source
+func scriptHash(source []byte) string {
+	sum := sha256.Sum256(source)
+	return hex.EncodeToString(sum[:])
+}
+
+// scriptInterpreter finds the interpreter the Manager's script sync
+// would use for the script
+func scriptInterpreter(file string, source []byte) (string, error) {
+
+	interpreter := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(source))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+		if strings.HasPrefix(line, "obdi-interpreter:") {
+			interpreter = strings.TrimSpace(
+				strings.TrimPrefix(line, "obdi-interpreter:"))
+		}
+	}
+
+	manifest := struct {
+		Interpreter *string `toml:"interpreter"`
+	}{}
+	if _, err := toml.DecodeFile(file+".obdi.toml", &manifest); err == nil {
+		if manifest.Interpreter != nil {
+			interpreter = *manifest.Interpreter
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	return interpreter, nil
+}
+
+func genKey(keyfile string) error {
+
+	if _, err := os.Stat(keyfile); err == nil {
+		return fmt.Errorf("%s exists. Not overwriting it.", keyfile)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	seed := base64.StdEncoding.EncodeToString(priv.Seed())
+	if err := ioutil.WriteFile(keyfile, []byte(seed+"\n"), 0600); err != nil {
+		return err
+	}
+
+	fmt.Printf("Private key written to %s\n", keyfile)
+	fmt.Printf("Add the public key to trusted_keys in obdi-worker.conf:\n")
+	fmt.Printf("%s\n", base64.StdEncoding.EncodeToString(pub))
+
+	return nil
+}
+
+func readKey(keyfile string) (ed25519.PrivateKey, error) {
+
+	data, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(
+		strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not an obdi-sign key", keyfile)
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func signScript(key ed25519.PrivateKey, file, interpreter string,
+	setInterpreter bool) error {
+
+	source, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	if !setInterpreter {
+		if interpreter, err = scriptInterpreter(file, source); err != nil {
+			return err
+		}
+	}
+
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key,
+		scriptSignedData(scriptHash(source), interpreter)))
+
+	if err := ioutil.WriteFile(file+".sig", []byte(sig+"\n"),
+		0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s (interpreter '%s'): %s\n", file, interpreter, sig)
+
+	return nil
+}
+
+func main() {
+
+	keyfile := flag.String("key", "", "The private key file")
+	genkey := flag.Bool("genkey", false, "Make a new key pair")
+	pubkey := flag.Bool("pubkey", false, "Print the public key")
+	interpreter := flag.String("interpreter", "",
+		"The interpreter the script runs with")
+	flag.Parse()
+
+	setInterpreter := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "interpreter" {
+			setInterpreter = true
+		}
+	})
+
+	if *keyfile == "" {
+		fmt.Fprintf(os.Stderr, "ERROR: -key is required\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *genkey {
+		if err := genKey(*keyfile); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	key, err := readKey(*keyfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	if *pubkey {
+		fmt.Printf("%s\n", base64.StdEncoding.EncodeToString(
+			key.Public().(ed25519.PublicKey)))
+		return
+	}
+
+	if flag.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: No scripts to sign\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	status := 0
+	for _, file := range flag.Args() {
+		if err := signScript(key, file, *interpreter,
+			setInterpreter); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %s\n", file, err)
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
@@ -18,28 +18,33 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"sync"
+	"time"
 )
 
 // Inbound
 type JobIn struct {
-	ScriptSource []byte // From manager
+	ScriptSource []byte // From manager, or the script cache
+	ScriptHash   string // From manager
+	Interpreter  string // From manager: empty to use the #! line
+	Signature    string // From manager: checked against trusted_keys
+	JobKey       string // From manager: sent back with status and output
 	ScriptName   string // From manager
 	Args         string // From manager
 	EnvVars      string // From manager
 	//NotifURL   string // From manager
-	JobID      int64  // From manager
-	Key        string // From manager
-	Type       int64  // From manager: 1 - user job, 2 - system job
-	Guid       string // Locally created
-	Pid        int64  // Locally created
-	Errors     int64  // Locally created
-	UserCancel bool   // Used locally only
+	JobID      int64     // From manager
+	Type       int64     // From manager: 1 - user job, 2 - system job
+	Guid       string    // Locally created
+	Pid        int64     // Locally created
+	StartTime  time.Time // Locally created
+	OutputSize int64     // Locally created: bytes of output sent
+	Errors     int64     // Locally created
+	UserCancel bool      // Used locally only
 }
 
 // Outbound: All created locally
@@ -49,6 +54,7 @@ type JobOut struct {
 	StatusReason  string
 	StatusPercent int64
 	Errors        int64
+	JobKey        string // Shows the manager the job was sent to us
 }
 
 type OutputLine struct {
@@ -56,6 +62,7 @@ type OutputLine struct {
 	Serial int64
 	JobId  int64
 	Text   string
+	JobKey string // Shows the manager the job was sent to us
 	//Type            int64       // 0 - output, 1 - error output
 }
 
@@ -70,6 +77,11 @@ type ApiError struct {
 	details string
 }
 
+// An error that might go away if the request is tried again later
+type TransientError struct {
+	details string
+}
+
 const (
 	STATUS_UNKNOWN = iota
 	STATUS_NOTSTARTED
@@ -82,41 +94,44 @@ const (
 
 func (api *Api) sendOutputLine(job JobIn, line string, serial int64) error {
 
+	api.AddOutputSize(job.JobID, int64(len(line)))
+
 	data := OutputLine{}
 	data.Serial = serial
 	data.JobId = job.JobID
 	data.Text = line
+	data.JobKey = job.JobKey
 
-	jsondata, err := json.Marshal(data)
-	if err != nil {
-		return ApiError{"Internal error: Manager login, JSON Encode"}
-	}
+	return api.send(SpoolItem{Type: SPOOL_OUTPUT, JobID: job.JobID,
+		Line: data})
+}
 
-	_, err = POST(jsondata,
-		config.User+"/"+api.Guid()+"/outputlines")
-	if err != nil {
-		return ApiError{err.Error()}
-	}
+func (api *Api) sendStatus(jobin JobIn, jobout JobOut) error {
 
-	return nil
+	jobout.JobKey = jobin.JobKey
+
+	return api.send(SpoolItem{Type: SPOOL_STATUS, JobID: jobin.JobID,
+		Status: jobout})
 }
 
-func (api *Api) sendStatus(jobin JobIn, jobout JobOut) error {
+// deliverOutputLine sends an output line to the manager. A
+// TransientError is returned if it's worth trying again later.
+func (api *Api) deliverOutputLine(data OutputLine) error {
 
 	tries := 0
 
 	r := &http.Response{}
 
 	for {
-		jsondata, err := json.Marshal(jobout)
+		jsondata, err := json.Marshal(data)
 		if err != nil {
-			return ApiError{"Internal error: sendStatus, JSON Encode"}
+			return ApiError{"Internal error: sendOutputLine, JSON Encode"}
 		}
 
-		resp, err := PUT(jsondata, config.User+"/"+api.Guid()+"/"+
-			"jobs/"+fmt.Sprintf("%d", jobin.JobID))
+		guid := api.Guid()
+		resp, err := api.POST(jsondata, api.Endpoint("outputlines"))
 		if err != nil {
-			return ApiError{err.Error()}
+			return TransientError{err.Error()}
 		}
 		r = resp
 		// Retry login (only once) on a 401
@@ -128,59 +143,118 @@ func (api *Api) sendStatus(jobin JobIn, jobout JobOut) error {
 		}
 		resp.Body.Close()
 		tries = tries + 1
-		api.Login()
+		api.relogin(guid)
 	}
 
-	if r.StatusCode != 200 {
+	return checkResponse(r, "SendOutputLine")
+}
 
-		// There was an error
-		// Read the response body for details
+// deliverStatus sends a job's status to the manager. A TransientError
+// is returned if it's worth trying again later.
+func (api *Api) deliverStatus(jobid int64, jobout JobOut) error {
 
-		var body []byte
-		if b, err := ioutil.ReadAll(r.Body); err != nil {
-			txt := fmt.Sprintf("Error reading Body ('%s').", err.Error())
-			return ApiError{txt}
-		} else {
-			body = b
+	tries := 0
+
+	r := &http.Response{}
+
+	for {
+		jsondata, err := json.Marshal(jobout)
+		if err != nil {
+			return ApiError{"Internal error: sendStatus, JSON Encode"}
 		}
-		type myErr struct {
-			Error string
+
+		guid := api.Guid()
+		resp, err := api.PUT(jsondata,
+			api.Endpoint(fmt.Sprintf("jobs/%d", jobid)))
+		if err != nil {
+			return TransientError{err.Error()}
 		}
-		errstr := myErr{}
-		if err := json.Unmarshal(body, &errstr); err != nil {
-			txt := fmt.Sprintf("Error decoding JSON ('%s')", err.Error())
-			return ApiError{txt}
+		r = resp
+		// Retry login (only once) on a 401
+		if resp.StatusCode != 401 {
+			break
 		}
-		txt := fmt.Sprintf("SendStatus to Manager failed ('%s').",
-			errstr.Error)
-		return ApiError{txt}
+		if tries == 1 {
+			break
+		}
+		resp.Body.Close()
+		tries = tries + 1
+		api.relogin(guid)
+	}
+
+	return checkResponse(r, "SendStatus")
+}
+
+// checkResponse closes the response body and returns the error the
+// manager sent, if any. Server errors and failed logins are returned as
+// a TransientError.
+func checkResponse(r *http.Response, what string) error {
 
+	defer r.Body.Close()
+
+	if r.StatusCode == 200 {
+		return nil
 	}
 
-	r.Body.Close()
+	// There was an error
+	// Read the response body for details
 
-	return nil
+	var body []byte
+	if b, err := ioutil.ReadAll(r.Body); err != nil {
+		txt := fmt.Sprintf("Error reading Body ('%s').", err.Error())
+		return TransientError{txt}
+	} else {
+		body = b
+	}
+	type myErr struct {
+		Error string
+	}
+	errstr := myErr{}
+	if err := json.Unmarshal(body, &errstr); err != nil {
+		errstr.Error = fmt.Sprintf("HTTP status %d", r.StatusCode)
+	}
+	txt := fmt.Sprintf("%s to Manager failed ('%s').", what, errstr.Error)
+
+	if r.StatusCode >= 500 || r.StatusCode == 401 {
+		return TransientError{txt}
+	}
+	return ApiError{txt}
 }
 
 func (e ApiError) Error() string {
 	return fmt.Sprintf("%s", e.details)
 }
 
+func (e TransientError) Error() string {
+	return fmt.Sprintf("%s", e.details)
+}
+
 type Login struct {
 	Login    string
 	Password string
 }
 
-func POST(jsondata []byte, endpoint string) (r *http.Response,
+// setCredentials adds the worker's token, or the GUID from logging in,
+// to a request. They go in a header, not the URL, so they're not in the
+// manager's access log.
+func (api *Api) setCredentials(req *http.Request) {
+
+	if config.WorkerToken != "" {
+		req.Header.Add("Authorization", "Bearer "+config.WorkerToken)
+	} else if guid := api.Guid(); guid != "" {
+		req.Header.Add("Authorization", "Bearer "+guid)
+	}
+}
+
+func (api *Api) POST(jsondata []byte, endpoint string) (r *http.Response,
 	e error) {
 
 	buf := bytes.NewBuffer(jsondata)
 
-	// accept bad certs
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	client, err := httpClient()
+	if err != nil {
+		return nil, err
 	}
-	client := &http.Client{Transport: tr}
 
 	//resp, err := client.Post(config.ManUrlPrefix+"/api/"+endpoint,
 	//	"application/json", buf)
@@ -192,22 +266,27 @@ func POST(jsondata []byte, endpoint string) (r *http.Response,
 		return resp, ApiError{txt}
 	}
 
+	api.setCredentials(req)
+
 	req.Close = true
 	resp, err = client.Do(req)
+	if err != nil {
+		txt := fmt.Sprintf("Could not send REST request ('%s').", err.Error())
+		return resp, ApiError{txt}
+	}
 
 	return resp, nil
 }
 
-func PUT(jsondata []byte, endpoint string) (r *http.Response,
+func (api *Api) PUT(jsondata []byte, endpoint string) (r *http.Response,
 	e error) {
 
 	buf := bytes.NewBuffer(jsondata)
 
-	// accept bad certs
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	client, err := httpClient()
+	if err != nil {
+		return nil, err
 	}
-	client := &http.Client{Transport: tr}
 
 	resp := &http.Response{}
 
@@ -220,14 +299,74 @@ func PUT(jsondata []byte, endpoint string) (r *http.Response,
 
 	req.Header.Add("Content-Type", `application/json`)
 
+	api.setCredentials(req)
+
+	req.Close = true
+	resp, err = client.Do(req)
+	if err != nil {
+		txt := fmt.Sprintf("Could not send REST request ('%s').", err.Error())
+		return resp, ApiError{txt}
+	}
+
+	return resp, nil
+}
+
+func (api *Api) GET(endpoint string) (r *http.Response, e error) {
+	return api.getWithTimeout(endpoint, 0)
+}
+
+// getWithTimeout is GET that gives up after timeout, including reading
+// the body. No timeout if it's zero.
+func (api *Api) getWithTimeout(endpoint string, timeout time.Duration) (
+	r *http.Response, e error) {
+
+	shared, err := httpClient()
+	if err != nil {
+		return nil, err
+	}
+	client := *shared
+	client.Timeout = timeout
+
+	resp := &http.Response{}
+
+	req, err := http.NewRequest("GET",
+		config.ManUrlPrefix+"/api/"+endpoint, nil)
+	if err != nil {
+		txt := fmt.Sprintf("Could not send REST request ('%s').", err.Error())
+		return resp, ApiError{txt}
+	}
+
+	api.setCredentials(req)
+
 	req.Close = true
 	resp, err = client.Do(req)
+	if err != nil {
+		txt := fmt.Sprintf("Could not send REST request ('%s').", err.Error())
+		return resp, ApiError{txt}
+	}
 
 	return resp, nil
 }
 
+// relogin logs in again after a request sent with guid was refused.
+// Other goroutines may have been refused at the same time, so it only
+// logs in if none of them has already.
+func (api *Api) relogin(guid string) error {
+	api.loginmutex.Lock()
+	defer api.loginmutex.Unlock()
+	if api.Guid() != guid {
+		return nil
+	}
+	return api.Login()
+}
+
 func (api *Api) Login() error {
 
+	// Workers with a token don't log in
+	if config.WorkerToken != "" {
+		return nil
+	}
+
 	data := Login{}
 	data.Login = config.User
 	data.Password = config.Password
@@ -236,7 +375,7 @@ func (api *Api) Login() error {
 		return ApiError{"Internal error: Manager login, JSON Encode"}
 	}
 
-	resp, err := POST(jsondata, "login")
+	resp, err := api.POST(jsondata, "login")
 	if err != nil {
 		logit("Logging in. POST FAILED." + err.Error() +
 			" (Maybe transport_timeout is too low or not set?)")
@@ -296,13 +435,17 @@ func (api *Api) Login() error {
 
 func (api *Api) Logout() error {
 
+	if config.WorkerToken != "" {
+		return nil
+	}
+
 	jsondata := []byte{} // No json for logout
 
-	_, err := POST(jsondata,
-		config.User+"/"+api.Guid()+"/logout")
+	resp, err := api.POST(jsondata, "logout")
 	if err != nil {
 		return ApiError{err.Error()}
 	}
+	resp.Body.Close()
 
 	api.UpdateGuid("")
 
@@ -358,11 +501,25 @@ func (api *Api) UserCancel(jobid int64) bool {
 	return false
 }
 
+// SetPid saves the pid of a job's process, which has just started
 func (api *Api) SetPid(jobid int64, pid int64) {
 	api.mutex.Lock()
 	for i, job := range api.jobs {
 		if job.JobID == jobid {
 			api.jobs[i].Pid = pid
+			api.jobs[i].StartTime = time.Now()
+			break
+		}
+	}
+	api.mutex.Unlock()
+}
+
+// AddOutputSize adds to the count of output bytes for a job
+func (api *Api) AddOutputSize(jobid int64, size int64) {
+	api.mutex.Lock()
+	for i, job := range api.jobs {
+		if job.JobID == jobid {
+			api.jobs[i].OutputSize += size
 			break
 		}
 	}
@@ -390,6 +547,22 @@ func (api *Api) Guid() string {
 	return api.guid
 }
 
+// LoggedIn returns true if requests can be sent to the manager
+func (api *Api) LoggedIn() bool {
+	return config.WorkerToken != "" || api.Guid() != ""
+}
+
+// Endpoint returns the manager endpoint for a worker request. Workers
+// with a token use the /worker routes, other workers use the routes of
+// the user they logged in as. The credentials are added by
+// setCredentials.
+func (api *Api) Endpoint(path string) string {
+	if config.WorkerToken != "" {
+		return "worker/" + path
+	}
+	return path
+}
+
 func (api *Api) UpdateGuid(guid string) {
 	api.mutex.Lock()
 	api.guid = guid
@@ -399,7 +572,9 @@ func (api *Api) UpdateGuid(guid string) {
 func (api *Api) Jobs() []JobIn {
 	api.mutex.Lock()
 	defer api.mutex.Unlock()
-	return api.jobs
+	jobs := make([]JobIn, len(api.jobs))
+	copy(jobs, api.jobs)
+	return jobs
 }
 
 func NewApi() Api {
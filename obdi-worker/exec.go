@@ -22,27 +22,101 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"syscall"
 	//"encoding/json"
 	//"strings"
 )
 
+// jobEnv builds the environment for a single job. Nothing is taken
+// from, or written to, the worker's own environment so concurrent jobs
+// can't see or change each other's settings.
+func jobEnv(job JobIn, jobdir string) []string {
+
+	env := []string{
+		"PATH=" + config.JobPath,
+		"HOME=" + jobdir,
+		"TMPDIR=" + jobdir,
+		"PWD=" + jobdir,
+		fmt.Sprintf("OBDI_JOB_ID=%d", job.JobID),
+		"OBDI_JOB_DIR=" + jobdir,
+	}
+
+	// Apply the sent environment variables, split on spaces
+	// but preserve quoted strings. Later entries win, so these
+	// override the defaults above.
+	if len(job.EnvVars) > 0 {
+		r := regexp.MustCompile("[^ ]*='.+'|[^ ]*=\".+\"|\\S+")
+		env = append(env, r.FindAllString(job.EnvVars, -1)...)
+	}
+
+	// Add the system scripts directory to Env.SYSSCRIPTDIR
+	env = append(env, "SYSSCRIPTDIR="+config.SysScriptDir)
+
+	return env
+}
+
 func (api *Api) execCmd(job JobIn) {
 
 	// TODO :: Put this logic in login/logout and reference count
 	//defer api.Logout( )
 
-	// Need to set the PATH to run the script from the script dir
-	os.Setenv("PATH", config.ScriptDir)
+	// However the job ends it's no longer running
+	defer api.RemoveJob(job.JobID)
 
+	// Only run scripts signed with a trusted key, if there are any
+	if err := checkScriptSignature(job); err != nil {
+		logit(fmt.Sprintf("Job %d: %s", job.JobID, err.Error()))
+		if err := api.sendStatus(job, JobOut{
+			Status:        STATUS_SYSCANCELLED,
+			StatusReason:  err.Error(),
+			StatusPercent: 0,
+			Errors:        0,
+		}); err != nil {
+			logit(fmt.Sprintf("Error: %s", err.Error()))
+		}
+		return
+	}
+
+	// Create a private working directory for this job. It's removed
+	// when the job finishes, unless the job failed and the worker is
+	// configured to keep failed job directories for debugging.
+	jobdir, err := ioutil.TempDir(config.JobDir,
+		fmt.Sprintf("job_%d_", job.JobID))
+	if err != nil {
+		if err := api.sendStatus(job, JobOut{
+			Status:        STATUS_SYSCANCELLED,
+			StatusReason:  fmt.Sprintf("Job directory error ('%s')", err.Error()),
+			StatusPercent: 0,
+			Errors:        0,
+		}); err != nil {
+			logit(fmt.Sprintf("Error: %s", err.Error()))
+		}
+		return
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded && config.KeepFailedJobDirs {
+			logit(fmt.Sprintf("Job %d failed. Keeping job directory '%s'.",
+				job.JobID, jobdir))
+			return
+		}
+		os.RemoveAll(jobdir)
+	}()
+
+	logit(fmt.Sprintf("Job %d: Running script '%s' (sha256 %s)", job.JobID,
+		job.ScriptName, job.ScriptHash))
+
+	// Write ScriptSource to the job directory, where no other job can
+	// see it and it's kept with the directory if the job fails
 	scriptfile := ""
 
-	// Write ScriptSource to disk
-	if file, err := ioutil.TempFile(os.TempDir(), "smworker_"); err != nil {
+	if file, err := os.OpenFile(filepath.Join(jobdir, "script"),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0700); err != nil {
 		if err := api.sendStatus(job, JobOut{
 			Status:        STATUS_SYSCANCELLED,
-			StatusReason:  fmt.Sprintf("TempFile error ('%s')", err.Error()),
+			StatusReason:  fmt.Sprintf("Script file error ('%s')", err.Error()),
 			StatusPercent: 0,
 			Errors:        0,
 		}); err != nil {
@@ -51,6 +125,8 @@ func (api *Api) execCmd(job JobIn) {
 		return
 	} else {
 		if _, err := file.Write(job.ScriptSource); err != nil {
+			file.Close()
+			os.Remove(file.Name())
 			if err := api.sendStatus(job, JobOut{
 				Status:        STATUS_SYSCANCELLED,
 				StatusReason:  fmt.Sprintf("Write error ('%s')", err.Error()),
@@ -62,31 +138,38 @@ func (api *Api) execCmd(job JobIn) {
 			return
 		}
 		file.Close()
-		os.Chmod(file.Name(), 0755)
 		scriptfile = file.Name()
 	}
-	defer os.Remove(scriptfile)
 
 	// Set up command, split on spaces but preserve quoted strings
 	head := scriptfile
 	r := regexp.MustCompile("'.+'|\".+\"|\\S+")
 	parts := r.FindAllString(job.Args, -1)
-	cmd := &exec.Cmd{}
-	cmd = exec.Command(head, parts...)
 
-	// Apply the sent environment variables, split on spaces
-	// but preserve quoted strings
-	if len(job.EnvVars) > 0 {
-		r = regexp.MustCompile("[^ ]*='.+'|[^ ]*=\".+\"|\\S+")
-		cmd.Env = r.FindAllString(job.EnvVars, -1)
-	} else {
-		cmd.Env = []string{}
+	// Run the script with its interpreter, if it has one, otherwise
+	// the #! line is used
+	if job.Interpreter != "" {
+		path, err := interpreterPath(job.Interpreter)
+		if err != nil {
+			if err := api.sendStatus(job, JobOut{
+				Status:        STATUS_SYSCANCELLED,
+				StatusReason:  err.Error(),
+				StatusPercent: 0,
+				Errors:        0,
+			}); err != nil {
+				logit(fmt.Sprintf("Error: %s", err.Error()))
+			}
+			return
+		}
+		head = path
+		parts = append([]string{scriptfile}, parts...)
 	}
 
-	// Add the system scripts directory to Env.SYSSCRIPTDIR
-	cmd.Env = append(cmd.Env, "SYSSCRIPTDIR="+config.SysScriptDir)
+	cmd := &exec.Cmd{}
+	cmd = exec.Command(head, parts...)
 
-	cmd.Dir = os.TempDir()
+	cmd.Env = jobEnv(job, jobdir)
+	cmd.Dir = jobdir
 
 	// Set up buffer for stdout
 	stdout, err := cmd.StdoutPipe()
@@ -192,12 +275,12 @@ func (api *Api) execCmd(job JobIn) {
 			logit(fmt.Sprintf("Error: (Script: '%s') %s", job.ScriptName,
             err.Error()))
 		}
-		api.RemoveJob(job.JobID)
 		return
 	}
 
 	status := cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
 	if status == 0 {
+		succeeded = true
 		if err := api.sendStatus(job, JobOut{
 			Status:        STATUS_OK,
 			StatusReason:  "Script finished successfully",
@@ -217,8 +300,6 @@ func (api *Api) execCmd(job JobIn) {
 		}
 	}
 
-	api.RemoveJob(int64(job.JobID))
-
 	// logout
 }
 
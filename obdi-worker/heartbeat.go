@@ -0,0 +1,169 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var VERSION string
+
+// Sent to the manager on startup and then every heartbeat_interval
+type Heartbeat struct {
+	DcSysName   string
+	EnvSysName  string
+	Name        string
+	Url         string // Where the Manager sends jobs, if set
+	Hostname    string
+	Version     string
+	RunningJobs int64
+	Load        float64 // 1 minute load average
+}
+
+// loadAverage returns the 1 minute load average from /proc/loadavg
+func loadAverage() float64 {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	load, _ := strconv.ParseFloat(fields[0], 64)
+	return load
+}
+
+// sendHeartbeat tells the manager we're alive and how busy we are.
+// The endpoint is either "register" or "heartbeat".
+func (api *Api) sendHeartbeat(endpoint string) error {
+
+	hostname, _ := os.Hostname()
+
+	data := Heartbeat{
+		DcSysName:   config.DcSysName,
+		EnvSysName:  config.EnvSysName,
+		Name:        config.WorkerName,
+		Url:         config.WorkerUrl,
+		Hostname:    hostname,
+		Version:     VERSION,
+		RunningJobs: int64(len(api.Jobs())),
+		Load:        loadAverage(),
+	}
+
+	jsondata, err := json.Marshal(data)
+	if err != nil {
+		return ApiError{"Internal error: sendHeartbeat, JSON Encode"}
+	}
+
+	// Token routes are /worker/register and /worker/heartbeat
+	path := "workers/" + endpoint
+	if config.WorkerToken != "" {
+		path = endpoint
+	}
+
+	for tries := 0; ; tries++ {
+		if !api.LoggedIn() {
+			api.loginmutex.Lock()
+			err := api.Login()
+			api.loginmutex.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+
+		resp, err := api.POST(jsondata, api.Endpoint(path))
+		if err != nil {
+			return ApiError{err.Error()}
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			txt := fmt.Sprintf("Error reading Body ('%s').", err.Error())
+			return ApiError{txt}
+		}
+
+		// Retry login (only once) on a 401
+		if resp.StatusCode == 401 && tries == 0 {
+			api.UpdateGuid("")
+			continue
+		}
+
+		if resp.StatusCode != 200 {
+			type myErr struct {
+				Error string
+			}
+			errstr := myErr{}
+			json.Unmarshal(body, &errstr)
+			txt := fmt.Sprintf("Heartbeat to Manager failed ('%s').",
+				errstr.Error)
+			return ApiError{txt}
+		}
+
+		// Jobs are signed for the name the Manager knows us by. A
+		// worker with its own api_token may have been given another.
+		reply := struct{ Name string }{}
+		json.Unmarshal(body, &reply)
+		if reply.Name != "" && !isOurName(reply.Name) {
+			logit(fmt.Sprintf("WARNING: This worker is '%s' in the "+
+				"Manager but worker_name is '%s'. Jobs will be "+
+				"rejected until they match.", reply.Name,
+				config.WorkerName))
+		}
+
+		return nil
+	}
+}
+
+// heartbeat registers with the manager then sends a heartbeat every
+// heartbeat_interval seconds so the manager knows if we go away.
+func (api *Api) heartbeat() {
+
+	if config.DcSysName == "" || config.EnvSysName == "" {
+		logit("dc_sys_name or env_sys_name is not set. " +
+			"Not registering with the Manager.")
+		return
+	}
+
+	interval := time.Duration(config.HeartbeatInterval) * time.Second
+
+	for {
+		if err := api.sendHeartbeat("register"); err != nil {
+			logit(fmt.Sprintf("Error: Registering with Manager: %s",
+				err.Error()))
+			time.Sleep(interval)
+			continue
+		}
+		logit(fmt.Sprintf("Registered with Manager as '%s' in '%s/%s'.",
+			config.WorkerName, config.DcSysName, config.EnvSysName))
+		break
+	}
+
+	for {
+		time.Sleep(interval)
+		if err := api.sendHeartbeat("heartbeat"); err != nil {
+			logit(fmt.Sprintf("Error: %s", err.Error()))
+		}
+	}
+}
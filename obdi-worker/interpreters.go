@@ -0,0 +1,57 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Interpreters used when the [interpreters] setting is missing
+var defaultInterpreters = map[string]string{
+	"bash":   "/bin/bash",
+	"sh":     "/bin/sh",
+	"python": "/usr/bin/python",
+	"perl":   "/usr/bin/perl",
+}
+
+// interpreterPath returns the program to run a script with. The
+// interpreter can be a name from the [interpreters] setting or one of
+// the paths listed there. Nothing else is allowed.
+func interpreterPath(interpreter string) (string, error) {
+
+	if path, ok := config.Interpreters[interpreter]; ok {
+		return path, nil
+	}
+
+	if strings.HasPrefix(interpreter, "/") {
+		for _, path := range config.Interpreters {
+			if path == interpreter {
+				return path, nil
+			}
+		}
+	}
+
+	allowed := []string{}
+	for name := range config.Interpreters {
+		allowed = append(allowed, name)
+	}
+	sort.Strings(allowed)
+
+	return "", ApiError{"Interpreter '" + interpreter + "' is not " +
+		"allowed on this worker. Allowed: " + strings.Join(allowed, ", ")}
+}
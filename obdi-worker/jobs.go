@@ -17,25 +17,39 @@
 package main
 
 import (
+	"encoding/json"
 	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
+	"io/ioutil"
 	//"sync"
 	"fmt"
 	"syscall"
 	//"time"
 )
 
-func (api *Api) ShowJobs(w rest.ResponseWriter, r *rest.Request) {
-	w.WriteJson(api.Jobs())
-}
-
 func (api *Api) AddJob(w rest.ResponseWriter, r *rest.Request) {
 
 	// Decode json post data into JobIn struct
 
 	logit(fmt.Sprintf("Connection from %s", r.RemoteAddr))
 
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	}
+
+	// Check the manager signed it with our key
+
+	if err := checkSignature(r.Header, "POST", r.RequestURI,
+		body); err != nil {
+		logit(fmt.Sprintf("Rejected request from %s ('%s')", r.RemoteAddr,
+			err.Error()))
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
 	job := JobIn{}
-	if err := r.DecodeJsonPayload(&job); err != nil {
+	if err := json.Unmarshal(body, &job); err != nil {
 		rest.Error(w, "Invalid data format received.", 400)
 		return
 	} else if job.JobID == 0 {
@@ -43,24 +57,80 @@ func (api *Api) AddJob(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
-	// Check the password matches
+	// The manager sends the script again if we don't have it
+
+	if err := api.resolveScript(&job, false); err != nil {
+		if _, ok := err.(ScriptNotCached); ok {
+			rest.Error(w, err.Error(), 412)
+			return
+		}
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	if err := api.startJob(job); err != nil {
+		// Can't send this error to the Manager so must return it here
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	w.WriteJson(newJobView(job, false))
+}
+
+func (api *Api) DeleteJob(w rest.ResponseWriter, r *rest.Request) {
+
+	// Decode json post data into JobIn struct
+
+	logit(fmt.Sprintf("Connection from %s", r.RemoteAddr))
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	}
+
+	// Check the manager signed it with our key
+
+	if err := checkSignature(r.Header, "DELETE", r.RequestURI,
+		body); err != nil {
+		logit(fmt.Sprintf("Rejected request from %s ('%s')", r.RemoteAddr,
+			err.Error()))
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	job := JobIn{}
+	if err := json.Unmarshal(body, &job); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	} else if job.JobID == 0 {
+		rest.Error(w, "Incorrect data format received.", 400)
+		return
+	}
 
-	if job.Key != config.WorkerKey {
-		rest.Error(w, "Invalid key", 400)
+	if err := api.killJob(job.JobID); err != nil {
+		rest.Error(w, err.Error(), 400)
 		return
 	}
 
+	w.WriteJson(newJobView(job, false))
+}
+
+// startJob adds the job to the job list, tells the manager it's about
+// to start, then runs it in the background. Used for jobs pushed to us
+// by the manager and for jobs fetched from the manager in pull mode.
+func (api *Api) startJob(job JobIn) error {
+
 	// Add the job to the job list
 	api.AppendJob(job)
 
-	if api.Guid() == "" {
+	if !api.LoggedIn() {
 		api.loginmutex.Lock()
 		if err := api.Login(); err != nil {
-			// Can't send this error to the Manager so must return it here
 			logit(fmt.Sprintf("Error: %s", err.Error()))
-			rest.Error(w, err.Error(), 400)
 			api.loginmutex.Unlock()
-			return
+			api.RemoveJob(job.JobID)
+			return err
 		}
 		api.loginmutex.Unlock()
 	}
@@ -74,40 +144,20 @@ func (api *Api) AddJob(w rest.ResponseWriter, r *rest.Request) {
 		logit(fmt.Sprintf("Error: %s", err.Error()))
 	}
 
-	w.WriteJson(job)
-
 	//a := fmt.Sprintf("%#v",job)
 	//logit(a)
 
 	go api.execCmd(job)
-}
-
-func (api *Api) DeleteJob(w rest.ResponseWriter, r *rest.Request) {
-
-	// Decode json post data into JobIn struct
-
-	logit(fmt.Sprintf("Connection from %s", r.RemoteAddr))
 
-	job := JobIn{}
-	if err := r.DecodeJsonPayload(&job); err != nil {
-		rest.Error(w, "Invalid data format received.", 400)
-		return
-	} else if job.JobID == 0 {
-		rest.Error(w, "Incorrect data format received.", 400)
-		return
-	}
-
-	// Check the password matches
+	return nil
+}
 
-	if job.Key != config.WorkerKey {
-		rest.Error(w, "Invalid key", 400)
-		return
-	}
+// killJob kills a running job and all of its child processes.
+func (api *Api) killJob(jobid int64) error {
 
-	oldjob, err := api.FindJob(job.JobID)
+	oldjob, err := api.FindJob(jobid)
 	if err != nil {
-		rest.Error(w, "Job not found", 400)
-		return
+		return ApiError{"Job not found"}
 	}
 
 	// So status can be updated correctly
@@ -116,9 +166,9 @@ func (api *Api) DeleteJob(w rest.ResponseWriter, r *rest.Request) {
 	// Kill the whole process group (-pid)
 	syscall.Kill(int(oldjob.Pid)*-1, syscall.SIGKILL)
 
-	// RemoveJob is done if the Wait fails in execCmd (exec.go)
-	// And wait will fail 'cos we just killed it.
+	// RemoveJob is done when execCmd (exec.go) returns, which it will
+	// 'cos we just killed it.
 	// //api.RemoveJob( oldjob.JobID )
 
-	w.WriteJson(job)
+	return nil
 }
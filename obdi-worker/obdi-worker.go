@@ -17,7 +17,7 @@
 package main
 
 import (
-	//"fmt"
+	"fmt"
 	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
 	"net/http"
 )
@@ -27,6 +27,20 @@ func main() {
 
 	api := NewApi()
 
+	// Send anything left over from last time
+	if err := loadSpool(); err != nil {
+		logit(fmt.Sprintf("Error: Spool directory ('%s')", err.Error()))
+	}
+	go api.replaySpool()
+
+	// Let the manager know we're here
+	go api.heartbeat()
+
+	// Fetch jobs from the manager instead of waiting for them
+	if config.PullMode {
+		go api.pullJobs()
+	}
+
 	handler := rest.ResourceHandler{
 		EnableRelaxedContentType: true,
 		//DisableJsonIndent: true,
@@ -37,6 +51,15 @@ func main() {
 		// Show jobs
 		rest.RouteObjectMethod("GET", "/jobs", &api, "ShowJobs"),
 
+		// Show a job
+		rest.RouteObjectMethod("GET", "/jobs/:id", &api, "ShowJob"),
+
+		// Worker health
+		rest.RouteObjectMethod("GET", "/health", &api, "ShowHealth"),
+
+		// Worker version
+		rest.RouteObjectMethod("GET", "/version", &api, "ShowVersion"),
+
 		// New job
 		rest.RouteObjectMethod("POST", "/jobs", &api, "AddJob"),
 
@@ -52,8 +75,14 @@ func main() {
 	http.Handle("/api/", http.StripPrefix("/api", &handler))
 
 	if config.SSLEnabled {
-		if err := http.ListenAndServeTLS(config.ListenAddr,
-			config.SSLCertFile, config.SSLKeyFile, nil); err != nil {
+		tlsConfig, err := listenerTLSConfig()
+		if err != nil {
+			logit(err.Error())
+			return
+		}
+		server := &http.Server{Addr: config.ListenAddr, TLSConfig: tlsConfig}
+		if err := server.ListenAndServeTLS(config.SSLCertFile,
+			config.SSLKeyFile); err != nil {
 			logit(err.Error())
 		}
 	} else {
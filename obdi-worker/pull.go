@@ -0,0 +1,140 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"time"
+)
+
+// What the manager sends back from a poll
+type PullReply struct {
+	Jobs  []JobIn // Jobs to start
+	Kills []JobIn // Jobs to kill, only JobID is set
+}
+
+// pullJobs long-polls the manager for jobs in this worker's environment.
+// It's used instead of the manager connecting to us when the worker is
+// behind NAT or a firewall that only allows outbound connections.
+func (api *Api) pullJobs() {
+
+	logit(fmt.Sprintf("Pull mode enabled. Polling %s for jobs in '%s/%s'.",
+		config.ManUrlPrefix, config.DcSysName, config.EnvSysName))
+
+	endpoint := func() string {
+		return api.Endpoint("pull") + "?" + url.Values{
+			"worker_name":  {config.WorkerName},
+			"dc_sys_name":  {config.DcSysName},
+			"env_sys_name": {config.EnvSysName},
+		}.Encode()
+	}
+
+	// Wait this long after an error before trying again
+	retry := 10 * time.Second
+
+	for {
+		if !api.LoggedIn() {
+			api.loginmutex.Lock()
+			err := api.Login()
+			api.loginmutex.Unlock()
+			if err != nil {
+				logit(fmt.Sprintf("Error: %s", err.Error()))
+				time.Sleep(retry)
+				continue
+			}
+		}
+
+		resp, err := api.getWithTimeout(endpoint(),
+			time.Duration(config.PullTimeout)*time.Second)
+		if err != nil {
+			logit(fmt.Sprintf("Error: %s", err.Error()))
+			time.Sleep(retry)
+			continue
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			logit(fmt.Sprintf("Error reading Body ('%s').", err.Error()))
+			time.Sleep(retry)
+			continue
+		}
+
+		if resp.StatusCode == 401 && config.WorkerToken == "" {
+			// Session expired, log in again
+			api.UpdateGuid("")
+			continue
+		}
+
+		if resp.StatusCode != 200 {
+			type myErr struct {
+				Error string
+			}
+			errstr := myErr{}
+			json.Unmarshal(body, &errstr)
+			logit(fmt.Sprintf("Polling Manager for jobs failed ('%s').",
+				errstr.Error))
+			time.Sleep(retry)
+			continue
+		}
+
+		// Only run jobs the manager signed with our key
+
+		if err := checkSignature(resp.Header, "GET",
+			resp.Request.URL.RequestURI(), body); err != nil {
+			logit(fmt.Sprintf("Rejected reply from Manager ('%s')",
+				err.Error()))
+			time.Sleep(retry)
+			continue
+		}
+
+		reply := PullReply{}
+		if err := json.Unmarshal(body, &reply); err != nil {
+			logit(fmt.Sprintf("Error decoding JSON ('%s')", err.Error()))
+			time.Sleep(retry)
+			continue
+		}
+
+		for _, job := range reply.Kills {
+			if err := api.killJob(job.JobID); err != nil {
+				logit(fmt.Sprintf("Error: Kill job %d: %s", job.JobID,
+					err.Error()))
+			}
+		}
+
+		for _, job := range reply.Jobs {
+			if err := api.resolveScript(&job, true); err != nil {
+				if err := api.sendStatus(job, JobOut{
+					Status:        STATUS_SYSCANCELLED,
+					StatusReason:  err.Error(),
+					StatusPercent: 0,
+					Errors:        0,
+				}); err != nil {
+					logit(fmt.Sprintf("Error: %s", err.Error()))
+				}
+				continue
+			}
+			if err := api.startJob(job); err != nil {
+				logit(fmt.Sprintf("Error: Start job %d: %s", job.JobID,
+					err.Error()))
+			}
+		}
+	}
+}
@@ -26,20 +26,47 @@ import (
 var config Config
 
 type Config struct {
-	Dbname           string `toml:"database_path"`
-	ListenAddr       string `toml:"listen_address"`
-	SessionTimeout   int    `toml:"session_timeout"`
-	StaticContent    string `toml:"static_content"`
-	SSLEnabled       bool   `toml:"ssl_enabled"`
-	SSLCertFile      string `toml:"ssl_cert"`
-	SSLKeyFile       string `toml:"ssl_key"`
-	WorkerKey        string `toml:"key"`
-	ScriptDir        string `toml:"script_dir"`
-	User             string `toml:"man_user"`
-	Password         string `toml:"man_password"`
-	ManUrlPrefix     string `toml:"man_urlprefix"`
-	SysScriptDir     string `toml:"system_scripts"`
-	TransportTimeout int64  `toml:"transport_timeout"` // Not used
+	Dbname            string   `toml:"database_path"`
+	ListenAddr        string   `toml:"listen_address"`
+	SessionTimeout    int      `toml:"session_timeout"`
+	StaticContent     string   `toml:"static_content"`
+	SSLEnabled        bool     `toml:"ssl_enabled"`
+	SSLCertFile       string   `toml:"ssl_cert"`
+	SSLKeyFile        string   `toml:"ssl_key"`
+	SSLClientCA       string   `toml:"ssl_client_ca"`
+	SSLClientPins     []string `toml:"ssl_client_pins"`
+	WorkerKey         string   `toml:"key"`
+	SignatureMaxAge   int64    `toml:"signature_max_age"`
+	ScriptDir         string   `toml:"script_dir"` // Not used
+	JobDir            string   `toml:"job_dir"`
+	KeepFailedJobDirs bool     `toml:"keep_failed_job_dirs"`
+	JobPath           string   `toml:"job_path"`
+	SpoolDir          string   `toml:"spool_dir"`
+	ScriptCacheDir    string   `toml:"script_cache_dir"`
+	ScriptCacheSize   int64    `toml:"script_cache_size"`
+	TrustedKeys       []string `toml:"trusted_keys"`
+	SpoolMaxBackoff   int64    `toml:"spool_max_backoff"`
+	User              string   `toml:"man_user"`
+	Password          string   `toml:"man_password"`
+	WorkerToken       string   `toml:"worker_token"`
+	ManUrlPrefix      string   `toml:"man_urlprefix"`
+	ManCA             string   `toml:"man_ca"`
+	ManPins           []string `toml:"man_pins"`
+	ManClientCert     string   `toml:"man_client_cert"`
+	ManClientKey      string   `toml:"man_client_key"`
+	ManInsecure       bool     `toml:"man_insecure"`
+	SysScriptDir      string   `toml:"system_scripts"`
+	PullMode          bool     `toml:"pull_mode"`
+	PullTimeout       int64    `toml:"pull_timeout"`
+	DcSysName         string   `toml:"dc_sys_name"`
+	EnvSysName        string   `toml:"env_sys_name"`
+	WorkerName        string   `toml:"worker_name"`
+	WorkerUrl         string   `toml:"worker_url"`
+	HeartbeatInterval int64    `toml:"heartbeat_interval"`
+	TransportTimeout  int64    `toml:"transport_timeout"` // Not used
+
+	// Interpreter name to path. Only these can run scripts.
+	Interpreters map[string]string `toml:"interpreters"`
 }
 
 func init() {
@@ -55,4 +82,43 @@ func (c *Config) Read_config() {
 		fmt.Printf("%s: %s\n", txt, err)
 		os.Exit(1)
 	}
+
+	if c.JobDir == "" {
+		c.JobDir = os.TempDir()
+	}
+	if c.WorkerName == "" {
+		c.WorkerName, _ = os.Hostname()
+	}
+	if c.SignatureMaxAge == 0 {
+		c.SignatureMaxAge = 300
+	}
+	if c.PullTimeout == 0 {
+		c.PullTimeout = 90
+	}
+	if c.HeartbeatInterval == 0 {
+		c.HeartbeatInterval = 30
+	}
+	if c.SpoolDir == "" {
+		c.SpoolDir = "/var/lib/obdi-worker/spool"
+	}
+	if len(c.Interpreters) == 0 {
+		c.Interpreters = defaultInterpreters
+	}
+	if c.ScriptCacheDir == "" {
+		c.ScriptCacheDir = "/var/lib/obdi-worker/scriptcache"
+	}
+	if c.ScriptCacheSize <= 0 {
+		c.ScriptCacheSize = 200
+	}
+	if c.SpoolMaxBackoff == 0 {
+		c.SpoolMaxBackoff = 300
+	}
+	if c.JobPath == "" {
+		c.JobPath = "/usr/local/bin:/usr/bin:/bin"
+	}
+	if _, err := trustedKeys(); err != nil {
+		logit(err.Error())
+		fmt.Printf("%s\n", err)
+		os.Exit(1)
+	}
 }
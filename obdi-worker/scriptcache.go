@@ -0,0 +1,226 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Scripts are kept in script_cache_dir, named by the SHA-256 of their
+// source, so the manager only has to send a script the first time. The
+// least recently used scripts are removed when there are more than
+// script_cache_size.
+
+var (
+	cachemutex sync.Mutex
+	hashRegexp = regexp.MustCompile("^[0-9a-f]{64}$")
+)
+
+// Returned when a job's script isn't in the cache and wasn't sent
+type ScriptNotCached struct {
+	details string
+}
+
+func (e ScriptNotCached) Error() string {
+	return e.details
+}
+
+// scriptHash returns the hex encoded SHA-256 of a script's source
+func scriptHash(source []byte) string {
+	sum := sha256.Sum256(source)
+	return hex.EncodeToString(sum[:])
+}
+
+// cachePath returns the cache file name for a hash. The hash is checked
+// so it can't be used to name a file outside the cache.
+func cachePath(hash string) (string, error) {
+	if !hashRegexp.MatchString(hash) {
+		return "", ApiError{"Invalid script hash '" + hash + "'"}
+	}
+	return filepath.Join(config.ScriptCacheDir, hash), nil
+}
+
+// cacheGet returns a script from the cache
+func cacheGet(hash string) ([]byte, bool) {
+
+	name, err := cachePath(hash)
+	if err != nil {
+		return nil, false
+	}
+
+	cachemutex.Lock()
+	defer cachemutex.Unlock()
+
+	source, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, false
+	}
+
+	// Don't trust a file that's been changed on disk
+	if scriptHash(source) != hash {
+		logit(fmt.Sprintf("Removing corrupt cached script %s", hash))
+		os.Remove(name)
+		return nil, false
+	}
+
+	// Mark it as recently used
+	now := time.Now()
+	os.Chtimes(name, now, now)
+
+	return source, true
+}
+
+// cachePut adds a script to the cache then removes the least recently
+// used scripts if the cache is too big
+func cachePut(hash string, source []byte) error {
+
+	name, err := cachePath(hash)
+	if err != nil {
+		return err
+	}
+
+	cachemutex.Lock()
+	defer cachemutex.Unlock()
+
+	if err := os.MkdirAll(config.ScriptCacheDir, 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(name+".tmp", source, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+
+	files, err := filepath.Glob(filepath.Join(config.ScriptCacheDir, "*"))
+	if err != nil || int64(len(files)) <= config.ScriptCacheSize {
+		return nil
+	}
+
+	type cached struct {
+		name string
+		used time.Time
+	}
+	entries := []cached{}
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			entries = append(entries, cached{file, info.ModTime()})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].used.Before(entries[j].used)
+	})
+	for i := 0; int64(len(entries)-i) > config.ScriptCacheSize; i++ {
+		os.Remove(entries[i].name)
+	}
+
+	return nil
+}
+
+// fetchScript gets a job's script source from the manager. The job's
+// key shows the manager the job was sent to us.
+func (api *Api) fetchScript(job JobIn) ([]byte, error) {
+
+	resp, err := api.GET(api.Endpoint("scripts/hash/"+job.ScriptHash) + "?" +
+		url.Values{
+			"job_id":  {strconv.FormatInt(job.JobID, 10)},
+			"job_key": {job.JobKey},
+		}.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		txt := fmt.Sprintf("Error reading Body ('%s').", err.Error())
+		return nil, ApiError{txt}
+	}
+
+	script := struct {
+		Source []byte
+		Error  string
+	}{}
+	if err := json.Unmarshal(body, &script); err != nil {
+		txt := fmt.Sprintf("Error decoding JSON ('%s')", err.Error())
+		return nil, ApiError{txt}
+	}
+	if resp.StatusCode != 200 {
+		txt := fmt.Sprintf("Fetching script from Manager failed ('%s').",
+			script.Error)
+		return nil, ApiError{txt}
+	}
+
+	return script.Source, nil
+}
+
+// resolveScript makes sure a job has its script source. A source sent
+// with the job is checked against its hash and cached. Otherwise the
+// cache is used and, if fetch is true, a missing script is fetched
+// from the manager.
+func (api *Api) resolveScript(job *JobIn, fetch bool) error {
+
+	// Older managers only send the source
+	if job.ScriptHash == "" {
+		if len(job.ScriptSource) == 0 {
+			return ApiError{"No script was sent"}
+		}
+		job.ScriptHash = scriptHash(job.ScriptSource)
+		return nil
+	}
+
+	if len(job.ScriptSource) == 0 {
+		source, ok := cacheGet(job.ScriptHash)
+		if ok {
+			job.ScriptSource = source
+			return nil
+		}
+		if !fetch {
+			return ScriptNotCached{"Script " + job.ScriptHash +
+				" is not in the cache"}
+		}
+		source, err := api.fetchScript(*job)
+		if err != nil {
+			return err
+		}
+		job.ScriptSource = source
+	}
+
+	if scriptHash(job.ScriptSource) != job.ScriptHash {
+		return ApiError{"Script does not match its hash"}
+	}
+
+	if err := cachePut(job.ScriptHash, job.ScriptSource); err != nil {
+		logit(fmt.Sprintf("Error: Could not cache script ('%s')",
+			err.Error()))
+	}
+
+	return nil
+}
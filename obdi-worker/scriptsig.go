@@ -0,0 +1,89 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// scriptSignedData returns what a script signature covers. The
+// interpreter is included so a signed script can't be run with a
+// different one. obdi-sign has the same function.
+func scriptSignedData(hash, interpreter string) []byte {
+	return []byte("obdi-script-v1\n" + hash + "\n" + interpreter + "\n")
+}
+
+// trustedKeys decodes the trusted_keys setting
+func trustedKeys() ([]ed25519.PublicKey, error) {
+
+	keys := []ed25519.PublicKey{}
+
+	for _, s := range config.TrustedKeys {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return keys, ApiError{fmt.Sprintf("Invalid trusted key '%s'. "+
+				"Use the public key printed by obdi-sign.", s)}
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+
+	return keys, nil
+}
+
+// checkScriptSignature returns an error unless the job's script was
+// signed with one of the trusted keys. Any script runs if there are no
+// trusted keys.
+func checkScriptSignature(job JobIn) error {
+
+	keys, err := trustedKeys()
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if job.Signature == "" {
+		return ApiError{fmt.Sprintf("Script '%s' is not signed. This "+
+			"worker only runs scripts signed with a trusted key.",
+			job.ScriptName)}
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(job.Signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return ApiError{fmt.Sprintf("Script '%s' has an invalid "+
+			"signature.", job.ScriptName)}
+	}
+
+	// Check the source we are about to run, not the hash we were sent
+	data := scriptSignedData(scriptHash(job.ScriptSource), job.Interpreter)
+
+	for _, key := range keys {
+		if ed25519.Verify(key, data, sig) {
+			return nil
+		}
+	}
+
+	return ApiError{fmt.Sprintf("Script '%s' signature does not match "+
+		"any trusted key. The script or its interpreter was changed "+
+		"after it was signed, or it was signed with an untrusted key.",
+		job.ScriptName)}
+}
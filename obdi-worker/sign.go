@@ -0,0 +1,99 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/hmac"
+	"github.com/mclarkson/obdi/common"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Nonces that have been seen recently, and when they were seen. They
+// only need to be kept for as long as their timestamp would be accepted.
+var (
+	nonces     = map[string]time.Time{}
+	noncemutex sync.Mutex
+)
+
+// isOurName returns true if a message signed for the named worker is
+// for us. The Manager names workers that aren't in its worker pool after
+// their environment. Workers without env_sys_name set can't be in a pool,
+// so they accept any name, as they did before names were signed.
+func isOurName(worker string) bool {
+	return config.EnvSysName == "" || worker == config.EnvSysName ||
+		worker == config.WorkerName
+}
+
+// checkSignature returns an error unless a message was signed with our
+// key for us, isn't too old and hasn't been seen before. uri is the
+// request URI, the path and any query string, the Manager signed. See
+// common.Signature.
+func checkSignature(h http.Header, method, uri string, body []byte) error {
+
+	timestamp := h.Get(common.HEADER_TIMESTAMP)
+	nonce := h.Get(common.HEADER_NONCE)
+	worker := h.Get(common.HEADER_WORKER)
+	sig := h.Get(common.HEADER_SIGNATURE)
+
+	if timestamp == "" || nonce == "" || sig == "" {
+		return ApiError{"Request is not signed"}
+	}
+
+	if !isOurName(worker) {
+		return ApiError{"Request is for worker '" + worker + "'. Check " +
+			"worker_name matches this worker's name in the Manager."}
+	}
+
+	expected := common.Signature(config.WorkerKey, worker, method, uri,
+		timestamp, nonce, body)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return ApiError{"Invalid signature"}
+	}
+
+	// Only signed messages get this far, so the nonce cache can't be
+	// filled up by anyone without the key
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ApiError{"Invalid timestamp"}
+	}
+	maxAge := time.Duration(config.SignatureMaxAge) * time.Second
+	age := time.Since(time.Unix(ts, 0))
+	if age > maxAge || age < -maxAge {
+		return ApiError{"Request is too old. Check the clocks on the " +
+			"Manager and worker."}
+	}
+
+	noncemutex.Lock()
+	defer noncemutex.Unlock()
+
+	for n, seen := range nonces {
+		if time.Since(seen) > 2*maxAge {
+			delete(nonces, n)
+		}
+	}
+
+	if _, ok := nonces[nonce]; ok {
+		return ApiError{"Repeated request"}
+	}
+	nonces[nonce] = time.Now()
+
+	return nil
+}
@@ -0,0 +1,270 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output lines and status updates that can't be delivered to the
+// manager are written to the spool directory, one file per message, and
+// sent again later in the order they were made.
+
+// Spool item types
+const (
+	SPOOL_OUTPUT = "output"
+	SPOOL_STATUS = "status"
+)
+
+// A message waiting in the spool
+type SpoolItem struct {
+	Type   string
+	JobID  int64
+	Line   OutputLine // Type SPOOL_OUTPUT
+	Status JobOut     // Type SPOOL_STATUS
+}
+
+// Held while a message for a job is being sent, so a later message for
+// the job can't overtake one that is about to be spooled
+type sendLock struct {
+	sync.Mutex
+	users int // Senders holding or waiting for the lock
+}
+
+var (
+	spoolmutex   sync.Mutex
+	spoolSeq     int64             // Sequence number of the last spool file
+	spoolPending = map[int64]int{} // Spooled messages for each job
+
+	// Per job, see lockJob
+	sendLocks = map[int64]*sendLock{}
+)
+
+// lockJob waits until no other message for the job is being sent
+func lockJob(jobid int64) *sendLock {
+	spoolmutex.Lock()
+	l := sendLocks[jobid]
+	if l == nil {
+		l = &sendLock{}
+		sendLocks[jobid] = l
+	}
+	l.users++
+	spoolmutex.Unlock()
+
+	l.Lock()
+	return l
+}
+
+// unlockJob releases a lock from lockJob
+func unlockJob(jobid int64, l *sendLock) {
+	l.Unlock()
+
+	spoolmutex.Lock()
+	l.users--
+	if l.users == 0 {
+		delete(sendLocks, jobid)
+	}
+	spoolmutex.Unlock()
+}
+
+// deliver sends a message to the manager
+func (api *Api) deliver(item SpoolItem) error {
+	switch item.Type {
+	case SPOOL_OUTPUT:
+		return api.deliverOutputLine(item.Line)
+	case SPOOL_STATUS:
+		return api.deliverStatus(item.JobID, item.Status)
+	}
+	return ApiError{"Unknown spool item type '" + item.Type + "'"}
+}
+
+// send delivers a message to the manager, or spools it if the manager
+// can't be reached. Messages for a job that already has messages in the
+// spool are spooled behind them so they're kept in order. Messages for
+// the same job are sent one at a time for the same reason.
+func (api *Api) send(item SpoolItem) error {
+
+	l := lockJob(item.JobID)
+	defer unlockJob(item.JobID, l)
+
+	spoolmutex.Lock()
+	if spoolPending[item.JobID] > 0 {
+		err := spoolWrite(item)
+		spoolmutex.Unlock()
+		return err
+	}
+	spoolmutex.Unlock()
+
+	err := api.deliver(item)
+	if _, ok := err.(TransientError); !ok {
+		return err
+	}
+
+	logit(fmt.Sprintf("Job %d: Spooling %s message ('%s')", item.JobID,
+		item.Type, err.Error()))
+
+	spoolmutex.Lock()
+	defer spoolmutex.Unlock()
+	if err := spoolWrite(item); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// spoolWrite adds a message to the spool. The file is written under a
+// temporary name then renamed so a crash can't leave half a message.
+// Call with spoolmutex held.
+func spoolWrite(item SpoolItem) error {
+
+	jsondata, err := json.Marshal(item)
+	if err != nil {
+		return ApiError{"Internal error: spool, JSON Encode"}
+	}
+
+	spoolSeq++
+	name := filepath.Join(config.SpoolDir, fmt.Sprintf("%016d.json",
+		spoolSeq))
+
+	if err := ioutil.WriteFile(name+".tmp", jsondata, 0600); err != nil {
+		return ApiError{"Could not write to spool ('" + err.Error() + "')"}
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		os.Remove(name + ".tmp")
+		return ApiError{"Could not write to spool ('" + err.Error() + "')"}
+	}
+
+	spoolPending[item.JobID]++
+
+	return nil
+}
+
+// spoolFiles returns the names of the spool files, oldest first
+func spoolFiles() []string {
+
+	files, err := filepath.Glob(filepath.Join(config.SpoolDir, "*.json"))
+	if err != nil {
+		return []string{}
+	}
+	sort.Strings(files)
+
+	return files
+}
+
+// loadSpool creates the spool directory and picks up messages left
+// from before a restart
+func loadSpool() error {
+
+	if err := os.MkdirAll(config.SpoolDir, 0700); err != nil {
+		return err
+	}
+
+	spoolmutex.Lock()
+	defer spoolmutex.Unlock()
+
+	files := spoolFiles()
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		item := SpoolItem{}
+		if err := json.Unmarshal(data, &item); err != nil {
+			continue
+		}
+		spoolPending[item.JobID]++
+	}
+
+	if len(files) > 0 {
+		last := strings.TrimSuffix(filepath.Base(files[len(files)-1]),
+			".json")
+		spoolSeq, _ = strconv.ParseInt(last, 10, 64)
+		logit(fmt.Sprintf("%d messages waiting in the spool.", len(files)))
+	}
+
+	return nil
+}
+
+// replaySpool sends spooled messages to the manager, oldest first.
+// While the manager can't be reached it waits longer between attempts,
+// up to spool_max_backoff seconds.
+func (api *Api) replaySpool() {
+
+	delay := time.Second
+	maxDelay := time.Duration(config.SpoolMaxBackoff) * time.Second
+
+	for {
+		time.Sleep(delay)
+
+		for _, file := range spoolFiles() {
+
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				logit(fmt.Sprintf("Error reading spool file ('%s')",
+					err.Error()))
+				break
+			}
+
+			item := SpoolItem{}
+			if err := json.Unmarshal(data, &item); err != nil {
+				logit(fmt.Sprintf("Removing bad spool file %s ('%s')",
+					file, err.Error()))
+				os.Remove(file)
+				continue
+			}
+
+			if !api.LoggedIn() {
+				api.loginmutex.Lock()
+				api.Login()
+				api.loginmutex.Unlock()
+			}
+
+			err = api.deliver(item)
+			if _, ok := err.(TransientError); ok {
+				// Try again later, from this message
+				delay *= 2
+				if delay > maxDelay {
+					delay = maxDelay
+				}
+				break
+			}
+			if err != nil {
+				logit(fmt.Sprintf("Job %d: Dropping spooled %s message "+
+					"('%s')", item.JobID, item.Type, err.Error()))
+			}
+
+			spoolmutex.Lock()
+			os.Remove(file)
+			spoolPending[item.JobID]--
+			if spoolPending[item.JobID] <= 0 {
+				delete(spoolPending, item.JobID)
+			}
+			spoolmutex.Unlock()
+
+			delay = time.Second
+		}
+	}
+}
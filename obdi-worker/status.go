@@ -0,0 +1,244 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clock ticks per second used in /proc/<pid>/stat. This is 100 on all
+// the platforms we run on.
+const CLK_TCK = 100
+
+var started = time.Now()
+
+// What's shown about a job. Anything secret, like the script and the
+// environment variables, is left out.
+type JobView struct {
+	JobID       int64
+	ScriptName  string
+	ScriptHash  string
+	Args        string
+	Type        int64
+	Pid         int64
+	StartTime   time.Time
+	Elapsed     float64 // Seconds since the process started
+	OutputBytes int64   // Bytes of output sent to the manager
+	UserCancel  bool
+	State       string  // Process state from /proc, e.g. R, S or Z
+	CpuSeconds  float64 // CPU time of the job's process group
+	MemoryRss   int64   // Resident memory of the process group in bytes
+}
+
+// A process's details from /proc/<pid>/stat
+type stat struct {
+	state string
+	pgrp  int64
+	cpu   float64 // Seconds, including children that have been waited for
+	rss   int64   // Bytes
+}
+
+// readStat reads /proc/<pid>/stat
+func readStat(pid int64) (st stat, err error) {
+
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return
+	}
+
+	// The command name is in brackets and can contain spaces, so
+	// split the fields after it
+	i := strings.LastIndex(string(data), ")")
+	if i == -1 {
+		err = ApiError{"Unexpected format in /proc/" +
+			strconv.FormatInt(pid, 10) + "/stat"}
+		return
+	}
+	fields := strings.Fields(string(data)[i+1:])
+	if len(fields) < 22 {
+		err = ApiError{"Unexpected format in /proc/" +
+			strconv.FormatInt(pid, 10) + "/stat"}
+		return
+	}
+
+	// fields[0] is field 3 in proc(5)
+	st.state = fields[0]
+	st.pgrp, _ = strconv.ParseInt(fields[2], 10, 64)
+	ticks := int64(0)
+	for _, f := range fields[11:15] { // utime, stime, cutime, cstime
+		n, _ := strconv.ParseInt(f, 10, 64)
+		ticks += n
+	}
+	pages, _ := strconv.ParseInt(fields[21], 10, 64)
+
+	st.cpu = float64(ticks) / CLK_TCK
+	st.rss = pages * int64(os.Getpagesize())
+
+	return
+}
+
+// procStat reads the state of a job's main process from /proc, and the
+// CPU time and resident memory of all the processes in its process
+// group. Jobs are started in their own session so the group's id is the
+// main process's pid.
+func procStat(pid int64) (state string, cpu float64, rss int64,
+	err error) {
+
+	st, err := readStat(pid)
+	if err != nil {
+		return
+	}
+	state = st.state
+
+	dirs, _ := ioutil.ReadDir("/proc")
+	for _, dir := range dirs {
+		p, err := strconv.ParseInt(dir.Name(), 10, 64)
+		if err != nil {
+			continue // Not a process
+		}
+		st, err := readStat(p)
+		if err != nil || st.pgrp != pid {
+			continue // Gone, or not part of the job
+		}
+		cpu += st.cpu
+		rss += st.rss
+	}
+
+	return
+}
+
+// newJobView makes the public view of a job, including live process
+// details if wanted
+func newJobView(job JobIn, live bool) JobView {
+
+	view := JobView{
+		JobID:       job.JobID,
+		ScriptName:  job.ScriptName,
+		ScriptHash:  job.ScriptHash,
+		Args:        job.Args,
+		Type:        job.Type,
+		Pid:         job.Pid,
+		StartTime:   job.StartTime,
+		OutputBytes: job.OutputSize,
+		UserCancel:  job.UserCancel,
+	}
+
+	if !job.StartTime.IsZero() {
+		view.Elapsed = time.Since(job.StartTime).Seconds()
+	}
+
+	if live && job.Pid > 0 {
+		view.State, view.CpuSeconds, view.MemoryRss, _ = procStat(job.Pid)
+	}
+
+	return view
+}
+
+// checkRequest returns an error unless the request was signed by the
+// manager
+func checkRequest(r *rest.Request) error {
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return ApiError{"Invalid data format received."}
+	}
+
+	return checkSignature(r.Header, r.Method, r.RequestURI, body)
+}
+
+// ShowJobs processes "GET /jobs" queries.
+func (api *Api) ShowJobs(w rest.ResponseWriter, r *rest.Request) {
+
+	if err := checkRequest(r); err != nil {
+		rest.Error(w, err.Error(), 401)
+		return
+	}
+
+	views := []JobView{}
+	for _, job := range api.Jobs() {
+		views = append(views, newJobView(job, false))
+	}
+
+	w.WriteJson(views)
+}
+
+// ShowJob processes "GET /jobs/:id" queries.
+func (api *Api) ShowJob(w rest.ResponseWriter, r *rest.Request) {
+
+	if err := checkRequest(r); err != nil {
+		rest.Error(w, err.Error(), 401)
+		return
+	}
+
+	jobid, err := strconv.ParseInt(r.PathParam("id"), 10, 64)
+	if err != nil {
+		rest.Error(w, "Invalid id.", 400)
+		return
+	}
+
+	job, err := api.FindJob(jobid)
+	if err != nil {
+		rest.Error(w, "Job not found.", 404)
+		return
+	}
+
+	w.WriteJson(newJobView(job, true))
+}
+
+// ShowHealth processes "GET /health" queries.
+func (api *Api) ShowHealth(w rest.ResponseWriter, r *rest.Request) {
+
+	if err := checkRequest(r); err != nil {
+		rest.Error(w, err.Error(), 401)
+		return
+	}
+
+	spoolmutex.Lock()
+	spooled := 0
+	for _, n := range spoolPending {
+		spooled += n
+	}
+	spoolmutex.Unlock()
+
+	w.WriteJson(map[string]interface{}{
+		"Status":      "OK",
+		"Name":        config.WorkerName,
+		"RunningJobs": len(api.Jobs()),
+		"Load":        loadAverage(),
+		"Uptime":      time.Since(started).Seconds(),
+		"LoggedIn":    api.LoggedIn(),
+		"Spooled":     spooled,
+		"PullMode":    config.PullMode,
+	})
+}
+
+// ShowVersion processes "GET /version" queries.
+func (api *Api) ShowVersion(w rest.ResponseWriter, r *rest.Request) {
+
+	if err := checkRequest(r); err != nil {
+		rest.Error(w, err.Error(), 401)
+		return
+	}
+
+	w.WriteJson(map[string]string{"Version": VERSION})
+}
@@ -0,0 +1,120 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"github.com/mclarkson/obdi/common"
+	"net/http"
+	"sync"
+)
+
+var (
+	manClient     *http.Client
+	manClientErr  error
+	manClientOnce sync.Once
+)
+
+// manTLSConfig builds the TLS settings used to connect to the manager.
+// The manager's certificate is checked against man_ca, or the system
+// CAs, and against man_pins if set. Checking is only turned off when
+// man_insecure is set.
+func manTLSConfig() (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{}
+
+	if config.ManInsecure {
+		logit("WARNING: man_insecure is set. The Manager's certificate " +
+			"is not checked.")
+		tlsConfig.InsecureSkipVerify = true
+	} else {
+		if config.ManCA != "" {
+			pool, err := common.LoadCertPool(config.ManCA)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if len(config.ManPins) > 0 {
+			if config.ManCA == "" {
+				// Pin only. The pin check replaces the CA check.
+				tlsConfig.InsecureSkipVerify = true
+			}
+			tlsConfig.VerifyPeerCertificate = common.CheckPins(config.ManPins)
+		}
+	}
+
+	// Identify ourselves to the manager
+	if config.ManClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.ManClientCert,
+			config.ManClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// httpClient returns the client used to send requests to the manager.
+// It's built once and reused.
+func httpClient() (*http.Client, error) {
+	manClientOnce.Do(func() {
+		tlsConfig, err := manTLSConfig()
+		if err != nil {
+			manClientErr = ApiError{
+				"TLS setup failed ('" + err.Error() + "')"}
+			logit(manClientErr.Error())
+			return
+		}
+		manClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+	})
+	return manClient, manClientErr
+}
+
+// listenerTLSConfig builds the TLS settings for the worker's listener.
+// Only the Manager connects to a worker, so when ssl_client_ca or
+// ssl_client_pins is set every connection must have a client
+// certificate. It must be signed by ssl_client_ca, if set, and match one
+// of ssl_client_pins, if set. Pins can be used without a CA, for a
+// self-signed certificate.
+func listenerTLSConfig() (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{}
+
+	if config.SSLClientCA != "" {
+		pool, err := common.LoadCertPool(config.SSLClientCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	} else if len(config.SSLClientPins) > 0 {
+		// Pin only. The pin check replaces the CA check.
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	}
+
+	if len(config.SSLClientPins) > 0 {
+		tlsConfig.VerifyPeerCertificate =
+			common.CheckPins(config.SSLClientPins)
+	}
+
+	return tlsConfig, nil
+}
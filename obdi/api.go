@@ -78,7 +78,11 @@ func (api *Api) DecrementPort() {
 func (api *Api) TouchSession(guid string) {
 	session := Session{}
 	mutex.Lock()
-	api.db.Where("guid = ?", guid).First(&session)
+	// API tokens don't have a session
+	if api.db.Where("guid = ?", guid).First(&session).RecordNotFound() {
+		mutex.Unlock()
+		return
+	}
 	session.UpdatedAt = time.Now()
 	api.db.Save(&session)
 	mutex.Unlock()
@@ -100,7 +104,15 @@ func (e ApiError) Error() string {
 	return fmt.Sprintf("%s", e.details)
 }
 
-func (api *Api) CheckLoginNoExpiry(login, guid string) (Session, error) {
+// checkWorkerSession is checkSession for the routes workers use while a
+// job runs. A worker's session still works for SESSION_WORKER_GRACE
+// minutes after it expires, so output isn't lost while the worker logs
+// in again. Other users' sessions expire as usual.
+func (api *Api) checkWorkerSession(login, guid string) (Session, error) {
+
+	if isApiToken(guid) {
+		return api.checkApiToken(login, guid)
+	}
 
 	user := User{}
 	session := Session{}
@@ -111,22 +123,33 @@ func (api *Api) CheckLoginNoExpiry(login, guid string) (Session, error) {
 		mutex.Unlock()
 		return session, ApiError{"Invalid credentials."}
 	}
-	// select * from sessions where user_id = user.userid
-	if err := api.db.Model(&user).Related(&session).Error; err != nil {
+	// A user can have several sessions, the GUID says which
+	if api.db.Where("guid = ? and user_id = ?", guid, user.Id).
+		First(&session).RecordNotFound() {
 		mutex.Unlock()
 		return session, ApiError{"Not logged in."}
 	}
 	mutex.Unlock()
 
-	// Check GUID
-	if session.Guid != guid {
-		return session, ApiError{"Invalid GUID."}
+	expiry := sessionExpiry()
+	if user.Role == ROLE_WORKER {
+		expiry = expiry.Add(-SESSION_WORKER_GRACE * time.Minute)
+	}
+	if session.UpdatedAt.Before(expiry) {
+		return session, ApiError{"Session expired."}
 	}
 
 	return session, nil
 }
 
-func (api *Api) CheckLogin(login, guid string) (Session, error) {
+// checkSession returns the user's session if the GUID is right and the
+// session hasn't expired. AuthMiddleware checks if the session is
+// restricted.
+func (api *Api) checkSession(login, guid string) (Session, error) {
+
+	if isApiToken(guid) {
+		return api.checkApiToken(login, guid)
+	}
 
 	user := User{}
 	session := Session{}
@@ -139,19 +162,15 @@ func (api *Api) CheckLogin(login, guid string) (Session, error) {
 	}
 	mutex.Unlock()
 
-	// select * from sessions where user_id = user.userid
+	// A user can have several sessions, the GUID says which
 	mutex.Lock()
-	if err := api.db.Model(&user).Related(&session).Error; err != nil {
+	if api.db.Where("guid = ? and user_id = ?", guid, user.Id).
+		First(&session).RecordNotFound() {
 		mutex.Unlock()
 		return session, ApiError{"Not logged in."}
 	}
 	mutex.Unlock()
 
-	// Check GUID
-	if session.Guid != guid {
-		return session, ApiError{"Invalid GUID."}
-	}
-
 	// Check session age
 	delta := time.Now().Sub(session.UpdatedAt)
 	if delta.Minutes() > float64(config.SessionTimeout) {
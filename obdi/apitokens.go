@@ -0,0 +1,280 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// API tokens let scripts use the API without logging in. A token is sent
+// in place of the session GUID, with the user's login, and lasts until
+// it expires or is revoked. A token can be limited to a role that the
+// user's role includes, and to one environment.
+//
+// Tokens don't have a session. Activity from one is logged with a
+// session id of minus the token's id.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	API_TOKEN_PREFIX = "obdi_" // Tells tokens and GUIDs apart
+	API_TOKEN_DAYS   = 90      // Expiry if none is given
+)
+
+// isApiToken returns true if the GUID from the URL is an API token
+func isApiToken(guid string) bool {
+	return strings.HasPrefix(guid, API_TOKEN_PREFIX)
+}
+
+// checkApiToken is checkSession for API tokens. It returns a session for
+// the token that is never saved.
+func (api *Api) checkApiToken(login, token string) (Session, error) {
+
+	user := User{}
+	apiToken := ApiToken{}
+
+	mutex.Lock()
+	if err := api.db.Where("login = ?", login).First(&user).Error; err != nil {
+		mutex.Unlock()
+		return Session{}, ApiError{"Invalid credentials."}
+	}
+	if api.db.Where("token_hash = ? and user_id = ?", hashToken(token),
+		user.Id).First(&apiToken).RecordNotFound() {
+		mutex.Unlock()
+		return Session{}, ApiError{"Invalid API token."}
+	}
+	mutex.Unlock()
+
+	if !user.Enabled {
+		return Session{}, ApiError{"User is disabled."}
+	}
+	if time.Now().After(apiToken.ExpiresAt) {
+		return Session{}, ApiError{"API token expired."}
+	}
+
+	apiToken.LastUsedAt = time.Now()
+	mutex.Lock()
+	api.db.Save(&apiToken)
+	mutex.Unlock()
+
+	return Session{
+		Id:         -apiToken.Id,
+		Guid:       token,
+		UserId:     user.Id,
+		TokenId:    apiToken.Id,
+		TokenRole:  apiToken.Role,
+		TokenEnvId: apiToken.EnvId,
+	}, nil
+}
+
+// GetAllApiTokens processes "GET /apitokens" queries. Users see their
+// own tokens. Those who can read users can see anyone's with user_id.
+func (api *Api) GetAllApiTokens(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	userId := session.UserId
+	qs := r.URL.Query() // Query string - map[string][]string
+	if len(qs["user_id"]) > 0 {
+		errl = api.Authorize(session, RESOURCE_USERS, ACTION_READ)
+		if errl != nil {
+			rest.Error(w, errl.Error(), 400)
+			return
+		}
+		id, err := strconv.ParseInt(qs["user_id"][0], 10, 64)
+		if err != nil {
+			rest.Error(w, "Invalid user_id.", 400)
+			return
+		}
+		userId = id
+	}
+
+	apiTokens := []ApiToken{}
+	mutex.Lock()
+	api.db.Order("name").Find(&apiTokens, "user_id = ?", userId)
+	mutex.Unlock()
+
+	// Create a slice of maps from apiTokens struct
+	// to selectively copy database fields for display
+
+	u := make([]map[string]interface{}, len(apiTokens))
+	for i := range apiTokens {
+		u[i] = make(map[string]interface{})
+		u[i]["Id"] = apiTokens[i].Id
+		u[i]["UserId"] = apiTokens[i].UserId
+		u[i]["Name"] = apiTokens[i].Name
+		u[i]["Role"] = apiTokens[i].Role
+		u[i]["EnvId"] = apiTokens[i].EnvId
+		u[i]["ExpiresAt"] = apiTokens[i].ExpiresAt
+		u[i]["Expired"] = time.Now().After(apiTokens[i].ExpiresAt)
+		u[i]["LastUsedAt"] = apiTokens[i].LastUsedAt
+		u[i]["CreatedAt"] = apiTokens[i].CreatedAt
+	}
+
+	w.WriteJson(&u)
+}
+
+// AddApiToken processes "POST /apitokens" queries. It makes a token for
+// the logged in user. The token is only sent back this once.
+func (api *Api) AddApiToken(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+
+	// Otherwise a leaked token could be used to make more
+
+	if session.TokenId != 0 {
+		rest.Error(w, "Log in to make API tokens.", 400)
+		return
+	}
+
+	tokenData := ApiToken{}
+	if err := r.DecodeJsonPayload(&tokenData); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	} else if len(tokenData.Name) == 0 {
+		rest.Error(w, "Incorrect data format received.", 400)
+		return
+	}
+
+	// Can't add if it exists already
+
+	apiToken := ApiToken{}
+	mutex.Lock()
+	if !api.db.Find(&apiToken, "user_id = ? and name = ?", session.UserId,
+		tokenData.Name).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record exists.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	// The scope can only narrow what the user can do
+
+	if tokenData.Role != "" {
+		if err := checkRole(tokenData.Role); err != nil {
+			rest.Error(w, err.Error(), 400)
+			return
+		}
+		if !roleIncludes(api.sessionRole(session), tokenData.Role) {
+			rest.Error(w, "Your role does not include role '"+
+				tokenData.Role+"'.", 400)
+			return
+		}
+	}
+	if tokenData.EnvId != 0 && !api.canReadEnv(session, tokenData.EnvId) {
+		rest.Error(w, "Environment not found.", 400)
+		return
+	}
+
+	if tokenData.ExpiresAt.IsZero() {
+		tokenData.ExpiresAt = time.Now().AddDate(0, 0, API_TOKEN_DAYS)
+	} else if time.Now().After(tokenData.ExpiresAt) {
+		rest.Error(w, "ExpiresAt is in the past.", 400)
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		rest.Error(w, err.Error(), 500)
+		return
+	}
+	token := API_TOKEN_PREFIX + hex.EncodeToString(b)
+
+	apiToken = ApiToken{
+		UserId:    session.UserId,
+		Name:      tokenData.Name,
+		TokenHash: hashToken(token),
+		Role:      tokenData.Role,
+		EnvId:     tokenData.EnvId,
+		ExpiresAt: tokenData.ExpiresAt,
+	}
+
+	mutex.Lock()
+	if err := api.db.Save(&apiToken).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	api.LogActivity(session.Id, fmt.Sprintf("Added API token '%s' "+
+		"expiring %s.", apiToken.Name,
+		apiToken.ExpiresAt.Format(time.RFC3339)))
+
+	w.WriteJson(map[string]interface{}{
+		"Id":        apiToken.Id,
+		"Name":      apiToken.Name,
+		"Token":     token,
+		"ExpiresAt": apiToken.ExpiresAt,
+	})
+}
+
+// DeleteApiToken processes "DELETE /apitokens/:id" queries. Users can
+// revoke their own tokens, and those who can change users anyone's.
+func (api *Api) DeleteApiToken(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	id := r.PathParam("id")
+
+	// Check that the id string is a number
+	if _, err := strconv.Atoi(id); err != nil {
+		rest.Error(w, "Invalid id.", 400)
+		return
+	}
+
+	apiToken := ApiToken{}
+	mutex.Lock()
+	if api.db.Find(&apiToken, id).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	if apiToken.UserId != session.UserId {
+		errl = api.Authorize(session, RESOURCE_USERS, ACTION_WRITE)
+		if errl != nil {
+			rest.Error(w, errl.Error(), 400)
+			return
+		}
+	}
+
+	mutex.Lock()
+	if err := api.db.Delete(&apiToken).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	api.LogActivity(session.Id, "Revoked API token '"+apiToken.Name+"'.")
+
+	w.WriteJson("Success")
+}
@@ -0,0 +1,260 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// Authentication for the REST API. AuthMiddleware checks the credentials
+// for every route except the public ones, before routing, so handlers
+// only have to ask for the session with authSession().
+//
+// Credentials can be sent in three ways:
+//
+//   Authorization: Bearer <GUID or API token>   GET /api/envs
+//   Cookie: obdi_session=<GUID>                  GET /api/envs
+//   In the path (deprecated)            GET /api/<login>/<GUID>/envs
+//
+// The path form puts the GUID in access logs, proxy logs and browser
+// history, so it can be turned off with disable_path_credentials. Go
+// plugins call back into the manager on 127.0.0.1 with the path form,
+// so it always works from there.
+// Header and cookie requests are rewritten to the path form before
+// routing, so the routes, and the PathParams that plugins use, don't
+// change.
+
+import (
+	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const SESSION_COOKIE = "obdi_session"
+
+// Routes that don't need credentials. A trailing slash matches anything
+// under it.
+var publicPaths = []string{
+	"/login",
+	"/login/totp",
+	"/oidc",
+	"/oidc/login",
+	"/oidc/callback",
+	"/oidc/ticket",
+	"/worker/register",
+	"/worker/heartbeat",
+	"/worker/pull",
+	"/worker/outputlines",
+	"/worker/jobs/",
+	"/worker/scripts/hash/",
+}
+
+type AuthMiddleware struct {
+	api *Api
+}
+
+func isPublicPath(p string) bool {
+
+	for _, public := range publicPaths {
+		if p == public ||
+			(strings.HasSuffix(public, "/") && strings.HasPrefix(p, public)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pathCredentials splits "/<login>/<GUID>/rest" into its parts. It only
+// succeeds if the second part is a GUID or an API token.
+func pathCredentials(p string) (login, guid, rest string, ok bool) {
+
+	parts := strings.SplitN(p, "/", 4)
+	if len(parts) < 4 || parts[1] == "" {
+		return "", "", "", false
+	}
+	if !IsGUID(parts[2]) && !isApiToken(parts[2]) {
+		return "", "", "", false
+	}
+
+	return parts[1], parts[2], "/" + parts[3], true
+}
+
+// headerCredentials returns the GUID or API token from the Authorization
+// header or, failing that, the session cookie
+func headerCredentials(r *rest.Request) string {
+
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+
+	if cookie, err := r.Cookie(SESSION_COOKIE); err == nil {
+		return cookie.Value
+	}
+
+	return ""
+}
+
+// guidLogin returns the login of the user that owns a GUID or API token
+func (api *Api) guidLogin(guid string) (string, error) {
+
+	user := User{}
+	userId := int64(0)
+
+	mutex.Lock()
+	if isApiToken(guid) {
+		apiToken := ApiToken{}
+		if !api.db.Where("token_hash = ?", hashToken(guid)).
+			First(&apiToken).RecordNotFound() {
+			userId = apiToken.UserId
+		}
+	} else {
+		session := Session{}
+		if !api.db.Where("guid = ?", guid).
+			First(&session).RecordNotFound() {
+			userId = session.UserId
+		}
+	}
+	if userId == 0 || api.db.First(&user, userId).RecordNotFound() {
+		mutex.Unlock()
+		return "", ApiError{"Not logged in."}
+	}
+	mutex.Unlock()
+
+	return user.Login, nil
+}
+
+// isLoopback returns true for requests from the manager's own host
+func isLoopback(remoteAddr string) bool {
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// restrictedPath returns true if a restricted session, for a user that
+// must set up two-factor authentication first, can use the route
+func restrictedPath(p string) bool {
+	return p == "/logout" || p == "/totp" || strings.HasPrefix(p, "/totp/")
+}
+
+// expiringPath returns false for routes that a worker can use for a
+// while after its session has expired, see checkWorkerSession
+func expiringPath(method, p string) bool {
+	return !(method == "POST" && p == "/outputlines")
+}
+
+func (mw *AuthMiddleware) MiddlewareFunc(h rest.HandlerFunc) rest.HandlerFunc {
+
+	return func(w rest.ResponseWriter, r *rest.Request) {
+
+		if isPublicPath(r.URL.Path) {
+			h(w, r)
+			return
+		}
+
+		// Find the credentials
+
+		login, guid, path, ok := pathCredentials(r.URL.Path)
+		if ok {
+			if config.DisablePathCredentials && !isLoopback(r.RemoteAddr) {
+				rest.Error(w, "Credentials in the URL are disabled. "+
+					"Use the Authorization header.", 401)
+				return
+			}
+			w.Header().Set("Deprecation", "true")
+		} else {
+			guid = headerCredentials(r)
+			if guid == "" {
+				rest.Error(w, "Not logged in.", 401)
+				return
+			}
+			var err error
+			if login, err = mw.api.guidLogin(guid); err != nil {
+				rest.Error(w, err.Error(), 401)
+				return
+			}
+			path = r.URL.Path
+		}
+
+		// Check them
+
+		session := Session{}
+		var errl error
+		if expiringPath(r.Method, path) {
+			session, errl = mw.api.checkSession(login, guid)
+		} else {
+			session, errl = mw.api.checkWorkerSession(login, guid)
+		}
+		if errl != nil {
+			rest.Error(w, errl.Error(), 401)
+			return
+		}
+
+		if session.Restricted && !restrictedPath(path) {
+			rest.Error(w, "Set up two-factor authentication first.", 401)
+			return
+		}
+
+		r.Env["SESSION"] = session
+
+		// Route header and cookie requests as if the credentials were
+		// in the path, then put the URL back for the access log
+
+		if !ok {
+			origUrl := r.URL
+			u := *r.URL
+			u.Path = "/" + login + "/" + guid + path
+			u.RawPath = ""
+			r.URL = &u
+			defer func() { r.URL = origUrl }()
+		}
+
+		h(w, r)
+
+		if expiringPath(r.Method, path) {
+			mw.api.TouchSession(guid)
+		}
+	}
+}
+
+// authSession returns the session AuthMiddleware found for the request
+func authSession(r *rest.Request) Session {
+	session, _ := r.Env["SESSION"].(Session)
+	return session
+}
+
+// setSessionCookie sends the session GUID as a cookie that scripts in
+// the browser can't read
+func setSessionCookie(w rest.ResponseWriter, guid string) {
+
+	cookie := &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    guid,
+		Path:     "/api/",
+		HttpOnly: true,
+		Secure:   config.SSLEnabled,
+		SameSite: http.SameSiteStrictMode,
+	}
+	if guid == "" {
+		cookie.MaxAge = -1
+	}
+
+	http.SetCookie(w.(http.ResponseWriter), cookie)
+}
@@ -26,16 +26,23 @@ import (
 
 // Maps to the users table
 type User struct {
-	Id        int64
-	Login     string `sql:"not null"`
-	Forename  string
-	Surname   string
-	Passhash  string
-	Enabled   bool
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	DeletedAt time.Time
-	Email     string
+	Id              int64
+	Login           string `sql:"not null"`
+	Forename        string
+	Surname         string
+	Passhash        string
+	Enabled         bool
+	Role            string    // One of the ROLE_* constants
+	AuthSource      string    // Where the password is checked, AUTH_*
+	TotpSecret      string    `json:"-"` // Base32, see totp.go
+	TotpEnabled     bool      `json:"-"` // Set when enrolment is confirmed
+	TotpLastStep    int64     `json:"-"` // So a code can't be used twice
+	TotpFailures    int64     `json:"-"` // Wrong codes in a row at login
+	TotpLockedUntil time.Time `json:"-"` // No codes accepted until then
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	DeletedAt       time.Time
+	Email           string
 
 	//Session     Session
 	//SessionId   sql.NullInt64
@@ -44,12 +51,20 @@ type User struct {
 
 // Maps to the sessions table
 type Session struct {
-	Id        int64
-	Guid      string
-	UserId    int64 `sql:"not null"`
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	DeletedAt time.Time
+	Id         int64
+	Guid       string
+	UserId     int64 `sql:"not null"`
+	Restricted bool  // Can only set up two-factor authentication
+	ClientIp   string
+	UserAgent  string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time // Last used
+	DeletedAt  time.Time
+
+	// Only set when an API token is used in place of a GUID
+	TokenId    int64  `sql:"-"`
+	TokenRole  string `sql:"-"`
+	TokenEnvId int64  `sql:"-"`
 }
 
 // Application log
@@ -71,11 +86,35 @@ type Env struct {
 	DcId               int64
 	//WorkerIp    string      // Hostname or IP address of worker
 	//WorkerPort  string      // Port the worker listens on
-	WorkerUrl string // Worker URL Prefix
-	WorkerKey string // Key (password) for worker
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	DeletedAt time.Time
+	WorkerUrl    string // Worker URL Prefix
+	WorkerKey    string // Key (password) for worker
+	PullMode     bool   // Workers fetch jobs from the manager
+	TotpRequired bool   // Users who can run jobs here need 2FA
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	DeletedAt    time.Time
+}
+
+// A worker in an environment's pool of workers. Workers are added by
+// the admin or when a worker registers with the manager.
+type Worker struct {
+	Id          int64
+	EnvId       int64
+	Name        string // Worker name, the worker's hostname by default
+	Url         string // Worker URL Prefix, Env.WorkerUrl if empty
+	ReportedUrl string // The URL the worker sent, for an admin to approve
+	Key         string // Key (password) for worker, Env.WorkerKey if empty
+	Weight      int64  // Relative share of the environment's jobs
+	Enabled     bool
+	TokenHash   string `json:"-"` // SHA-256 of the worker's API token
+	Hostname    string
+	Version     string
+	RunningJobs int64
+	Load        float64 // 1 minute load average
+	LastSeen    time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	DeletedAt   time.Time
 }
 
 type Dc struct {
@@ -112,9 +151,11 @@ type EnvCapMap struct {
 }
 
 // Permissions
+// A Perm is for a user or for a group. See groups.go.
 type Perm struct {
 	Id        int64
 	UserId    int64
+	GroupId   int64
 	EnvId     int64
 	Writeable bool
 	Enabled   bool
@@ -123,32 +164,127 @@ type Perm struct {
 	DeletedAt time.Time
 }
 
-type Script struct {
+// Lets a user run a script. See scriptperms.go.
+type ScriptPerm struct {
+	Id        int64
+	ScriptId  int64
+	UserId    int64
+	GroupId   int64
+	EnvId     int64 // 0 for any environment
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt time.Time
+}
+
+// Users in a group get the group's Perms and ScriptPerms
+type Group struct {
 	Id        int64
 	Name      string
 	Desc      string
-	Source    []byte
-	Type      string
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt time.Time
 }
 
+type GroupMember struct {
+	Id        int64
+	GroupId   int64
+	UserId    int64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt time.Time
+}
+
+// A long lived token that can be used in place of a session GUID, by
+// scripts. Only the hash is stored. See apitokens.go.
+type ApiToken struct {
+	Id         int64
+	UserId     int64
+	Name       string
+	TokenHash  string `json:"-"` // SHA-256 of the token, see hashToken
+	Role       string // Use this role, not the user's, if set
+	EnvId      int64  // Only this environment if set
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	DeletedAt  time.Time
+}
+
+// A one-time code for when a user's authenticator is lost. Only the hash
+// is stored and the code is deleted when it's used.
+type TotpRecoveryCode struct {
+	Id        int64
+	UserId    int64
+	CodeHash  string // SHA-256 of the code, see hashToken
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt time.Time
+}
+
+type Script struct {
+	Id          int64
+	Name        string
+	Desc        string
+	Source      []byte
+	Type        string
+	Interpreter string // bash, sh, python, perl, a full path, or empty
+	Hash        string // SHA-256 of Source, hex encoded
+	Revision    int64  // The current ScriptRevision
+	Signature   string // Made with obdi-sign, checked by workers
+	Comment     string `sql:"-"` // Sent with changes for the revision
+	Managed     bool   // Synced from script_sync_dir, not editable
+	SyncPath    string // The file it was synced from
+	Restricted  bool   // Only users with a ScriptPerm can run it
+
+	ValidationOk       bool   // Passed the checks in validate.go
+	ValidationReport   string // Errors and warnings, one per line
+	ValidationOverride bool   // An admin let it run anyway
+	ValidatedAt        time.Time
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt time.Time
+}
+
+// A saved version of a script. Revisions are never changed or deleted.
+type ScriptRevision struct {
+	Id          int64
+	ScriptId    int64
+	Revision    int64 // Counts up from 1 for each script
+	Source      []byte
+	Hash        string
+	Interpreter string
+	Signature   string
+	Author      string // Login of the user that made the change
+	Comment     string
+	CreatedAt   time.Time
+}
+
 type Job struct {
-	Id            int64
-	ScriptId      int64
-	Args          string // E.g. `-a -f "bob 1" name`
-	EnvVars       string // E.g. `A:1 B:"Hi there" C:3`
-	Status        int64
-	StatusReason  string
-	StatusPercent int64
-	CreatedAt     time.Time
-	UpdatedAt     time.Time
-	DeletedAt     time.Time
-	UserLogin     string
-	Errors        int64
-	EnvId         int64 // For WorkerUrl and WorkerKey
-	Type          int64 // 1 - user job, 2 - system job
+	Id             int64
+	ScriptId       int64
+	Args           string // E.g. `-a -f "bob 1" name`
+	EnvVars        string // E.g. `A:1 B:"Hi there" C:3`
+	Status         int64
+	StatusReason   string
+	StatusPercent  int64
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	DeletedAt      time.Time
+	UserLogin      string
+	Errors         int64
+	EnvId          int64 // For WorkerUrl and WorkerKey
+	Type           int64 // 1 - user job, 2 - system job
+	Pending        bool  // Pull mode: waiting for a worker to collect it
+	KillPending    bool  // Pull mode: waiting for a worker to kill it
+	WorkerId       int64 // The worker the job was sent to
+	WorkerName     string
+	ScriptHash     string // SHA-256 of the script source that was sent
+	ScriptRevision int64  // The revision of the script that was sent
+	Collected      bool   // Pull mode: collected, not yet started
+	CollectedAt    time.Time
+	KeyHash        string `json:"-"` // SHA-256 of the key sent with the job
 }
 
 type OutputLine struct {
@@ -212,6 +348,14 @@ func (db *Database) InitDB() {
 		txt := "AutoMigrate Env table failed"
 		log.Fatal(fmt.Sprintf("%s: %s", txt, err))
 	}
+	if err := db.dB.AutoMigrate(Worker{}).Error; err != nil {
+		txt := "AutoMigrate Worker table failed"
+		log.Fatal(fmt.Sprintf("%s: %s", txt, err))
+	}
+	if err := db.dB.AutoMigrate(ScriptRevision{}).Error; err != nil {
+		txt := "AutoMigrate ScriptRevision table failed"
+		log.Fatal(fmt.Sprintf("%s: %s", txt, err))
+	}
 	if err := db.dB.AutoMigrate(Dc{}).Error; err != nil {
 		txt := "AutoMigrate Dc table failed"
 		log.Fatal(fmt.Sprintf("%s: %s", txt, err))
@@ -248,6 +392,26 @@ func (db *Database) InitDB() {
 		txt := "AutoMigrate OutputLine table failed"
 		log.Fatal(fmt.Sprintf("%s: %s", txt, err))
 	}
+	if err := db.dB.AutoMigrate(ScriptPerm{}).Error; err != nil {
+		txt := "AutoMigrate ScriptPerm table failed"
+		log.Fatal(fmt.Sprintf("%s: %s", txt, err))
+	}
+	if err := db.dB.AutoMigrate(Group{}).Error; err != nil {
+		txt := "AutoMigrate Group table failed"
+		log.Fatal(fmt.Sprintf("%s: %s", txt, err))
+	}
+	if err := db.dB.AutoMigrate(GroupMember{}).Error; err != nil {
+		txt := "AutoMigrate GroupMember table failed"
+		log.Fatal(fmt.Sprintf("%s: %s", txt, err))
+	}
+	if err := db.dB.AutoMigrate(TotpRecoveryCode{}).Error; err != nil {
+		txt := "AutoMigrate TotpRecoveryCode table failed"
+		log.Fatal(fmt.Sprintf("%s: %s", txt, err))
+	}
+	if err := db.dB.AutoMigrate(ApiToken{}).Error; err != nil {
+		txt := "AutoMigrate ApiToken table failed"
+		log.Fatal(fmt.Sprintf("%s: %s", txt, err))
+	}
 	if err := db.dB.AutoMigrate(Script{}).Error; err != nil {
 		txt := "AutoMigrate Script table failed"
 		log.Fatal(fmt.Sprintf("%s: %s", txt, err))
@@ -261,15 +425,35 @@ func (db *Database) InitDB() {
 		log.Fatal(fmt.Sprintf("%s: %s", txt, err))
 	}
 
+	db.restrictGrantedScripts()
+	db.fillAddedColumns()
+
 	// Unique index is also a constraint. So these are forced to be unique
 	db.dB.Model(User{}).AddUniqueIndex("idx_login", "login")
 	db.dB.Model(Plugin{}).AddIndex("idx_name", "name")
 	db.dB.Model(Session{}).AddIndex("idx_user_id", "user_id")
+	db.dB.Model(Session{}).AddIndex("idx_session_guid", "guid")
 	db.dB.Model(Activity{}).AddIndex("idx_session_id", "session_id")
 	db.dB.Model(Script{}).AddIndex("idx_script_name", "name")
+	db.dB.Model(Script{}).AddIndex("idx_script_hash", "hash")
+	db.dB.Model(ScriptRevision{}).AddIndex("idx_scriptrevision_script_id",
+		"script_id", "revision")
+	db.dB.Model(ScriptRevision{}).AddIndex("idx_scriptrevision_hash", "hash")
+	db.dB.Model(ScriptPerm{}).AddIndex("idx_scriptperm_script_id",
+		"script_id", "user_id")
+	db.dB.Model(Perm{}).AddIndex("idx_perm_group_id", "group_id")
+	db.dB.Model(ScriptPerm{}).AddIndex("idx_scriptperm_group_id", "group_id")
+	db.dB.Model(GroupMember{}).AddIndex("idx_groupmember_user_id",
+		"user_id", "group_id")
+	db.dB.Model(TotpRecoveryCode{}).AddIndex("idx_recoverycode_user_id",
+		"user_id")
+	db.dB.Model(ApiToken{}).AddIndex("idx_apitoken_token_hash",
+		"token_hash")
+	db.dB.Model(Worker{}).AddIndex("idx_worker_env_id", "env_id")
+	db.dB.Model(Worker{}).AddIndex("idx_worker_token_hash", "token_hash")
 	// TODO: OutputLines table should be in a separate DB file if
 	// TODO: performance drops.
-	db.dB.Model(OutputLine{}).AddIndex("idx_id_serial", "job_id", "serial")
+	db.uniqueOutputLines()
 
 	logit("Sqlite3 database " + dbname + " opened")
 }
@@ -289,20 +473,190 @@ func (db *Database) CreateAdminAccount() {
 
 		db.dB.Where(User{Login: "admin"}).
 			Attrs(User{
-			Passhash: string(c.Hash),
-			Forename: "Admin",
-			Surname:  "User",
-			Email:    "admin@invalid",
-		}).FirstOrCreate(&user)
+				Passhash:   string(c.Hash),
+				Forename:   "Admin",
+				Surname:    "User",
+				Email:      "admin@invalid",
+				Role:       ROLE_ADMIN,
+				AuthSource: AUTH_LOCAL,
+			}).FirstOrCreate(&user)
 
 		logit("Admin user created")
 	}
+
+	db.setDefaultRoles()
+}
+
+// setDefaultRoles gives a role to users created before there were roles.
+// The admin user keeps full access, worker logins become workers and
+// everyone else becomes an operator, which is what they could do before.
+// Worker logins are the "worker" user, the worker_client_users and users
+// that have logged in with Go's HTTP client, as workers do.
+func (db *Database) setDefaultRoles() {
+
+	users := []User{}
+	db.dB.Where("role = '' OR role IS NULL").Find(&users)
+
+	for _, user := range users {
+		user.Role = ROLE_OPERATOR
+		if user.Login == "admin" {
+			user.Role = ROLE_ADMIN
+		} else if user.Login == "worker" {
+			user.Role = ROLE_WORKER
+		}
+		for _, login := range config.WorkerClientUsers {
+			if login == user.Login {
+				user.Role = ROLE_WORKER
+			}
+		}
+		if user.Role == ROLE_OPERATOR && db.hasWorkerSession(user.Id) {
+			user.Role = ROLE_WORKER
+		}
+		db.dB.Model(&user).UpdateColumn("role", user.Role)
+		text := fmt.Sprintf("User '%s' given role '%s'", user.Login,
+			user.Role)
+		if user.Role == ROLE_OPERATOR {
+			text += ". If a worker logs in as this user, an admin " +
+				"must change its role to 'worker'."
+		}
+		logit(text)
+	}
+}
+
+// hasWorkerSession returns true if the user has logged in with Go's HTTP
+// client. Browsers send their own user agent.
+func (db *Database) hasWorkerSession(userid int64) bool {
+
+	count := 0
+	db.dB.Table("sessions").Where("user_id = ? AND user_agent LIKE 'Go%'",
+		userid).Count(&count)
+
+	return count > 0
+}
+
+// restrictGrantedScripts restricts the scripts that have ScriptPerms when
+// the restricted column is added. Before then having a ScriptPerm was
+// what restricted a script.
+func (db *Database) restrictGrantedScripts() {
+
+	ids := []int64{}
+	db.dB.Model(ScriptPerm{}).Pluck("script_id", &ids)
+	if len(ids) == 0 {
+		return
+	}
+
+	sql := "UPDATE scripts SET restricted = ? WHERE restricted IS NULL " +
+		"AND id IN (?)"
+	if err := db.dB.Exec(sql, true, ids).Error; err != nil {
+		txt := "Restricting scripts with script permissions failed"
+		log.Fatal(fmt.Sprintf("%s: %s", txt, err))
+	}
+}
+
+// uniqueOutputLines replaces the old output line index with a unique
+// one, so a line a worker sends twice is only saved once. Lines saved
+// twice before then are removed first.
+func (db *Database) uniqueOutputLines() {
+
+	count := 0
+	db.dB.Table("sqlite_master").Where("type = 'index' and name = ?",
+		"idx_outputline_job_serial").Count(&count)
+	if count > 0 {
+		return
+	}
+
+	sql := "DELETE FROM output_lines WHERE id NOT IN " +
+		"(SELECT min(id) FROM output_lines GROUP BY job_id, serial)"
+	if err := db.dB.Exec(sql).Error; err != nil {
+		txt := "Removing repeated output lines failed"
+		log.Fatal(fmt.Sprintf("%s: %s", txt, err))
+	}
+
+	db.dB.Exec("DROP INDEX IF EXISTS idx_id_serial")
+	sql = "CREATE UNIQUE INDEX idx_outputline_job_serial " +
+		"ON output_lines(job_id, serial)"
+	if err := db.dB.Exec(sql).Error; err != nil {
+		txt := "Adding the output line index failed"
+		log.Fatal(fmt.Sprintf("%s: %s", txt, err))
+	}
 }
 
 func (db *Database) DB() *gorm.DB {
 	return &db.dB
 }
 
+// Columns added to tables that already existed, with the value rows
+// saved before the column was added should get. AutoMigrate leaves them
+// NULL, which can't be read into an int64, bool, string or time.
+var addedColumns = map[string]map[string]interface{}{
+	"users": {
+		"role":              "",
+		"auth_source":       AUTH_LOCAL,
+		"totp_secret":       "",
+		"totp_enabled":      false,
+		"totp_last_step":    0,
+		"totp_failures":     0,
+		"totp_locked_until": time.Time{},
+	},
+	"workers": {
+		"reported_url": "",
+	},
+	"sessions": {
+		"restricted": false,
+		"client_ip":  "",
+		"user_agent": "",
+	},
+	"envs": {
+		"pull_mode":     false,
+		"totp_required": false,
+	},
+	"perms": {
+		"group_id": 0,
+	},
+	"script_perms": {
+		"group_id": 0,
+	},
+	"jobs": {
+		"pending":         false,
+		"kill_pending":    false,
+		"worker_id":       0,
+		"worker_name":     "",
+		"script_hash":     "",
+		"script_revision": 0,
+		"key_hash":        "",
+		"collected":       false,
+		"collected_at":    time.Time{},
+	},
+	"scripts": {
+		"interpreter":         "",
+		"hash":                "",
+		"revision":            0,
+		"signature":           "",
+		"managed":             false,
+		"sync_path":           "",
+		"validation_ok":       false,
+		"validation_report":   "",
+		"validation_override": false,
+		"validated_at":        time.Time{},
+		"restricted":          false,
+	},
+}
+
+// fillAddedColumns replaces the NULLs in addedColumns
+func (db *Database) fillAddedColumns() {
+
+	for table, columns := range addedColumns {
+		for column, value := range columns {
+			sql := "UPDATE " + table + " SET " + column + " = ? WHERE " +
+				column + " IS NULL"
+			if err := db.dB.Exec(sql, value).Error; err != nil {
+				txt := "Filling in " + table + "." + column + " failed"
+				log.Fatal(fmt.Sprintf("%s: %s", txt, err))
+			}
+		}
+	}
+}
+
 func NewDB() *Database {
 	db := &Database{}
 	db.InitDB()
@@ -30,28 +30,19 @@ import (
 
 func (api *Api) GetAllDcs(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
-
-	// Only admin is allowed
+	session := authSession(r)
+	var errl error = nil
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	//session := Session{}
-	var errl error = nil
-	//if session,errl = api.CheckLogin( login, guid ); errl != nil {
-	if _, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_DCS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	dcs := []Dc{}
 	qs := r.URL.Query() // Query string - map[string][]string
 	if len(qs["sys_name"]) > 0 {
@@ -98,27 +89,19 @@ func (api *Api) GetAllDcs(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) AddDc(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
-
-	// Only admin is allowed
+	session := authSession(r)
+	var errl error
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_DCS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Can't add if it exists already
 
 	dcData := Dc{}
@@ -155,27 +138,19 @@ func (api *Api) AddDc(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) UpdateDc(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
-
-	// Only admin is allowed
+	session := authSession(r)
+	var errl error
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_DCS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Ensure user exists
 
 	id := r.PathParam("id")
@@ -224,27 +199,19 @@ func (api *Api) UpdateDc(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) DeleteDc(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
-
-	// Only admin is allowed
+	session := authSession(r)
+	var errl error
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_DCS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Delete
 
 	id := 0
@@ -0,0 +1,281 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Unified diffs of script revisions, made with Myers' O(ND) difference
+// algorithm. Its linear space version is used so memory only grows with
+// the length of the files.
+
+// Diffs of files longer than this many lines aren't attempted. Memory
+// isn't a problem but the time taken grows with the number of lines
+// times the number of differences.
+const MAX_DIFF_LINES = 5000
+
+// A line of a diff: ' ' unchanged, '-' removed or '+' added
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// splitLines splits text into lines without their line endings
+func splitLines(text string) []string {
+	if text == "" {
+		return []string{}
+	}
+	text = strings.TrimSuffix(text, "\n")
+	return strings.Split(text, "\n")
+}
+
+// diffLines returns the edit script that turns a into b
+func diffLines(a, b []string) []diffLine {
+	return diffAppend(make([]diffLine, 0, len(a)+len(b)), a, b)
+}
+
+// diffAppend appends the edit script that turns a into b to lines. Lines
+// at the start and end that are the same are taken off, then the rest
+// is split in two where the shortest edit script crosses its middle and
+// each part is diffed in turn.
+func diffAppend(lines []diffLine, a, b []string) []diffLine {
+
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		lines = append(lines, diffLine{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+
+	same := 0
+	for same < len(a) && same < len(b) &&
+		a[len(a)-1-same] == b[len(b)-1-same] {
+		same++
+	}
+	tail := a[len(a)-same:]
+	a, b = a[:len(a)-same], b[:len(b)-same]
+
+	x, y := -1, -1
+	if len(a) > 0 && len(b) > 0 {
+		x, y = diffMiddle(a, b)
+	}
+
+	if x >= 0 {
+		lines = diffAppend(lines, a[:x], b[:y])
+		lines = diffAppend(lines, a[x:], b[y:])
+	} else {
+		// Nothing in common
+		for _, text := range a {
+			lines = append(lines, diffLine{'-', text})
+		}
+		for _, text := range b {
+			lines = append(lines, diffLine{'+', text})
+		}
+	}
+
+	for _, text := range tail {
+		lines = append(lines, diffLine{' ', text})
+	}
+
+	return lines
+}
+
+// diffMiddle returns the point, x lines into a and y lines into b, where
+// a shortest edit script from a to b crosses its middle. Shortest paths
+// are searched for from both ends at once until they overlap. It returns
+// -1, -1 if a and b have no lines in common.
+//
+// The first and last lines of a and b must differ, so the point is never
+// at either end.
+func diffMiddle(a, b []string) (int, int) {
+
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD
+
+	// forward[offset+k] is how far into a the furthest reaching path
+	// from the start has got on diagonal k, where k is x - y. backward
+	// is the same for paths from the end, counted from the end.
+	forward := make([]int, 2*maxD+2)
+	backward := make([]int, 2*maxD+2)
+	for i := range forward {
+		forward[i] = -1
+		backward[i] = -1
+	}
+	forward[offset+1] = 0
+	backward[offset+1] = 0
+
+	delta := n - m
+	odd := delta%2 != 0
+
+	// Diagonals that have gone off the edge of a or b are skipped
+	fStart, fEnd, bStart, bEnd := 0, 0, 0, 0
+
+	for d := 0; d < maxD; d++ {
+
+		for k := -d + fStart; k <= d-fEnd; k += 2 {
+			i := offset + k
+			x := 0
+			if k == -d || (k != d && forward[i-1] < forward[i+1]) {
+				x = forward[i+1]
+			} else {
+				x = forward[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[i] = x
+			if x > n {
+				fEnd += 2
+			} else if y > m {
+				fStart += 2
+			} else if odd {
+				j := offset + delta - k
+				if j >= 0 && j < len(backward) && backward[j] != -1 &&
+					x >= n-backward[j] {
+					return x, y
+				}
+			}
+		}
+
+		for k := -d + bStart; k <= d-bEnd; k += 2 {
+			i := offset + k
+			x := 0
+			if k == -d || (k != d && backward[i-1] < backward[i+1]) {
+				x = backward[i+1]
+			} else {
+				x = backward[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			backward[i] = x
+			if x > n {
+				bEnd += 2
+			} else if y > m {
+				bStart += 2
+			} else if !odd {
+				j := offset + delta - k
+				if j >= 0 && j < len(forward) && forward[j] != -1 {
+					fx := forward[j]
+					fy := fx - (j - offset)
+					if fx >= n-x {
+						return fx, fy
+					}
+				}
+			}
+		}
+	}
+
+	return -1, -1
+}
+
+// unifiedDiff returns a unified diff, with three lines of context,
+// between two texts. An empty string means there are no differences.
+func unifiedDiff(fromName, toName, from, to string) (string, error) {
+
+	a := splitLines(from)
+	b := splitLines(to)
+
+	if len(a) > MAX_DIFF_LINES || len(b) > MAX_DIFF_LINES {
+		return "", ApiError{fmt.Sprintf("Too many lines to diff (limit %d)",
+			MAX_DIFF_LINES)}
+	}
+
+	lines := diffLines(a, b)
+	const context = 3
+
+	out := ""
+	for start := 0; start < len(lines); {
+
+		// Find the next change
+		for start < len(lines) && lines[start].op == ' ' {
+			start++
+		}
+		if start == len(lines) {
+			break
+		}
+
+		// Extend the hunk while changes are close together
+		first := start - context
+		if first < 0 {
+			first = 0
+		}
+		end := start
+		for end < len(lines) {
+			if lines[end].op != ' ' {
+				end++
+				continue
+			}
+			next := end
+			for next < len(lines) && lines[next].op == ' ' {
+				next++
+			}
+			if next == len(lines) || next-end > 2*context {
+				break
+			}
+			end = next
+		}
+		last := end + context
+		if last > len(lines) {
+			last = len(lines)
+		}
+
+		// Line numbers of the hunk in each file
+		aStart, bStart := 1, 1
+		for _, l := range lines[:first] {
+			if l.op != '+' {
+				aStart++
+			}
+			if l.op != '-' {
+				bStart++
+			}
+		}
+		aLen, bLen := 0, 0
+		for _, l := range lines[first:last] {
+			if l.op != '+' {
+				aLen++
+			}
+			if l.op != '-' {
+				bLen++
+			}
+		}
+		if aLen == 0 {
+			aStart--
+		}
+		if bLen == 0 {
+			bStart--
+		}
+
+		if out == "" {
+			out = "--- " + fromName + "\n+++ " + toName + "\n"
+		}
+		out += fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", aStart, aLen,
+			bStart, bLen)
+		for _, l := range lines[first:last] {
+			out += string(l.op) + l.text + "\n"
+		}
+
+		start = last
+	}
+
+	return out, nil
+}
@@ -30,28 +30,19 @@ import (
 
 func (api *Api) GetAllEnvCaps(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
-
-	// Only admin is allowed
+	session := authSession(r)
+	var errl error = nil
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	//session := Session{}
-	var errl error = nil
-	//if session,errl = api.CheckLogin( login, guid ); errl != nil {
-	if _, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_CAPS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	qs := r.URL.Query() // Query string - map[string][]string
 
 	envcaps := []EnvCap{}
@@ -91,27 +82,19 @@ func (api *Api) GetAllEnvCaps(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) AddEnvCap(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
-
-	// Only admin is allowed
+	session := authSession(r)
+	var errl error
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_CAPS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Can't add if it exists already
 
 	EnvCapData := EnvCap{}
@@ -151,27 +134,19 @@ func (api *Api) AddEnvCap(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) UpdateEnvCap(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
-
-	// Only admin is allowed
+	session := authSession(r)
+	var errl error
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_CAPS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Ensure user exists
 
 	id := r.PathParam("id")
@@ -222,27 +197,19 @@ func (api *Api) UpdateEnvCap(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) DeleteEnvCap(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
-
-	// Only admin is allowed
+	session := authSession(r)
+	var errl error
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_CAPS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Delete
 
 	id := 0
@@ -0,0 +1,80 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// Users can only see the jobs and output of environments they have an
+// enabled Perm for, and can only start and kill jobs where the Perm is
+// also writeable. The Perm can be the user's own or one of a group the
+// user is in. Roles that see every environment, see allEnvs, don't need
+// Perms.
+
+// envPermSQL returns a subquery for the ids of the environments a user
+// can read, or write. The user id is its only parameter.
+func envPermSQL(writeable bool) string {
+
+	// Group perms have a user_id of 0 and direct perms don't join to
+	// any members, so the user id only has to match one of the two.
+
+	sql := "SELECT perms.env_id FROM perms " +
+		"LEFT JOIN group_members ON perms.group_id != 0 " +
+		"AND group_members.group_id = perms.group_id " +
+		"AND (group_members.deleted_at IS NULL OR " +
+		"group_members.deleted_at <= '0001-01-02') " +
+		"WHERE ? IN (perms.user_id, group_members.user_id) " +
+		"AND perms.enabled = 1 " +
+		"AND (perms.deleted_at IS NULL OR perms.deleted_at <= '0001-01-02')"
+
+	if writeable {
+		sql += " AND perms.writeable = 1"
+	}
+
+	return sql
+}
+
+// envAllowed returns true if the session's user can read, or write, the
+// environment
+func (api *Api) envAllowed(session Session, envId int64,
+	writeable bool) bool {
+
+	if session.TokenEnvId != 0 && session.TokenEnvId != envId {
+		return false
+	}
+
+	if api.allEnvs(session, writeable) {
+		return true
+	}
+
+	count := 0
+	mutex.Lock()
+	api.db.Model(Env{}).Where("envs.id = ? AND envs.id IN ("+
+		envPermSQL(writeable)+")", envId, session.UserId).Count(&count)
+	mutex.Unlock()
+
+	return count > 0
+}
+
+// canReadEnv returns true if the session's user can see the jobs and
+// output of the environment
+func (api *Api) canReadEnv(session Session, envId int64) bool {
+	return api.envAllowed(session, envId, false)
+}
+
+// canWriteEnv returns true if the session's user can start and kill
+// jobs in the environment
+func (api *Api) canWriteEnv(session Session, envId int64) bool {
+	return api.envAllowed(session, envId, true)
+}
@@ -30,26 +30,24 @@ import (
 
 func (api *Api) GetAllEnvs(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	session := authSession(r)
+	var errl error = nil
 
-	// Anyone can view envs
+	// Check the user's role allows it
 
-	//session := Session{}
-	var errl error = nil
-	//if session,errl = api.CheckLogin( login, guid ); errl != nil {
-	if _, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_ENVS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	envs := []Env{}
 	qs := r.URL.Query() // Query string - map[string][]string
-	if login == "admin" {
+
+	writeable := len(qs["writeable"]) > 0 // only writeable envs
+	if api.allEnvs(session, writeable) {
 		if len(qs["sys_name"]) > 0 {
 			srch := qs["sys_name"][0]
 			if len(qs["dc_id"]) > 0 {
@@ -70,6 +68,10 @@ func (api *Api) GetAllEnvs(w rest.ResponseWriter, r *rest.Request) {
 			       return
 			   }
 			*/
+		} else if len(qs["env_id"]) > 0 {
+			mutex.Lock()
+			api.db.Find(&envs, "id = ?", qs["env_id"][0])
+			mutex.Unlock()
 		} else {
 			mutex.Lock()
 			err := api.db.Order("dc_id,sys_name").Find(&envs)
@@ -81,35 +83,38 @@ func (api *Api) GetAllEnvs(w rest.ResponseWriter, r *rest.Request) {
 				}
 			}
 		}
-	} else { //Not admin
+	} else {
 
 		// Only return readable/writeable envs for the current user
 
-		additional_where := ""
+		query := api.db.Where("envs.id in ("+envPermSQL(writeable)+")",
+			session.UserId)
 
 		if len(qs["env_id"]) > 0 {
-			additional_where = "AND envs.id = " + qs["env_id"][0]
+			query = query.Where("envs.id = ?", qs["env_id"][0])
 		}
 
-		if len(qs["writeable"]) > 0 { // only writeable envs
-			mutex.Lock()
-			api.db.Where("envs.id in (SELECT perms.env_id from perms "+
-				"LEFT JOIN users on users.id=perms.user_id "+
-				"WHERE users.login=? and perms.writeable=1) "+
-				additional_where,
-				login).Find(&envs)
-			mutex.Unlock()
-		} else { // readable or writeable envs
-			mutex.Lock()
-			api.db.Where("envs.id in (SELECT perms.env_id from perms "+
-				"LEFT JOIN users on users.id=perms.user_id "+
-				"WHERE users.login=? and perms.enabled=1) "+
-				additional_where,
-				login).Find(&envs)
-			mutex.Unlock()
+		mutex.Lock()
+		query.Find(&envs)
+		mutex.Unlock()
+	}
+
+	// API tokens can be for one environment
+
+	if session.TokenEnvId != 0 {
+		scoped := []Env{}
+		for _, env := range envs {
+			if env.Id == session.TokenEnvId {
+				scoped = append(scoped, env)
+			}
 		}
+		envs = scoped
 	}
 
+	// Only those who can change envs see the worker key
+
+	showKey := api.Authorize(session, RESOURCE_ENVS, ACTION_WRITE) == nil
+
 	// Create a slice of maps from users struct
 	// to selectively copy database fields for display
 
@@ -122,9 +127,22 @@ func (api *Api) GetAllEnvs(w rest.ResponseWriter, r *rest.Request) {
 		//u[i]["WorkerIp"] = envs[i].WorkerIp
 		//u[i]["WorkerPort"] = envs[i].WorkerPort
 		u[i]["WorkerUrl"] = envs[i].WorkerUrl
-		if login == "admin" {
+		if showKey {
 			u[i]["WorkerKey"] = envs[i].WorkerKey
 		}
+		u[i]["PullMode"] = envs[i].PullMode
+		u[i]["TotpRequired"] = envs[i].TotpRequired
+
+		// Details of the most recently seen worker
+		u[i]["WorkerRegistered"] = false
+		if workers := api.envWorkers(envs[i].Id); len(workers) > 0 {
+			u[i]["WorkerRegistered"] = true
+			u[i]["WorkerName"] = workers[0].Name
+			u[i]["WorkerHostname"] = workers[0].Hostname
+			u[i]["WorkerVersion"] = workers[0].Version
+			u[i]["WorkerLastSeen"] = workers[0].LastSeen
+			u[i]["WorkerHealthy"] = workers[0].Healthy()
+		}
 		u[i]["CreatedAt"] = envs[i].CreatedAt
 
 		dc := Dc{}
@@ -144,27 +162,19 @@ func (api *Api) GetAllEnvs(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) AddEnv(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	session := authSession(r)
+	var errl error
 
-	// Only admin is allowed
+	// Check the user's role allows it
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
-
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_ENVS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Can't add if it exists already
 
 	envData := Env{}
@@ -210,27 +220,19 @@ func (api *Api) AddEnv(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) UpdateEnv(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
-
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	// Credentials were checked by AuthMiddleware
 
-	// Only admin is allowed
+	session := authSession(r)
+	var errl error
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_ENVS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Ensure user exists
 
 	id := r.PathParam("id")
@@ -284,27 +286,19 @@ func (api *Api) UpdateEnv(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) DeleteEnv(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	session := authSession(r)
+	var errl error
 
-	// Only admin is allowed
+	// Check the user's role allows it
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
+	errl = api.Authorize(session, RESOURCE_ENVS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
-		return
-	}
-
-	defer api.TouchSession(guid)
-
 	// Delete
 
 	id := 0
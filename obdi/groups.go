@@ -0,0 +1,709 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
+	"strconv"
+)
+
+// A Perm or ScriptPerm names either a user or a group, never both. Users
+// get the grants of every group they are a member of as well as their
+// own, see envPermSQL and grantsFor.
+
+// userGroupIds returns the ids of the groups the user is a member of
+func (api *Api) userGroupIds(userId int64) []int64 {
+
+	ids := []int64{}
+	mutex.Lock()
+	api.db.Model(GroupMember{}).Where("user_id = ?", userId).
+		Pluck("group_id", &ids)
+	mutex.Unlock()
+
+	return ids
+}
+
+// checkGrantee returns an error unless exactly one of userId and groupId
+// is set and it exists. Otherwise it returns a name for the activity log.
+func (api *Api) checkGrantee(userId, groupId int64) (string, error) {
+
+	if (userId == 0) == (groupId == 0) {
+		return "", ApiError{"Set one of UserId or GroupId."}
+	}
+
+	if groupId != 0 {
+		group := Group{}
+		mutex.Lock()
+		if api.db.First(&group, groupId).RecordNotFound() {
+			mutex.Unlock()
+			return "", ApiError{"Group not found."}
+		}
+		mutex.Unlock()
+		return "group '" + group.Name + "'", nil
+	}
+
+	user := User{}
+	mutex.Lock()
+	if api.db.First(&user, userId).RecordNotFound() {
+		mutex.Unlock()
+		return "", ApiError{"User not found."}
+	}
+	mutex.Unlock()
+
+	return "'" + user.Login + "'", nil
+}
+
+// syncMappedGroups adds the user to the obdi groups that the user's LDAP
+// or OIDC groups map to in groupMap, and removes the user from the other
+// mapped groups. Groups that aren't in the map are left alone. Missing
+// groups are created. from is used in the new group's description.
+func (api *Api) syncMappedGroups(user User, groups []string,
+	groupMap map[string]string, same func(a, b string) bool, from string) {
+
+	for external, name := range groupMap {
+
+		member := false
+		for _, group := range groups {
+			if same(external, group) {
+				member = true
+			}
+		}
+
+		group := Group{}
+		mutex.Lock()
+		if api.db.Where(Group{Name: name}).First(&group).RecordNotFound() {
+			if !member {
+				mutex.Unlock()
+				continue
+			}
+			group = Group{Name: name, Desc: "From " + from + " " + external}
+			api.db.Save(&group)
+			logit("Created group '" + name + "' from " + from)
+		}
+
+		gm := GroupMember{}
+		notFound := api.db.Where("group_id = ? and user_id = ?", group.Id,
+			user.Id).First(&gm).RecordNotFound()
+		if member && notFound {
+			api.db.Save(&GroupMember{GroupId: group.Id, UserId: user.Id})
+		} else if !member && !notFound {
+			api.db.Delete(&gm)
+		}
+		mutex.Unlock()
+	}
+}
+
+func (api *Api) GetAllGroups(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error = nil
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_PERMS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	qs := r.URL.Query() // Query string - map[string][]string
+
+	groups := []Group{}
+	query := api.db.Order("name")
+
+	if len(qs["name"]) > 0 {
+		query = query.Where("name = ?", qs["name"][0])
+	}
+	if len(qs["user_id"]) > 0 {
+		uid, _ := strconv.ParseInt(qs["user_id"][0], 10, 64)
+		query = query.Where("id in (?)", append(api.userGroupIds(uid), 0))
+	}
+
+	// No results is not an error
+	mutex.Lock()
+	err := query.Find(&groups)
+	mutex.Unlock()
+	if err.Error != nil {
+		if !err.RecordNotFound() {
+			rest.Error(w, err.Error.Error(), 500)
+			return
+		}
+	}
+
+	// Create a slice of maps from users struct
+	// to selectively copy database fields for display
+
+	u := make([]map[string]interface{}, len(groups))
+	for i := range groups {
+		u[i] = make(map[string]interface{})
+		u[i]["Id"] = groups[i].Id
+		u[i]["Name"] = groups[i].Name
+		u[i]["Desc"] = groups[i].Desc
+		u[i]["CreatedAt"] = groups[i].CreatedAt
+
+		userIds := []int64{}
+		mutex.Lock()
+		api.db.Model(GroupMember{}).Where("group_id = ?", groups[i].Id).
+			Pluck("user_id", &userIds)
+		mutex.Unlock()
+
+		u[i]["UserIds"] = userIds
+	}
+
+	w.WriteJson(&u)
+}
+
+func (api *Api) AddGroup(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_PERMS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	// Can't add if it exists already
+
+	groupData := Group{}
+
+	if err := r.DecodeJsonPayload(&groupData); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	} else if len(groupData.Name) == 0 {
+		rest.Error(w, "Incorrect data format received.", 400)
+		return
+	}
+
+	group := Group{}
+	mutex.Lock()
+	if !api.db.Find(&group, "name = ?", groupData.Name).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record exists.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	// Add group
+
+	mutex.Lock()
+	if err := api.db.Save(&groupData).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	api.LogActivity(session.Id, "Added new group '"+groupData.Name+"'.")
+	w.WriteJson(groupData)
+}
+
+func (api *Api) UpdateGroup(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_PERMS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	id := r.PathParam("id")
+
+	// Check that the id string is a number
+	if _, err := strconv.Atoi(id); err != nil {
+		rest.Error(w, "Invalid id.", 400)
+		return
+	}
+
+	// Load data from db, then ...
+	group := Group{}
+	mutex.Lock()
+	if api.db.Find(&group, id).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	// ... overwrite any sent fields
+	if err := r.DecodeJsonPayload(&group); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	} else if len(group.Name) == 0 {
+		rest.Error(w, "Incorrect data format received.", 400)
+		return
+	}
+
+	// Force the use of the path id over an id in the payload
+	Id, _ := strconv.Atoi(id)
+	group.Id = int64(Id)
+
+	// Names are unique
+
+	other := Group{}
+	mutex.Lock()
+	if !api.db.Find(&other, "name = ? and id != ?", group.Name,
+		group.Id).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record exists.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	mutex.Lock()
+	if err := api.db.Save(&group).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	api.LogActivity(session.Id, "Updated group '"+group.Name+"'.")
+
+	w.WriteJson("Success")
+}
+
+func (api *Api) DeleteGroup(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_PERMS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	// Delete
+
+	id := 0
+	if id, errl = strconv.Atoi(r.PathParam("id")); errl != nil {
+		rest.Error(w, "Invalid id.", 400)
+		return
+	}
+
+	group := Group{}
+	mutex.Lock()
+	if api.db.First(&group, id).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	// The group's members and grants go with it
+
+	mutex.Lock()
+	tx := api.db.Begin()
+	for _, model := range []interface{}{&GroupMember{}, &Perm{},
+		&ScriptPerm{}} {
+		if err := tx.Where("group_id = ?", group.Id).
+			Delete(model).Error; err != nil {
+			tx.Rollback()
+			mutex.Unlock()
+			rest.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	if err := tx.Delete(&group).Error; err != nil {
+		tx.Rollback()
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	tx.Commit()
+	mutex.Unlock()
+
+	api.LogActivity(session.Id, "Deleted group '"+group.Name+"'.")
+
+	w.WriteJson("Success")
+}
+
+func (api *Api) GetAllGroupMembers(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error = nil
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_PERMS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	qs := r.URL.Query() // Query string - map[string][]string
+
+	members := []GroupMember{}
+	query := api.db.Order("group_id, user_id")
+
+	if len(qs["group_id"]) > 0 {
+		query = query.Where("group_id = ?", qs["group_id"][0])
+	}
+	if len(qs["user_id"]) > 0 {
+		query = query.Where("user_id = ?", qs["user_id"][0])
+	}
+
+	// No results is not an error
+	mutex.Lock()
+	err := query.Find(&members)
+	mutex.Unlock()
+	if err.Error != nil {
+		if !err.RecordNotFound() {
+			rest.Error(w, err.Error.Error(), 500)
+			return
+		}
+	}
+
+	// Create a slice of maps from users struct
+	// to selectively copy database fields for display
+
+	u := make([]map[string]interface{}, len(members))
+	for i := range members {
+		u[i] = make(map[string]interface{})
+		u[i]["Id"] = members[i].Id
+		u[i]["GroupId"] = members[i].GroupId
+		u[i]["UserId"] = members[i].UserId
+		u[i]["CreatedAt"] = members[i].CreatedAt
+
+		group := Group{}
+		mutex.Lock()
+		api.db.Model(&members[i]).Related(&group)
+		mutex.Unlock()
+
+		u[i]["GroupName"] = group.Name
+
+		user := User{}
+		mutex.Lock()
+		api.db.Model(&members[i]).Related(&user)
+		mutex.Unlock()
+
+		u[i]["UserLogin"] = user.Login
+		u[i]["UserEnabled"] = user.Enabled
+	}
+
+	w.WriteJson(&u)
+}
+
+func (api *Api) AddGroupMember(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_PERMS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	// Can't add if it exists already
+
+	memberData := GroupMember{}
+
+	if err := r.DecodeJsonPayload(&memberData); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	} else if memberData.GroupId == 0 || memberData.UserId == 0 {
+		rest.Error(w, "Incorrect data format received.", 400)
+		return
+	}
+
+	group := Group{}
+	mutex.Lock()
+	if api.db.First(&group, memberData.GroupId).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Group not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	user := User{}
+	mutex.Lock()
+	if api.db.First(&user, memberData.UserId).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "User not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	member := GroupMember{}
+	mutex.Lock()
+	if !api.db.Find(&member, "group_id = ? and user_id = ?",
+		memberData.GroupId, memberData.UserId).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record exists.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	// Add member
+
+	mutex.Lock()
+	if err := api.db.Save(&memberData).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	text := fmt.Sprintf("Added '%s' to group '%s'.", user.Login, group.Name)
+
+	api.LogActivity(session.Id, text)
+	w.WriteJson(memberData)
+}
+
+func (api *Api) DeleteGroupMember(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_PERMS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	// Delete
+
+	id := 0
+	if id, errl = strconv.Atoi(r.PathParam("id")); errl != nil {
+		rest.Error(w, "Invalid id.", 400)
+		return
+	}
+
+	member := GroupMember{}
+	mutex.Lock()
+	if api.db.First(&member, id).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	mutex.Lock()
+	if err := api.db.Delete(&member).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	text := fmt.Sprintf("Removed user %d from group %d. GroupMemberID = "+
+		"'%d'.", member.UserId, member.GroupId, member.Id)
+
+	api.LogActivity(session.Id, text)
+
+	w.WriteJson("Success")
+}
+
+// GetEffectivePerms processes "GET /users/:id/effectiveperms" queries.
+// It shows what the user can see and run, and where each grant came
+// from.
+func (api *Api) GetEffectivePerms(w rest.ResponseWriter,
+	r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error = nil
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_PERMS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	id := 0
+	if id, errl = strconv.Atoi(r.PathParam("id")); errl != nil {
+		rest.Error(w, "Invalid id.", 400)
+		return
+	}
+
+	user := User{}
+	mutex.Lock()
+	if api.db.First(&user, id).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	// Work it out as if the user were logged in
+
+	as := Session{UserId: user.Id}
+
+	groupIds := api.userGroupIds(user.Id)
+	groups := []Group{}
+	if len(groupIds) > 0 {
+		mutex.Lock()
+		api.db.Order("name").Find(&groups, "id in (?)", groupIds)
+		mutex.Unlock()
+	}
+	groupNames := make(map[int64]string)
+	g := make([]map[string]interface{}, len(groups))
+	for i := range groups {
+		groupNames[groups[i].Id] = groups[i].Name
+		g[i] = map[string]interface{}{
+			"Id":   groups[i].Id,
+			"Name": groups[i].Name,
+		}
+	}
+
+	// Environments, from the user's role and from Perms
+
+	type effectiveEnv struct {
+		Env       Env
+		Writeable bool
+		Via       []string
+	}
+	envs := make(map[int64]*effectiveEnv)
+	order := []int64{}
+
+	addEnv := func(env Env, writeable bool, via string) {
+		e, ok := envs[env.Id]
+		if !ok {
+			e = &effectiveEnv{Env: env}
+			envs[env.Id] = e
+			order = append(order, env.Id)
+		}
+		e.Writeable = e.Writeable || writeable
+		e.Via = append(e.Via, via)
+	}
+
+	if api.allEnvs(as, false) {
+		all := []Env{}
+		mutex.Lock()
+		api.db.Order("dc_id,sys_name").Find(&all)
+		mutex.Unlock()
+		for _, env := range all {
+			addEnv(env, api.allEnvs(as, true), "role "+user.Role)
+		}
+	}
+
+	perms := []Perm{}
+	query := api.grantsFor(user.Id).Where("enabled = 1")
+	mutex.Lock()
+	query.Order("env_id").Find(&perms)
+	mutex.Unlock()
+
+	for _, perm := range perms {
+		env := Env{}
+		mutex.Lock()
+		notFound := api.db.First(&env, perm.EnvId).RecordNotFound()
+		mutex.Unlock()
+		if notFound {
+			continue
+		}
+		via := "user"
+		if perm.GroupId != 0 {
+			via = "group " + groupNames[perm.GroupId]
+		}
+		addEnv(env, perm.Writeable, via)
+	}
+
+	e := make([]map[string]interface{}, len(order))
+	for i, id := range order {
+		env := envs[id]
+		dc := Dc{}
+		mutex.Lock()
+		api.db.Model(&env.Env).Related(&dc)
+		mutex.Unlock()
+
+		e[i] = map[string]interface{}{
+			"EnvId":       id,
+			"EnvSysName":  env.Env.SysName,
+			"EnvDispName": env.Env.DispName,
+			"DcSysName":   dc.SysName,
+			"Writeable":   env.Writeable,
+			"Via":         env.Via,
+		}
+	}
+
+	// Scripts the user can run, and where
+
+	canRun := roleAllows(user.Role, RESOURCE_JOBS, ACTION_RUN)
+
+	s := []map[string]interface{}{}
+	if canRun {
+		scripts := []Script{}
+		mutex.Lock()
+		api.db.Order("name").Find(&scripts)
+		mutex.Unlock()
+
+		envIds := api.scriptEnvIds(as, scripts)
+		for _, script := range scripts {
+			if ids, ok := envIds[script.Id]; ok {
+				s = append(s, map[string]interface{}{
+					"ScriptId":   script.Id,
+					"Name":       script.Name,
+					"Restricted": script.Restricted,
+					"EnvIds":     ids,
+				})
+			}
+		}
+	}
+
+	// Two-factor authentication
+
+	t := map[string]interface{}{
+		"Enabled":  user.TotpEnabled,
+		"Required": api.totpRequired(user),
+		"Exempt":   totpExemption(user),
+	}
+
+	w.WriteJson(map[string]interface{}{
+		"UserId":     user.Id,
+		"Login":      user.Login,
+		"Role":       user.Role,
+		"Enabled":    user.Enabled,
+		"CanRunJobs": canRun,
+		"Groups":     g,
+		"Envs":       e,
+		"Scripts":    s,
+		"TwoFactor":  t,
+	})
+}
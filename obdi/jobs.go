@@ -20,7 +20,6 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
@@ -41,25 +40,55 @@ const (
 	STATUS_ERROR
 )
 
+// What's sent to a worker to start a job
+type Jobsend struct {
+	ScriptSource []byte // Only sent if the worker doesn't have it cached
+	ScriptHash   string // SHA-256 of the script source
+	ScriptName   string
+	Interpreter  string // Empty to use the script's #! line
+	Signature    string // Base64 ed25519 signature, see obdi-sign
+	JobKey       string // Sent back with status and output, see newJobKey
+	Args         string
+	EnvVars      string
+	//NotifURL        string
+	JobID int64
+	Type  int64 // 1 - user job, 2 - system job
+}
+
+// What's sent to a worker to kill a job
+type Jobkill struct {
+	JobID int64
+}
+
 /*
- * Send HTTP POST request
+ * Send HTTP POST request, signed with the worker's key
  */
-func POST(jsondata []byte, url, endpoint string) (r *http.Response, e error) {
+func POST(jsondata []byte, worker Worker, endpoint string) (
+	r *http.Response, e error) {
 
+	url := worker.Url
 	buf := bytes.NewBuffer(jsondata)
 
-	// accept bad certs
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	client, err := httpClient()
+	if err != nil {
+		return nil, err
 	}
-	client := &http.Client{Transport: tr}
 
 	//fmt.Printf("\n%s/api/%s\n",url,endpoint)
 	for strings.HasSuffix(url, "/") {
 		url = strings.TrimSuffix(url, "/")
 	}
-	resp, err := client.Post(url+"/api/"+endpoint,
-		"application/json", buf)
+	req, err := http.NewRequest("POST", url+"/api/"+endpoint, buf)
+	if err != nil {
+		txt := fmt.Sprintf("Could not send REST request ('%s').", err.Error())
+		return nil, ApiError{txt}
+	}
+
+	req.Header.Add("Content-Type", `application/json`)
+	signHeaders(req.Header, worker.Key, worker.Name, "POST",
+		req.URL.RequestURI(), jsondata)
+
+	resp, err := client.Do(req)
 	if err != nil {
 		txt := fmt.Sprintf("Could not send REST request ('%s').", err.Error())
 		return resp, ApiError{txt}
@@ -67,7 +96,9 @@ func POST(jsondata []byte, url, endpoint string) (r *http.Response, e error) {
 
 	if resp.StatusCode != 200 {
 		var body []byte
-		if b, err := ioutil.ReadAll(resp.Body); err != nil {
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
 			txt := fmt.Sprintf("Error reading Body ('%s').", err.Error())
 			return resp, ApiError{txt}
 		} else {
@@ -92,18 +123,51 @@ func POST(jsondata []byte, url, endpoint string) (r *http.Response, e error) {
 }
 
 /*
- * Send HTTP DELETE request
+ * Send HTTP GET request, signed with the worker's key
+ */
+func GET(worker Worker, endpoint string) (r *http.Response, e error) {
+
+	url := worker.Url
+
+	client, err := httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	for strings.HasSuffix(url, "/") {
+		url = strings.TrimSuffix(url, "/")
+	}
+	req, err := http.NewRequest("GET", url+"/api/"+endpoint, nil)
+	if err != nil {
+		txt := fmt.Sprintf("Could not send REST request ('%s').", err.Error())
+		return nil, ApiError{txt}
+	}
+
+	signHeaders(req.Header, worker.Key, worker.Name, "GET",
+		req.URL.RequestURI(), []byte{})
+
+	resp, err := client.Do(req)
+	if err != nil {
+		txt := fmt.Sprintf("Could not send REST request ('%s').", err.Error())
+		return resp, ApiError{txt}
+	}
+
+	return resp, nil
+}
+
+/*
+ * Send HTTP DELETE request, signed with the worker's key
  */
-func DELETE(jsondata []byte, url, endpoint string) (r *http.Response,
-	e error) {
+func DELETE(jsondata []byte, worker Worker, endpoint string) (
+	r *http.Response, e error) {
 
+	url := worker.Url
 	buf := bytes.NewBuffer(jsondata)
 
-	// accept bad certs
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	client, err := httpClient()
+	if err != nil {
+		return nil, err
 	}
-	client := &http.Client{Transport: tr}
 
 	resp := &http.Response{}
 
@@ -118,42 +182,66 @@ func DELETE(jsondata []byte, url, endpoint string) (r *http.Response,
 	}
 
 	req.Header.Add("Content-Type", `application/json`)
+	signHeaders(req.Header, worker.Key, worker.Name, "DELETE",
+		req.URL.RequestURI(), jsondata)
 
 	resp, err = client.Do(req)
+	if err != nil {
+		txt := fmt.Sprintf("Could not send REST request ('%s').", err.Error())
+		return resp, ApiError{txt}
+	}
 
 	return resp, nil
 }
 
+// newJobsend fills in the job details a worker needs to run a job. The
+// script source is left out, workers ask for it if they need it.
+func newJobsend(job Job, script Script, key string) Jobsend {
+	return Jobsend{
+		JobKey:      key,
+		ScriptHash:  job.ScriptHash,
+		ScriptName:  script.Name,
+		Interpreter: script.Interpreter,
+		Signature:   script.Signature,
+		JobID:       job.Id,
+		Args:        job.Args,
+		EnvVars:     job.EnvVars,
+		Type:        job.Type,
+	}
+}
+
 func (api *Api) GetAllJobs(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	session := authSession(r)
+	var errl error = nil
 
-	// Admin is NOT allowed
+	// Check the user's role allows it
 
-	if login == "admin" {
-		rest.Error(w, "Not allowed", 400)
+	errl = api.Authorize(session, RESOURCE_JOBS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	//session := Session{}
-	var errl error = nil
-	//if session,errl = api.CheckLogin( login, guid ); errl != nil {
-	if _, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
-		return
-	}
+	// Only jobs in environments the user can read
 
-	defer api.TouchSession(guid)
+	readable := api.db
+	if !api.allEnvs(session, false) {
+		readable = api.db.Where("env_id in ("+envPermSQL(false)+")",
+			session.UserId)
+	}
+	if session.TokenEnvId != 0 {
+		readable = readable.Where("env_id = ?", session.TokenEnvId)
+	}
 
 	jobs := []Job{}
 	qs := r.URL.Query() // Query string - map[string][]string
 	if len(qs["job_id"]) > 0 {
 		srch := qs["job_id"][0]
 		mutex.Lock()
-		api.db.Order("id desc").Find(&jobs, "id = ?", srch)
+		readable.Order("id desc").Find(&jobs, "id = ?", srch)
 		mutex.Unlock()
 		/*
 		   if api.db.Order("id").
@@ -165,7 +253,7 @@ func (api *Api) GetAllJobs(w rest.ResponseWriter, r *rest.Request) {
 	} else {
 		// No results is not an error
 		mutex.Lock()
-		err := api.db.Order("id desc").Limit(200).Find(&jobs)
+		err := readable.Order("id desc").Limit(200).Find(&jobs)
 		mutex.Unlock()
 		if err.Error != nil {
 			if !err.RecordNotFound() {
@@ -203,7 +291,11 @@ func (api *Api) GetAllJobs(w rest.ResponseWriter, r *rest.Request) {
 
 		u[i]["EnvSysName"] = env.SysName
 		u[i]["EnvDispName"] = env.DispName
-		u[i]["WorkerUrl"] = env.WorkerUrl
+		u[i]["WorkerId"] = jobs[i].WorkerId
+		u[i]["WorkerName"] = jobs[i].WorkerName
+		u[i]["ScriptHash"] = jobs[i].ScriptHash
+		u[i]["ScriptRevision"] = jobs[i].ScriptRevision
+		u[i]["WorkerUrl"] = api.jobWorker(jobs[i], env).Url
 
 		dc := Dc{}
 		mutex.Lock()
@@ -241,27 +333,21 @@ func (api *Api) AddJob(w rest.ResponseWriter, r *rest.Request) {
 
 	logit(fmt.Sprintf("Connection from %s", r.RemoteAddr))
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	session := authSession(r)
+	var errl error
 
-	// Admin is not allowed
+	login := r.PathParam("login")
 
-	if login == "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_JOBS, ACTION_RUN)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Can't add if it exists already
 
 	jobData := Job{}
@@ -290,6 +376,18 @@ func (api *Api) AddJob(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
+	if !api.canWriteEnv(session, jobData.EnvId) {
+		rest.Error(w, "Not allowed. You can't run jobs in this "+
+			"environment.", 400)
+		return
+	}
+
+	if !api.canRunScript(session, jobData.ScriptId, jobData.EnvId) {
+		rest.Error(w, "Not allowed. You can't run this script in this "+
+			"environment.", 400)
+		return
+	}
+
 	// Add job to DB
 
 	saveJob := func() {
@@ -311,12 +409,15 @@ func (api *Api) AddJob(w rest.ResponseWriter, r *rest.Request) {
 	api.db.Model(&jobData).Related(&env)
 	mutex.Unlock()
 
-	// We need WorkerUrl and WorkerKey
+	// Find workers that can take the job. Pull mode workers connect
+	// to us so don't need a URL. This fails straight away if the
+	// workers have gone away, rather than waiting for a send to time
+	// out.
 
-	if env.WorkerUrl == "" || env.WorkerKey == "" {
-		txt := "WorkerUrl or WorkerKey not set for this environment"
+	workers, err := api.pickWorkers(env, !env.PullMode)
+	if err != nil {
 		jobData.Status = STATUS_ERROR
-		jobData.StatusReason = txt
+		jobData.StatusReason = err.Error()
 		saveJob()
 		w.WriteJson(jobData)
 		return
@@ -342,54 +443,121 @@ func (api *Api) AddJob(w rest.ResponseWriter, r *rest.Request) {
 	}
 	mutex.Unlock()
 
-	// Jobsend definition
-	type Jobsend struct {
-		ScriptSource []byte
-		ScriptName   string
-		Args         string
-		EnvVars      string
-		//NotifURL        string
-		JobID int64
-		Key   string
-		Type  int64 // 1 - user job, 2 - system job
-	}
-
-	// Jobsend data
-	data := Jobsend{
-		ScriptSource: script.Source,
-		ScriptName:   script.Name,
-		JobID:        jobData.Id,
-		Key:          env.WorkerKey,
-		Args:         jobData.Args,
-		EnvVars:      jobData.EnvVars,
-		Type:         jobData.Type,
+	// Scripts saved before hashes were added don't have one yet
+
+	if hash := scriptHash(script.Source); script.Hash != hash {
+		script.Hash = hash
+		mutex.Lock()
+		api.db.Save(&script)
+		mutex.Unlock()
 	}
+	jobData.ScriptHash = script.Hash
 
-	// Encode
-	jsondata, err := json.Marshal(data)
-	if err != nil {
-		txt := fmt.Sprintf("Error sending job to worker, JSON Encode:",
-			err.Error())
+	if err := api.ensureRevision(&script); err != nil {
 		jobData.Status = STATUS_ERROR
-		jobData.StatusReason = txt
+		jobData.StatusReason = err.Error()
 		saveJob()
 		w.WriteJson(jobData)
-		//rest.Error(w, txt, 400)
 		return
 	}
-	// POST to worker
-	resp, err := POST(jsondata, env.WorkerUrl, "jobs")
-	//fmt.Printf("%+v", jsondata)
-	if err != nil {
-		txt := "Could not send job to worker. ('" + err.Error() + "')"
+	jobData.ScriptRevision = script.Revision
+
+	if err := api.checkValidated(&script); err != nil {
+		jobData.Status = STATUS_ERROR
+		jobData.StatusReason = err.Error()
+		saveJob()
+		w.WriteJson(jobData)
+		return
+	}
+	saveJob()
+
+	// Pull mode workers collect the job from us
+
+	if env.PullMode {
+		jobData.Status = STATUS_NOTSTARTED
+		jobData.StatusReason = "Waiting for a worker to collect the job"
+		jobData.Pending = true
+		saveJob()
+		text := fmt.Sprintf("Added new job, %d.", jobData.Id)
+		api.LogActivity(session.Id, text)
+		w.WriteJson(jobData)
+		return
+	}
+
+	// Try each worker in turn until one accepts the job
+
+	errs := []string{}
+	for _, worker := range workers {
+
+		// Jobsend data, with a new key for each worker it's sent to
+		key, keyHash, err := newJobKey()
+		if err != nil {
+			jobData.Status = STATUS_ERROR
+			jobData.StatusReason = err.Error()
+			saveJob()
+			w.WriteJson(jobData)
+			return
+		}
+		data := newJobsend(jobData, script, key)
+
+		// Encode
+		jsondata, err := json.Marshal(data)
+		if err != nil {
+			txt := fmt.Sprintf("Error sending job to worker, JSON Encode: %s",
+				err.Error())
+			jobData.Status = STATUS_ERROR
+			jobData.StatusReason = txt
+			saveJob()
+			w.WriteJson(jobData)
+			//rest.Error(w, txt, 400)
+			return
+		}
+
+		// The worker sends status updates as soon as it gets the job
+		// so record who it was sent to first
+		jobData.WorkerId = worker.Id
+		jobData.WorkerName = worker.Name
+		jobData.KeyHash = keyHash
+		saveJob()
+
+		// POST to worker
+		resp, err := POST(jsondata, worker, "jobs")
+		//fmt.Printf("%+v", jsondata)
+		if err != nil && resp != nil && resp.StatusCode == 412 {
+			// The worker doesn't have the script cached. Send it.
+			data.ScriptSource = script.Source
+			if jsondata, err = json.Marshal(data); err == nil {
+				resp, err = POST(jsondata, worker, "jobs")
+			}
+		}
+		if err != nil {
+			txt := fmt.Sprintf("%s: %s", worker.Name, err.Error())
+			logit(fmt.Sprintf("Job %d: Could not send job to worker %s",
+				jobData.Id, txt))
+			errs = append(errs, txt)
+			continue
+		}
+		resp.Body.Close()
+		errs = []string{}
+		break
+	}
+
+	if len(errs) > 0 {
+		txt := "Could not send job to worker. ('" +
+			strings.Join(errs, "', '") + "')"
+		mutex.Lock()
+		api.db.First(&jobData, jobData.Id)
+		mutex.Unlock()
 		jobData.Status = STATUS_ERROR
 		jobData.StatusReason = txt
+		jobData.WorkerId = 0
+		jobData.WorkerName = ""
+		jobData.KeyHash = ""
 		saveJob()
 		w.WriteJson(jobData)
 		//rest.Error(w, txt, 400)
 		return
 	}
-	defer resp.Body.Close()
 
 	text := fmt.Sprintf("Added new job, %d.", jobData.Id)
 	api.LogActivity(session.Id, text)
@@ -398,59 +566,45 @@ func (api *Api) AddJob(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) UpdateJob(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	session := authSession(r)
+	var errl error
 
-	// Admin is not allowed
+	// Check the user's role allows it
 
-	if login == "admin" {
-		rest.Error(w, "Not allowed", 400)
+	errl = api.Authorize(session, RESOURCE_JOBS, ACTION_REPORT)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	id, err := strconv.ParseInt(r.PathParam("id"), 10, 64)
+	if err != nil {
+		rest.Error(w, "Invalid id.", 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
+	// Only the job's status can be changed, and only by the worker the
+	// job was sent to
 
-	// Ensure user exists
-
-	id := r.PathParam("id")
-
-	// Check that the id string is a number
-	if _, err := strconv.Atoi(id); err != nil {
-		rest.Error(w, "Invalid id.", 400)
+	status := JobStatus{}
+	if err := r.DecodeJsonPayload(&status); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
 		return
 	}
 
-	// Load data from db, then ...
-	job := Job{}
-	mutex.Lock()
-	if api.db.Find(&job, id).RecordNotFound() {
-		mutex.Unlock()
-		//rest.Error(w, err.Error(), 400)
-		rest.Error(w, "Job ID not found.", 400)
+	job, err := api.keyedJob(id, status.JobKey)
+	if err != nil {
+		rest.Error(w, err.Error(), 400)
 		return
 	}
-	mutex.Unlock()
 
-	// ... overwrite any sent fields
-	if err := r.DecodeJsonPayload(&job); err != nil {
-		//rest.Error(w, err.Error(), 400)
-		rest.Error(w, "Invalid data format received.", 400)
+	if err := setJobStatus(&job, status); err != nil {
+		rest.Error(w, err.Error(), 400)
 		return
 	}
 
-	// Force the use of the path id over an id in the payload
-	Id, _ := strconv.Atoi(id)
-	job.Id = int64(Id)
-
 	mutex.Lock()
 	if err := api.db.Save(&job).Error; err != nil {
 		mutex.Unlock()
@@ -467,27 +621,19 @@ func (api *Api) UpdateJob(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) DeleteJob(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
-
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	// Credentials were checked by AuthMiddleware
 
-	// Only admin is allowed
+	session := authSession(r)
+	var errl error
 
-	if login == "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_JOBS, ACTION_RUN)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Delete
 
 	id := 0
@@ -505,6 +651,12 @@ func (api *Api) DeleteJob(w rest.ResponseWriter, r *rest.Request) {
 	}
 	mutex.Unlock()
 
+	if !api.canWriteEnv(session, job.EnvId) {
+		rest.Error(w, "Not allowed. You can't delete jobs in this "+
+			"environment.", 400)
+		return
+	}
+
 	mutex.Lock()
 	if err := api.db.Delete(&job).Error; err != nil {
 		mutex.Unlock()
@@ -520,27 +672,19 @@ func (api *Api) DeleteJob(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) KillJob(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	session := authSession(r)
+	var errl error
 
-	// Only admin is allowed
+	// Check the user's role allows it
 
-	if login == "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
-
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_JOBS, ACTION_RUN)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Delete
 
 	id := 0
@@ -558,24 +702,44 @@ func (api *Api) KillJob(w rest.ResponseWriter, r *rest.Request) {
 	}
 	mutex.Unlock()
 
+	if !api.canWriteEnv(session, job.EnvId) {
+		rest.Error(w, "Not allowed. You can't kill jobs in this "+
+			"environment.", 400)
+		return
+	}
+
 	env := Env{}
 	mutex.Lock()
 	api.db.Model(&job).Related(&env)
 	mutex.Unlock()
 
-	if env.WorkerUrl == "" || env.WorkerKey == "" {
+	worker := api.jobWorker(job, env)
+
+	if (worker.Url == "" && !env.PullMode) || worker.Key == "" {
 		txt := "WorkerUrl or WorkerKey not set for the target environment"
 		rest.Error(w, txt, 400)
 		return
 	}
 
-	type Jobkill struct {
-		JobID int64
-		Key   string
+	// Pull mode workers collect the kill request from us
+
+	if env.PullMode {
+		job.KillPending = true
+		mutex.Lock()
+		if err := api.db.Save(&job).Error; err != nil {
+			mutex.Unlock()
+			rest.Error(w, err.Error(), 400)
+			return
+		}
+		mutex.Unlock()
+		api.LogActivity(session.Id,
+			fmt.Sprintf("Requested kill of job %d.", job.Id))
+		w.WriteJson(&job)
+		return
 	}
+
 	data := Jobkill{
 		JobID: job.Id,
-		Key:   env.WorkerKey,
 	}
 	// Encode
 	jsondata, err := json.Marshal(data)
@@ -587,7 +751,7 @@ func (api *Api) KillJob(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 	// POST to worker
-	resp, err := DELETE(jsondata, env.WorkerUrl, "jobs")
+	resp, err := DELETE(jsondata, worker, "jobs")
 	if err != nil {
 		txt := "Could not send kill command to worker. ('" + err.Error() + "')"
 		rest.Error(w, txt, 400)
@@ -0,0 +1,351 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/mclarkson/obdi/common"
+	"github.com/mclarkson/obdi/external/go-ldap/ldap"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// LDAP logins run alongside local accounts. A user that isn't in the
+// database, or was created by an LDAP login, is checked against the LDAP
+// server. Local users never are, so the admin user still works when the
+// LDAP server is down.
+
+type LdapConfig struct {
+	Enabled      bool   `toml:"enabled"`
+	Url          string `toml:"url"` // ldap://host or ldaps://host
+	StartTLS     bool   `toml:"start_tls"`
+	CA           string `toml:"ca"`
+	Insecure     bool   `toml:"insecure"`
+	BindDN       string `toml:"bind_dn"` // Search as this, or anonymously
+	BindPassword string `toml:"bind_password"`
+	BaseDN       string `toml:"base_dn"`
+	UserFilter   string `toml:"user_filter"` // %s is the login
+	GroupAttr    string `toml:"group_attribute"`
+	GroupBaseDN  string `toml:"group_base_dn"`
+	GroupFilter  string `toml:"group_filter"` // %s is the user's DN
+	ForenameAttr string `toml:"forename_attribute"`
+	SurnameAttr  string `toml:"surname_attribute"`
+	EmailAttr    string `toml:"email_attribute"`
+	DefaultRole  string `toml:"default_role"`
+	Timeout      int64  `toml:"timeout"` // Seconds
+
+	// LDAP group DN to obdi role, and to obdi group name
+	GroupRoles map[string]string `toml:"group_roles"`
+	GroupMap   map[string]string `toml:"groups"`
+}
+
+// ldapDefaults fills in the settings that weren't set and returns an
+// error if the rest can't work
+func (c *LdapConfig) ldapDefaults() error {
+
+	if c.UserFilter == "" {
+		c.UserFilter = "(uid=%s)"
+	}
+	if c.GroupAttr == "" {
+		c.GroupAttr = "memberOf"
+	}
+	if c.GroupBaseDN == "" {
+		c.GroupBaseDN = c.BaseDN
+	}
+	if c.ForenameAttr == "" {
+		c.ForenameAttr = "givenName"
+	}
+	if c.SurnameAttr == "" {
+		c.SurnameAttr = "sn"
+	}
+	if c.EmailAttr == "" {
+		c.EmailAttr = "mail"
+	}
+	if c.DefaultRole == "" {
+		c.DefaultRole = ROLE_OPERATOR
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10
+	}
+
+	if !c.Enabled {
+		return nil
+	}
+
+	if c.Url == "" || c.BaseDN == "" {
+		return fmt.Errorf("url and base_dn must be set")
+	}
+	if _, err := ldap.CompileFilter(ldapUserFilter(c.UserFilter,
+		"x")); err != nil {
+		return fmt.Errorf("user_filter: %s", err.Error())
+	}
+	if c.GroupFilter != "" {
+		if _, err := ldap.CompileFilter(ldapUserFilter(c.GroupFilter,
+			"x")); err != nil {
+			return fmt.Errorf("group_filter: %s", err.Error())
+		}
+	}
+	if err := checkRole(c.DefaultRole); err != nil {
+		return fmt.Errorf("default_role: %s", err.Error())
+	}
+	for dn, role := range c.GroupRoles {
+		if err := checkRole(role); err != nil {
+			return fmt.Errorf("group_roles '%s': %s", dn, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// ldapUserFilter puts an escaped value into a filter template
+func ldapUserFilter(template, value string) string {
+	return strings.Replace(template, "%s", ldap.EscapeFilter(value), -1)
+}
+
+// ldapValues returns the values of an entry's attribute. Servers don't
+// always send attribute names in the case they were asked for.
+func ldapValues(entry *ldap.Entry, attr string) []string {
+	for _, a := range entry.Attributes {
+		if strings.EqualFold(a.Name, attr) {
+			return a.Values
+		}
+	}
+	return nil
+}
+
+// ldapFirst returns the first value of an entry's attribute or ""
+func ldapFirst(entry *ldap.Entry, attr string) string {
+	if values := ldapValues(entry, attr); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// ldapSameDN returns true if the DNs differ only in case or spacing
+func ldapSameDN(a, b string) bool {
+
+	norm := func(dn string) string {
+		parts := strings.Split(strings.ToLower(dn), ",")
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+		return strings.Join(parts, ",")
+	}
+
+	return norm(a) == norm(b)
+}
+
+// ldapConnect connects to the server, doing StartTLS if it's set
+func ldapConnect() (*ldap.Conn, error) {
+
+	c := config.LDAP
+
+	u, err := url.Parse(c.Url)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := ldap.DefaultLdapPort
+		if u.Scheme == "ldaps" {
+			port = ldap.DefaultLdapsPort
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.Insecure,
+		ServerName:         u.Hostname(),
+	}
+	if c.CA != "" {
+		pool, err := common.LoadCertPool(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	timeout := time.Duration(c.Timeout) * time.Second
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var netConn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		netConn, err = dialer.Dial("tcp", host)
+	case "ldaps":
+		netConn, err = tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+	default:
+		return nil, fmt.Errorf("LDAP URL must start with ldap:// or " +
+			"ldaps://")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn := ldap.NewConn(netConn, u.Scheme == "ldaps")
+	conn.SetTimeout(timeout)
+	conn.Start()
+
+	if c.StartTLS && u.Scheme == "ldap" {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// ldapSearch returns the entries below base that match the filter.
+// Asking for sizeLimit entries or more is an error.
+func ldapSearch(conn *ldap.Conn, base, filter string, attrs []string,
+	sizeLimit int) ([]*ldap.Entry, error) {
+
+	result, err := conn.Search(ldap.NewSearchRequest(base,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, sizeLimit,
+		int(config.LDAP.Timeout), false, filter, attrs, nil))
+	if err != nil {
+		return nil, err
+	}
+	return result.Entries, nil
+}
+
+// ldapAuthenticate checks the login and password with the LDAP server
+// and returns the user's entry and the DNs of the user's groups
+func ldapAuthenticate(login, password string) (*ldap.Entry, []string,
+	error) {
+
+	c := config.LDAP
+
+	conn, err := ldapConnect()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	// Find the user
+
+	if c.BindDN != "" {
+		if err := conn.Bind(c.BindDN, c.BindPassword); err != nil {
+			return nil, nil, fmt.Errorf("Bind as '%s' failed: %s",
+				c.BindDN, err.Error())
+		}
+	}
+
+	attrs := []string{c.ForenameAttr, c.SurnameAttr, c.EmailAttr,
+		c.GroupAttr}
+	entries, err := ldapSearch(conn, c.BaseDN,
+		ldapUserFilter(c.UserFilter, login), attrs, 2)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, nil, fmt.Errorf("More than one LDAP entry for '%s'",
+			login)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(entries) != 1 {
+		return nil, nil, fmt.Errorf("%d LDAP entries for '%s'",
+			len(entries), login)
+	}
+	entry := entries[0]
+
+	// Check the password
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		return nil, nil, err
+	}
+
+	// Find the user's groups
+
+	groups := ldapValues(entry, c.GroupAttr)
+
+	if c.GroupFilter != "" {
+		if c.BindDN != "" {
+			if err := conn.Bind(c.BindDN, c.BindPassword); err != nil {
+				return nil, nil, err
+			}
+		}
+		found, err := ldapSearch(conn, c.GroupBaseDN,
+			ldapUserFilter(c.GroupFilter, entry.DN), []string{"1.1"}, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, group := range found {
+			groups = append(groups, group.DN)
+		}
+	}
+
+	return entry, groups, nil
+}
+
+// ldapLogin checks the login and password with the LDAP server. Users
+// are created the first time they log in and their details, role and
+// groups are updated every time.
+func (api *Api) ldapLogin(login, password string) (User, error) {
+
+	entry, groups, err := ldapAuthenticate(login, password)
+	if err != nil {
+		logit(fmt.Sprintf("LDAP login for '%s' failed: %s", login,
+			err.Error()))
+		return User{}, err
+	}
+
+	user := User{}
+	mutex.Lock()
+	isNew := api.db.Where(User{Login: login}).First(&user).RecordNotFound()
+	mutex.Unlock()
+
+	if isNew {
+		user = User{
+			Login:      login,
+			Enabled:    true,
+			Role:       config.LDAP.DefaultRole,
+			AuthSource: AUTH_LDAP,
+		}
+	} else if user.AuthSource != AUTH_LDAP {
+		return User{}, ApiError{"Not an LDAP user."}
+	} else if !user.Enabled {
+		logit("LDAP login for disabled user '" + login + "'")
+		return User{}, ApiError{"User is disabled."}
+	}
+
+	user.Forename = ldapFirst(entry, config.LDAP.ForenameAttr)
+	user.Surname = ldapFirst(entry, config.LDAP.SurnameAttr)
+	user.Email = ldapFirst(entry, config.LDAP.EmailAttr)
+	user.Role = mappedRole(groups, config.LDAP.GroupRoles, ldapSameDN,
+		config.LDAP.DefaultRole, user.Role)
+
+	mutex.Lock()
+	if err := api.db.Save(&user).Error; err != nil {
+		mutex.Unlock()
+		return User{}, err
+	}
+	mutex.Unlock()
+
+	if isNew {
+		logit(fmt.Sprintf("Created user '%s' with role '%s' from LDAP",
+			login, user.Role))
+	}
+
+	api.syncMappedGroups(user, groups, config.LDAP.GroupMap, ldapSameDN,
+		"LDAP group")
+
+	return user, nil
+}
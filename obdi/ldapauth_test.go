@@ -0,0 +1,350 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/mclarkson/obdi/external/go-asn1-ber/asn1-ber"
+	"github.com/mclarkson/obdi/external/go-ldap/ldap"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLdapUserFilter(t *testing.T) {
+
+	tests := []struct {
+		template, value, want string
+	}{
+		{"(uid=%s)", "jbloggs", "(uid=jbloggs)"},
+		{"(uid=%s)", "*", `(uid=\2a)`},
+		{"(uid=%s)", "a)(uid=*", `(uid=a\29\28uid=\2a)`},
+		{"(uid=%s)", `a\b`, `(uid=a\5cb)`},
+		{"(uid=%s)", "a\x00b", `(uid=a\00b)`},
+		{"(|(uid=%s)(mail=%s))", "x", "(|(uid=x)(mail=x))"},
+	}
+
+	for _, test := range tests {
+		got := ldapUserFilter(test.template, test.value)
+		if got != test.want {
+			t.Errorf("ldapUserFilter(%q, %q) = %q, want %q",
+				test.template, test.value, got, test.want)
+		}
+		if _, err := ldap.CompileFilter(got); err != nil {
+			t.Errorf("%q doesn't compile: %s", got, err)
+		}
+	}
+}
+
+func TestLdapDefaultsFilters(t *testing.T) {
+
+	tests := []struct {
+		userFilter, groupFilter string
+		ok                      bool
+	}{
+		{"", "", true},
+		{"(&(objectClass=person)(uid=%s))", "(member=%s)", true},
+		{"uid=%s", "", false},
+		{"(uid=%s", "", false},
+		{"(uid=%s)", "(member=%s", false},
+	}
+
+	for _, test := range tests {
+		c := LdapConfig{
+			Enabled:     true,
+			Url:         "ldap://localhost",
+			BaseDN:      "dc=example,dc=com",
+			UserFilter:  test.userFilter,
+			GroupFilter: test.groupFilter,
+		}
+		err := c.ldapDefaults()
+		if (err == nil) != test.ok {
+			t.Errorf("user_filter %q, group_filter %q: got error %v",
+				test.userFilter, test.groupFilter, err)
+		}
+	}
+}
+
+// ldapFixture is an LDAP server with a few users, enough for a login
+type ldapFixture struct {
+	listener  net.Listener
+	passwords map[string]string // DN to password
+	entries   []*ldap.Entry
+	groups    map[string][]string // Group DN to member DNs
+	mutex     sync.Mutex
+	filters   []string // Search filters received
+}
+
+func newLdapFixture(t *testing.T) *ldapFixture {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &ldapFixture{
+		listener: listener,
+		passwords: map[string]string{
+			"cn=reader,dc=example,dc=com":             "readerpw",
+			"uid=jbloggs,ou=people,dc=example,dc=com": "secret",
+			"uid=twin,ou=people,dc=example,dc=com":    "twinpw",
+			"uid=twin,ou=others,dc=example,dc=com":    "twinpw",
+		},
+		entries: []*ldap.Entry{
+			ldap.NewEntry("uid=jbloggs,ou=people,dc=example,dc=com",
+				map[string][]string{
+					"uid":       {"jbloggs"},
+					"givenname": {"Joe"},
+					"sn":        {"Bloggs"},
+					"mail":      {"joe@example.com"},
+					"memberOf":  {"cn=admins,ou=groups,dc=example,dc=com"},
+				}),
+			ldap.NewEntry("uid=twin,ou=people,dc=example,dc=com",
+				map[string][]string{"uid": {"twin"}}),
+			ldap.NewEntry("uid=twin,ou=others,dc=example,dc=com",
+				map[string][]string{"uid": {"twin"}}),
+		},
+		groups: map[string][]string{
+			"cn=ops,ou=groups,dc=example,dc=com": {
+				"uid=jbloggs,ou=people,dc=example,dc=com"},
+		},
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	return f
+}
+
+func (f *ldapFixture) Close() {
+	f.listener.Close()
+}
+
+func (f *ldapFixture) Url() string {
+	return "ldap://" + f.listener.Addr().String()
+}
+
+// serve answers bind and search requests until the client unbinds
+func (f *ldapFixture) serve(conn net.Conn) {
+
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		msgId := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+			code := int64(ldap.LDAPResultInvalidCredentials)
+			if pw, ok := f.passwords[dn]; ok && pw == password {
+				code = ldap.LDAPResultSuccess
+			}
+			f.reply(conn, msgId, ldap.ApplicationBindResponse, code)
+
+		case ldap.ApplicationSearchRequest:
+			f.search(conn, msgId, op)
+
+		default:
+			return
+		}
+	}
+}
+
+// search answers a search for (uid=x) below a base DN with the user's
+// entry, or for (member=x) with the groups x is in
+func (f *ldapFixture) search(conn net.Conn, msgId int64, op *ber.Packet) {
+
+	base := op.Children[0].Data.String()
+	sizeLimit := int(op.Children[3].Value.(int64))
+	filter, err := ldap.DecompileFilter(op.Children[6])
+	if err != nil {
+		f.reply(conn, msgId, ldap.ApplicationSearchResultDone,
+			ldap.LDAPResultProtocolError)
+		return
+	}
+
+	f.mutex.Lock()
+	f.filters = append(f.filters, filter)
+	f.mutex.Unlock()
+
+	found := []*ldap.Entry{}
+	if strings.HasPrefix(filter, "(uid=") {
+		uid := strings.TrimSuffix(strings.TrimPrefix(filter, "(uid="), ")")
+		for _, entry := range f.entries {
+			if entry.GetAttributeValue("uid") == uid &&
+				strings.HasSuffix(entry.DN, base) {
+				found = append(found, entry)
+			}
+		}
+	} else if strings.HasPrefix(filter, "(member=") {
+		member := strings.TrimSuffix(strings.TrimPrefix(filter,
+			"(member="), ")")
+		for group, members := range f.groups {
+			for _, m := range members {
+				if m == member {
+					found = append(found, ldap.NewEntry(group, nil))
+				}
+			}
+		}
+	}
+
+	code := int64(ldap.LDAPResultSuccess)
+	if sizeLimit > 0 && len(found) > sizeLimit {
+		found = found[:sizeLimit]
+		code = ldap.LDAPResultSizeLimitExceeded
+	}
+	for _, entry := range found {
+		conn.Write(ldapFixtureEntry(msgId, entry).Bytes())
+	}
+	f.reply(conn, msgId, ldap.ApplicationSearchResultDone, code)
+}
+
+// reply sends an LDAPResult
+func (f *ldapFixture) reply(conn net.Conn, msgId int64, tag ber.Tag,
+	code int64) {
+
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag,
+		nil, "")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal,
+		ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal,
+		ber.TypePrimitive, ber.TagOctetString, "", ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal,
+		ber.TypePrimitive, ber.TagOctetString, "", ""))
+	conn.Write(ldapFixtureMessage(msgId, result).Bytes())
+}
+
+func ldapFixtureMessage(msgId int64, op *ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed,
+		ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal,
+		ber.TypePrimitive, ber.TagInteger, msgId, ""))
+	packet.AppendChild(op)
+	return packet
+}
+
+func ldapFixtureEntry(msgId int64, entry *ldap.Entry) *ber.Packet {
+
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed,
+		ldap.ApplicationSearchResultEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive,
+		ber.TagOctetString, entry.DN, ""))
+
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed,
+		ber.TagSequence, nil, "")
+	for _, a := range entry.Attributes {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed,
+			ber.TagSequence, nil, "")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal,
+			ber.TypePrimitive, ber.TagOctetString, a.Name, ""))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed,
+			ber.TagSet, nil, "")
+		for _, v := range a.Values {
+			values.AppendChild(ber.NewString(ber.ClassUniversal,
+				ber.TypePrimitive, ber.TagOctetString, v, ""))
+		}
+		attr.AppendChild(values)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+
+	return ldapFixtureMessage(msgId, op)
+}
+
+func TestLdapAuthenticate(t *testing.T) {
+
+	f := newLdapFixture(t)
+	defer f.Close()
+
+	saved := config.LDAP
+	defer func() { config.LDAP = saved }()
+
+	config.LDAP = LdapConfig{
+		Enabled:      true,
+		Url:          f.Url(),
+		BindDN:       "cn=reader,dc=example,dc=com",
+		BindPassword: "readerpw",
+		BaseDN:       "dc=example,dc=com",
+		GroupFilter:  "(member=%s)",
+		ForenameAttr: "givenName",
+		Timeout:      5,
+	}
+	if err := config.LDAP.ldapDefaults(); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, groups, err := ldapAuthenticate("jbloggs", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.DN != "uid=jbloggs,ou=people,dc=example,dc=com" {
+		t.Errorf("DN is %q", entry.DN)
+	}
+	if got := ldapFirst(entry, config.LDAP.ForenameAttr); got != "Joe" {
+		t.Errorf("forename is %q", got)
+	}
+	if got := ldapFirst(entry, config.LDAP.EmailAttr); got !=
+		"joe@example.com" {
+		t.Errorf("email is %q", got)
+	}
+	want := []string{"cn=admins,ou=groups,dc=example,dc=com",
+		"cn=ops,ou=groups,dc=example,dc=com"}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("groups are %q, want %q", groups, want)
+	}
+
+	failures := []struct {
+		login, password string
+	}{
+		{"jbloggs", "wrong"},
+		{"jbloggs", ""},
+		{"nobody", "secret"},
+		{"twin", "twinpw"}, // Two entries
+		{"*", "secret"},
+		{"jbloggs)(uid=*", "secret"},
+	}
+	for _, test := range failures {
+		if _, _, err := ldapAuthenticate(test.login,
+			test.password); err == nil {
+			t.Errorf("%q with password %q logged in", test.login,
+				test.password)
+		}
+	}
+
+	// Logins are sent escaped, never as filter syntax
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, filter := range f.filters {
+		if strings.Contains(filter, "(uid=*") {
+			t.Errorf("unescaped filter %q sent", filter)
+		}
+	}
+}
@@ -21,12 +21,74 @@ import (
 	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
 )
 
+// Where a user's password is checked
+const (
+	AUTH_LOCAL = "local" // The bcrypt hash in User.Passhash
+	AUTH_LDAP  = "ldap"  // The LDAP server, see ldapauth.go
+	AUTH_OIDC  = "oidc"  // The OpenID Connect provider, see oidc.go
+)
+
+// checkAuthSource returns an error unless s is one of the AUTH_* values
+func checkAuthSource(s string) error {
+	if s != AUTH_LOCAL && s != AUTH_LDAP && s != AUTH_OIDC {
+		return ApiError{"AuthSource must be " + AUTH_LOCAL + ", " +
+			AUTH_LDAP + " or " + AUTH_OIDC}
+	}
+	return nil
+}
+
+// passwordLoginAllowed returns an error if the user has to use single
+// sign-on. Local admins can always log in with a password, so there's a
+// way in when the OIDC provider is down, and so can workers.
+func passwordLoginAllowed(user User) error {
+
+	if !config.OIDC.Enabled || config.OIDC.PasswordLogins {
+		return nil
+	}
+
+	if user.AuthSource == AUTH_LOCAL &&
+		(user.Role == ROLE_ADMIN || user.Role == ROLE_WORKER) {
+		return nil
+	}
+
+	return ApiError{"Use single sign-on to log in."}
+}
+
+// newSession makes a new session for the user, leaving any others the
+// user has open. A restricted session can only set up two-factor
+// authentication.
+func (api *Api) newSession(user User, restricted bool,
+	r *rest.Request) (Session, error) {
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > SESSION_AGENT_MAX {
+		userAgent = userAgent[:SESSION_AGENT_MAX]
+	}
+
+	session := Session{
+		Guid:       NewGUID(),
+		UserId:     user.Id,
+		Restricted: restricted,
+		ClientIp:   clientIp(r),
+		UserAgent:  userAgent,
+	}
+
+	mutex.Lock()
+	if err := api.db.Save(&session).Error; err != nil {
+		mutex.Unlock()
+		return session, err
+	}
+	mutex.Unlock()
+
+	return session, nil
+}
+
 // DoLogin processes "POST /login" queries.
 //
 // Checks login name and passhash stored in database.
 // If correct then 200 header and GUID are sent.
-//    any previous sessions for that user are closed.
-//    new session entry is made in session table.
+//    new session entry is made in session table, the user's other
+//    sessions stay open.
 // If not correct then 400 header with error message.
 //
 func (api *Api) DoLogin(w rest.ResponseWriter, r *rest.Request) {
@@ -43,81 +105,114 @@ func (api *Api) DoLogin(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
+	// Workers can be made to prove who they are with a client certificate
+
+	if err := checkClientCert(userData.Login, r.Request); err != nil {
+		rest.Error(w, err.Error(), 401)
+		return
+	}
+
 	//fmt.Printf( "\n%#v\n", userData )
 	// Get passhash for login from database
 
 	user := User{}
 	mutex.Lock()
-	if api.db.Where(User{Login: userData.Login}).
-		First(&user).RecordNotFound() {
-		rest.Error(w, "User or password error.", 400)
-		mutex.Unlock()
-		return
-	}
+	found := !api.db.Where(User{Login: userData.Login}).
+		First(&user).RecordNotFound()
 	mutex.Unlock()
 
-	// Check password against hash
+	if found && user.AuthSource == AUTH_LOCAL {
+
+		// Check password against hash
+
+		c := &Crypt{}
+		c.Pass = []byte(userData.Password)
+		c.Hash = []byte(user.Passhash)
+		if err := c.Check(); err != nil {
+			rest.Error(w, "User or password error.", 400)
+			return
+		}
+
+	} else if (!found || user.AuthSource == AUTH_LDAP) &&
+		config.LDAP.Enabled {
 
-	c := &Crypt{}
-	c.Pass = []byte(userData.Password)
-	c.Hash = []byte(user.Passhash)
-	if err := c.Check(); err != nil {
+		// Check the password with the LDAP server, which also creates
+		// the user on their first login
+
+		var err error
+		if user, err = api.ldapLogin(userData.Login,
+			userData.Password); err != nil {
+			rest.Error(w, "User or password error.", 400)
+			return
+		}
+
+	} else {
 		rest.Error(w, "User or password error.", 400)
 		return
 	}
 
-	// The user's password matches.
-	// Delete old session(s) and create a new one.
-
-	guid := NewGUID()
-	session := Session{}
-
-	for {
-		session = Session{}
-		mutex.Lock()
-		if api.db.Where(Session{UserId: user.Id}).
-			First(&session).RecordNotFound() {
-
-			session = Session{
-				Guid:   guid,
-				UserId: user.Id,
-			}
-			if err := api.db.Save(&session).Error; err != nil {
-				rest.Error(w, err.Error(), 400)
-				mutex.Unlock()
-				return
-			}
-			mutex.Unlock()
-			break
-
-		} else {
-
-			if err := api.db.Delete(&session).Error; err != nil {
-				rest.Error(w, err.Error(), 400)
-				mutex.Unlock()
-				return
-			}
+	if err := passwordLoginAllowed(user); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	// The user's password matches. Users with two-factor authentication
+	// send a code next, see TotpLogin.
+
+	if user.TotpEnabled {
+		token, err := totpChallenge(user)
+		if err != nil {
+			rest.Error(w, err.Error(), 500)
+			return
 		}
-		mutex.Unlock()
+		w.WriteJson(struct {
+			TOTPRequired bool
+			Token        string
+		}{true, token})
+		return
+	}
+
+	// Start a new session. The user's other sessions are kept.
+
+	api.startSession(w, r, user)
+}
+
+// startSession makes a new session for the user and sends its GUID.
+// Users that must use two-factor authentication but haven't set it up
+// get a restricted session, which can only set it up.
+func (api *Api) startSession(w rest.ResponseWriter, r *rest.Request,
+	user User) {
+
+	restricted := !user.TotpEnabled && api.totpRequired(user)
+
+	session, err := api.newSession(user, restricted, r)
+	if err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
 	}
 
 	logit("User '" + user.Login + "' logged in")
 	api.LogActivity(session.Id, "User '"+user.Login+"' logged in.")
 
-	w.WriteJson(struct{ GUID string }{guid})
+	// The GUID is sent both ways, see auth.go
+	setSessionCookie(w, session.Guid)
+
+	w.WriteJson(struct {
+		GUID, Role string
+		TOTPSetup  bool
+	}{session.Guid, user.Role, restricted})
 }
 
 func (api *Api) Logout(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware. Restricted sessions
+	// can log out too.
 
+	session := authSession(r)
 	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
 
-	session := Session{}
-	var errl error = nil
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 400)
+	if session.TokenId != 0 {
+		rest.Error(w, "Revoke API tokens instead.", 400)
 		return
 	}
 
@@ -129,6 +224,8 @@ func (api *Api) Logout(w rest.ResponseWriter, r *rest.Request) {
 	}
 	mutex.Unlock()
 
+	setSessionCookie(w, "")
+
 	logit("User '" + login + "' logged out")
 	api.LogActivity(session.Id, "User '"+login+"' logged out")
 	w.WriteJson("Success")
@@ -39,6 +39,7 @@ func main() {
 
 	handler := rest.ResourceHandler{
 		EnableRelaxedContentType: true,
+		PreRoutingMiddlewares:    []rest.Middleware{&AuthMiddleware{&api}},
 		//DisableJsonIndent: true,
 		//EnableGzip:        true,
 	}
@@ -46,6 +47,18 @@ func main() {
 
 		&rest.Route{"POST", "/login", api.DoLogin},
 
+		&rest.Route{"POST", "/login/totp", api.TotpLogin},
+
+		// OpenID Connect single sign-on
+
+		&rest.Route{"GET", "/oidc", api.GetOidc},
+
+		&rest.Route{"GET", "/oidc/login", api.OidcLogin},
+
+		&rest.Route{"GET", "/oidc/callback", api.OidcCallback},
+
+		&rest.Route{"POST", "/oidc/ticket", api.OidcTicket},
+
 		&rest.Route{"POST", "/#login/:GUID/logout", api.Logout},
 
 		// ADMIN FUNCTIONS
@@ -60,6 +73,37 @@ func main() {
 
 		&rest.Route{"DELETE", "/:login/:GUID/users/:id", api.DeleteUser},
 
+		&rest.Route{"DELETE", "/:login/:GUID/users/:id/totp", api.ResetTotp},
+
+		// Two-factor authentication, for the logged in user
+
+		&rest.Route{"GET", "/#login/:GUID/totp", api.GetTotp},
+
+		&rest.Route{"POST", "/#login/:GUID/totp", api.SetupTotp},
+
+		&rest.Route{"POST", "/#login/:GUID/totp/confirm", api.ConfirmTotp},
+
+		&rest.Route{"POST", "/#login/:GUID/totp/recoverycodes",
+			api.NewTotpRecoveryCodes},
+
+		&rest.Route{"POST", "/#login/:GUID/totp/disable", api.DisableTotp},
+
+		// API tokens, used in place of the GUID
+
+		&rest.Route{"GET", "/#login/:GUID/apitokens", api.GetAllApiTokens},
+
+		&rest.Route{"POST", "/#login/:GUID/apitokens", api.AddApiToken},
+
+		&rest.Route{"DELETE", "/#login/:GUID/apitokens/:id",
+			api.DeleteApiToken},
+
+		// Sessions, one for each place a user is logged in
+
+		&rest.Route{"GET", "/#login/:GUID/sessions", api.GetAllSessions},
+
+		&rest.Route{"DELETE", "/#login/:GUID/sessions/:id",
+			api.DeleteSession},
+
 		// Data Centres
 
 		&rest.Route{"GET", "/:login/:GUID/dcs", api.GetAllDcs},
@@ -90,6 +134,42 @@ func main() {
 
 		&rest.Route{"PUT", "/:login/:GUID/perms/:id", api.UpdatePerm},
 
+		// Script permissions
+
+		&rest.Route{"GET", "/:login/:GUID/scriptperms", api.GetAllScriptPerms},
+
+		&rest.Route{"POST", "/:login/:GUID/scriptperms", api.AddScriptPerm},
+
+		&rest.Route{"DELETE", "/:login/:GUID/scriptperms/:id",
+			api.DeleteScriptPerm},
+
+		&rest.Route{"PUT", "/:login/:GUID/scriptperms/:id",
+			api.UpdateScriptPerm},
+
+		// Groups of users
+
+		&rest.Route{"GET", "/:login/:GUID/groups", api.GetAllGroups},
+
+		&rest.Route{"POST", "/:login/:GUID/groups", api.AddGroup},
+
+		&rest.Route{"DELETE", "/:login/:GUID/groups/:id", api.DeleteGroup},
+
+		&rest.Route{"PUT", "/:login/:GUID/groups/:id", api.UpdateGroup},
+
+		&rest.Route{"GET", "/:login/:GUID/groupmembers",
+			api.GetAllGroupMembers},
+
+		&rest.Route{"POST", "/:login/:GUID/groupmembers",
+			api.AddGroupMember},
+
+		&rest.Route{"DELETE", "/:login/:GUID/groupmembers/:id",
+			api.DeleteGroupMember},
+
+		// What a user can see and run, from all of their grants
+
+		&rest.Route{"GET", "/:login/:GUID/users/:id/effectiveperms",
+			api.GetEffectivePerms},
+
 		// Data Centre Capabilities
 
 		&rest.Route{"GET", "/:login/:GUID/dccaps", api.GetAllDcCaps},
@@ -134,12 +214,38 @@ func main() {
 
 		&rest.Route{"GET", "/#login/:GUID/scripts", api.GetAllScripts},
 
+		&rest.Route{"GET", "/#login/:GUID/scripts/hash/:hash",
+			api.GetScriptByHash},
+
 		&rest.Route{"POST", "/:login/:GUID/scripts", api.AddScript},
 
+		&rest.Route{"POST", "/:login/:GUID/scripts/sync", api.SyncScripts},
+
 		&rest.Route{"DELETE", "/:login/:GUID/scripts/:id", api.DeleteScript},
 
 		&rest.Route{"PUT", "/:login/:GUID/scripts/:id", api.UpdateScript},
 
+		&rest.Route{"GET", "/#login/:GUID/scripts/:id/revisions",
+			api.GetAllRevisions},
+
+		&rest.Route{"GET", "/#login/:GUID/scripts/:id/revisions/:rev",
+			api.GetRevision},
+
+		&rest.Route{"GET", "/#login/:GUID/scripts/:id/diff",
+			api.DiffRevisions},
+
+		&rest.Route{"POST", "/:login/:GUID/scripts/:id/revisions/:rev/restore",
+			api.RestoreRevision},
+
+		&rest.Route{"POST", "/:login/:GUID/scripts/:id/validate",
+			api.ValidateScript},
+
+		&rest.Route{"PUT", "/:login/:GUID/scripts/:id/validation",
+			api.OverrideValidation},
+
+		&rest.Route{"PUT", "/:login/:GUID/scripts/:id/restricted",
+			api.SetScriptRestricted},
+
 		// Jobs
 
 		&rest.Route{"GET", "/#login/:GUID/jobs", api.GetAllJobs},
@@ -152,6 +258,50 @@ func main() {
 
 		&rest.Route{"PUT", "/#login/:GUID/jobs/:id", api.UpdateJob},
 
+		// Pull mode workers
+
+		&rest.Route{"GET", "/#login/:GUID/pull", api.PullJobs},
+
+		// Workers
+
+		&rest.Route{"GET", "/:login/:GUID/workers", api.GetAllWorkers},
+
+		&rest.Route{"POST", "/:login/:GUID/workers", api.AddWorker},
+
+		&rest.Route{"DELETE", "/:login/:GUID/workers/:id", api.DeleteWorker},
+
+		&rest.Route{"PUT", "/:login/:GUID/workers/:id", api.UpdateWorker},
+
+		&rest.Route{"POST", "/#login/:GUID/workers/register",
+			api.RegisterWorker},
+
+		&rest.Route{"POST", "/#login/:GUID/workers/heartbeat",
+			api.WorkerHeartbeat},
+
+		&rest.Route{"POST", "/:login/:GUID/workers/:id/token",
+			api.NewWorkerToken},
+
+		&rest.Route{"GET", "/:login/:GUID/workers/:id/health",
+			api.GetWorkerHealth},
+
+		&rest.Route{"GET", "/:login/:GUID/workers/:id/jobs/:jobid",
+			api.GetWorkerJob},
+
+		// Workers using an API token
+
+		&rest.Route{"POST", "/worker/register", api.RegisterWorkerByToken},
+
+		&rest.Route{"POST", "/worker/heartbeat", api.WorkerHeartbeatByToken},
+
+		&rest.Route{"GET", "/worker/pull", api.PullJobsByToken},
+
+		&rest.Route{"POST", "/worker/outputlines", api.AddOutputLineByToken},
+
+		&rest.Route{"PUT", "/worker/jobs/:id", api.UpdateJobByToken},
+
+		&rest.Route{"GET", "/worker/scripts/hash/:hash",
+			api.GetScriptByToken},
+
 		// Plugins
 
 		&rest.Route{"GET", "/#login/:GUID/plugins", api.GetAllPlugins},
@@ -215,6 +365,8 @@ func main() {
 	// Add the REST API handle
 	http.Handle("/api/", http.StripPrefix("/api", &handler))
 
+	go api.purgeSessions()
+
 	// Add the Web Server handle
 	changeHeaderThenServe := func(h http.Handler) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
@@ -238,8 +390,14 @@ func main() {
 	http.HandleFunc("/manager/admin", api.serveRunTemplate)
 
 	if config.SSLEnabled {
-		if err := http.ListenAndServeTLS(config.ListenAddr,
-			config.SSLCertFile, config.SSLKeyFile, nil); err != nil {
+		tlsConfig, err := listenerTLSConfig()
+		if err != nil {
+			logit(err.Error())
+			return
+		}
+		server := &http.Server{Addr: config.ListenAddr, TLSConfig: tlsConfig}
+		if err := server.ListenAndServeTLS(config.SSLCertFile,
+			config.SSLKeyFile); err != nil {
 			logit(err.Error())
 		}
 	} else {
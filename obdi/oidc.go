@@ -0,0 +1,802 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// OpenID Connect single sign-on for the GUI. It's the authorization code
+// flow with PKCE:
+//
+//   1. The login page sends the browser to GET /oidc/login, which
+//      redirects it to the provider.
+//   2. The provider sends it back to GET /oidc/callback with a code. The
+//      code is swapped for an ID token, which is checked, and the user is
+//      found, or created, from its claims. A session is made as DoLogin
+//      does and the browser is sent to the manager with a ticket.
+//   3. The login page swaps the ticket for the GUID with POST
+//      /oidc/ticket. The ticket can only be used once and doesn't last
+//      long, so the GUID is never in a URL.
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/mclarkson/obdi/common"
+	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type OidcConfig struct {
+	Enabled        bool     `toml:"enabled"`
+	Name           string   `toml:"name"` // Shown on the login button
+	Issuer         string   `toml:"issuer"`
+	ClientId       string   `toml:"client_id"`
+	ClientSecret   string   `toml:"client_secret"`
+	RedirectUrl    string   `toml:"redirect_url"` // .../api/oidc/callback
+	Scopes         []string `toml:"scopes"`
+	CA             string   `toml:"ca"`
+	Insecure       bool     `toml:"insecure"`
+	LoginClaim     string   `toml:"login_claim"`
+	ForenameClaim  string   `toml:"forename_claim"`
+	SurnameClaim   string   `toml:"surname_claim"`
+	EmailClaim     string   `toml:"email_claim"`
+	GroupsClaim    string   `toml:"groups_claim"`
+	DefaultRole    string   `toml:"default_role"`
+	Timeout        int64    `toml:"timeout"`         // Seconds
+	PasswordLogins bool     `toml:"password_logins"` // For everyone
+
+	// Group in the groups claim to obdi role, and to obdi group name
+	GroupRoles map[string]string `toml:"group_roles"`
+	GroupMap   map[string]string `toml:"groups"`
+}
+
+// How long a login at the provider, and a ticket, can take
+const (
+	OIDC_LOGIN_TIMEOUT  = 10 * time.Minute
+	OIDC_TICKET_TIMEOUT = time.Minute
+	OIDC_STATE_COOKIE   = "obdi_oidc_state"
+)
+
+// The parts of the provider's discovery document that are used
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+// A login that has been sent to the provider
+type oidcLogin struct {
+	Nonce     string
+	Verifier  string // PKCE code verifier
+	Interface string // run or admin
+	Expires   time.Time
+}
+
+// A login that has finished, waiting for the GUI to fetch its GUID
+type oidcTicket struct {
+	Login   string
+	GUID    string
+	Role    string
+	Expires time.Time
+}
+
+var (
+	oidcMutex    = &sync.Mutex{}
+	oidcMeta     *oidcProvider
+	oidcKeys     = map[string]crypto.PublicKey{}
+	oidcKeysTime time.Time
+	oidcLogins   = map[string]oidcLogin{}
+	oidcTickets  = map[string]oidcTicket{}
+
+	oidcClient     *http.Client
+	oidcClientErr  error
+	oidcClientOnce sync.Once
+)
+
+// oidcDefaults fills in the settings that weren't set and returns an
+// error if the rest can't work
+func (c *OidcConfig) oidcDefaults() error {
+
+	if c.Name == "" {
+		c.Name = "single sign-on"
+	}
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{"openid", "profile", "email"}
+	}
+	if c.LoginClaim == "" {
+		c.LoginClaim = "preferred_username"
+	}
+	if c.ForenameClaim == "" {
+		c.ForenameClaim = "given_name"
+	}
+	if c.SurnameClaim == "" {
+		c.SurnameClaim = "family_name"
+	}
+	if c.EmailClaim == "" {
+		c.EmailClaim = "email"
+	}
+	if c.GroupsClaim == "" {
+		c.GroupsClaim = "groups"
+	}
+	if c.DefaultRole == "" {
+		c.DefaultRole = ROLE_OPERATOR
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10
+	}
+
+	if !c.Enabled {
+		return nil
+	}
+
+	if c.Issuer == "" || c.ClientId == "" || c.RedirectUrl == "" {
+		return fmt.Errorf("issuer, client_id and redirect_url must be set")
+	}
+	if u, err := url.Parse(c.RedirectUrl); err != nil || !u.IsAbs() {
+		return fmt.Errorf("redirect_url must be a full URL")
+	}
+	hasOpenid := false
+	for _, scope := range c.Scopes {
+		if scope == "openid" {
+			hasOpenid = true
+		}
+	}
+	if !hasOpenid {
+		c.Scopes = append([]string{"openid"}, c.Scopes...)
+	}
+	if err := checkRole(c.DefaultRole); err != nil {
+		return fmt.Errorf("default_role: %s", err.Error())
+	}
+	for group, role := range c.GroupRoles {
+		if err := checkRole(role); err != nil {
+			return fmt.Errorf("group_roles '%s': %s", group, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// oidcHttpClient returns the client used to talk to the provider
+func oidcHttpClient() (*http.Client, error) {
+	oidcClientOnce.Do(func() {
+		tlsConfig := &tls.Config{InsecureSkipVerify: config.OIDC.Insecure}
+		if config.OIDC.CA != "" {
+			pool, err := common.LoadCertPool(config.OIDC.CA)
+			if err != nil {
+				oidcClientErr = err
+				logit("OIDC TLS setup failed: " + err.Error())
+				return
+			}
+			tlsConfig.RootCAs = pool
+		}
+		oidcClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout:   time.Duration(config.OIDC.Timeout) * time.Second,
+		}
+	})
+	return oidcClient, oidcClientErr
+}
+
+// oidcRandom returns n random bytes, base64url encoded
+func oidcRandom(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// oidcGetJSON fetches a URL from the provider and decodes the JSON
+func oidcGetJSON(rawurl string, v interface{}) error {
+
+	client, err := oidcHttpClient()
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Get(rawurl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("GET %s returned %s", rawurl, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// oidcDiscover returns the provider's endpoints. They are fetched once.
+func oidcDiscover() (oidcProvider, error) {
+
+	oidcMutex.Lock()
+	meta := oidcMeta
+	oidcMutex.Unlock()
+	if meta != nil {
+		return *meta, nil
+	}
+
+	issuer := config.OIDC.Issuer
+	p := oidcProvider{}
+	if err := oidcGetJSON(strings.TrimSuffix(issuer, "/")+
+		"/.well-known/openid-configuration", &p); err != nil {
+		return p, err
+	}
+
+	if p.Issuer != issuer {
+		return p, fmt.Errorf("Provider issuer '%s' is not '%s'", p.Issuer,
+			issuer)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" ||
+		p.JwksUri == "" {
+		return p, fmt.Errorf("Provider discovery document is incomplete")
+	}
+
+	oidcMutex.Lock()
+	oidcMeta = &p
+	oidcMutex.Unlock()
+
+	return p, nil
+}
+
+// oidcFetchKeys reads the provider's signing keys. Keys that can't be
+// used are skipped.
+func oidcFetchKeys(jwksUri string) (map[string]crypto.PublicKey, error) {
+
+	jwks := struct {
+		Keys []struct {
+			Kty, Kid, Use, Crv, N, E, X, Y string
+		}
+	}{}
+	if err := oidcGetJSON(jwksUri, &jwks); err != nil {
+		return nil, err
+	}
+
+	b64 := func(s string) *big.Int {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(b)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, e := b64(k.N), b64(k.E)
+			if n == nil || e == nil || !e.IsInt64() {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			x, y := b64(k.X), b64(k.Y)
+			if k.Crv != "P-256" || x == nil || y == nil ||
+				!elliptic.P256().IsOnCurve(x, y) {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x,
+				Y: y}
+		}
+	}
+
+	return keys, nil
+}
+
+// oidcKey returns the provider's key with the kid. The keys are fetched
+// again when the kid isn't known, so providers can rotate keys, but not
+// more than once a minute.
+func oidcKey(kid string) (crypto.PublicKey, error) {
+
+	oidcMutex.Lock()
+	key, ok := oidcKeys[kid]
+	stale := time.Since(oidcKeysTime) > time.Minute
+	oidcMutex.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("Unknown key id '%s'", kid)
+	}
+
+	p, err := oidcDiscover()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := oidcFetchKeys(p.JwksUri)
+	if err != nil {
+		return nil, err
+	}
+
+	oidcMutex.Lock()
+	oidcKeys = keys
+	oidcKeysTime = time.Now()
+	oidcMutex.Unlock()
+
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("Unknown key id '%s'", kid)
+	}
+
+	return key, nil
+}
+
+// oidcVerify checks the ID token's signature and claims and returns the
+// claims. Only RS256 and ES256 signatures are accepted.
+func oidcVerify(token, nonce string) (map[string]interface{}, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("ID token is not a JWT")
+	}
+
+	header := struct{ Alg, Kid string }{}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("ID token header: %s", err.Error())
+	}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return nil, fmt.Errorf("ID token header: %s", err.Error())
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("ID token signature: %s", err.Error())
+	}
+
+	key, err := oidcKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the signature
+
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch header.Alg {
+	case "RS256":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("Key '%s' is not an RSA key", header.Kid)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:],
+			sig); err != nil {
+			return nil, fmt.Errorf("ID token signature is invalid")
+		}
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("Key '%s' is not an EC key", header.Kid)
+		}
+		if len(sig) != 64 || !ecdsa.Verify(k, hash[:],
+			new(big.Int).SetBytes(sig[:32]),
+			new(big.Int).SetBytes(sig[32:])) {
+			return nil, fmt.Errorf("ID token signature is invalid")
+		}
+	default:
+		return nil, fmt.Errorf("ID token algorithm '%s' is not supported",
+			header.Alg)
+	}
+
+	// Check the claims
+
+	claims := map[string]interface{}{}
+	if b, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, fmt.Errorf("ID token claims: %s", err.Error())
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, fmt.Errorf("ID token claims: %s", err.Error())
+	}
+
+	if claims["iss"] != config.OIDC.Issuer {
+		return nil, fmt.Errorf("ID token issuer is wrong")
+	}
+
+	aud := oidcClaimList(claims, "aud")
+	audOk := false
+	for _, a := range aud {
+		if a == config.OIDC.ClientId {
+			audOk = true
+		}
+	}
+	if !audOk {
+		return nil, fmt.Errorf("ID token audience is wrong")
+	}
+	if azp, ok := claims["azp"]; (ok || len(aud) > 1) &&
+		azp != config.OIDC.ClientId {
+		return nil, fmt.Errorf("ID token authorized party is wrong")
+	}
+
+	// Allow the clocks to be a little out
+	now := float64(time.Now().Unix())
+	skew := float64(60)
+	if exp, ok := claims["exp"].(float64); !ok || exp+skew < now {
+		return nil, fmt.Errorf("ID token has expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && iat-skew > now {
+		return nil, fmt.Errorf("ID token was issued in the future")
+	}
+
+	if claims["nonce"] != nonce {
+		return nil, fmt.Errorf("ID token nonce is wrong")
+	}
+
+	return claims, nil
+}
+
+// oidcClaim returns a string claim, or "" if it isn't a string
+func oidcClaim(claims map[string]interface{}, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+// oidcClaimList returns a claim that can be a string or a list of
+// strings as a list
+func oidcClaimList(claims map[string]interface{}, name string) []string {
+
+	list := []string{}
+
+	switch v := claims[name].(type) {
+	case string:
+		list = append(list, v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+	}
+
+	return list
+}
+
+// oidcExchange swaps the code from the callback for an ID token
+func oidcExchange(code, verifier string) (string, error) {
+
+	p, err := oidcDiscover()
+	if err != nil {
+		return "", err
+	}
+	client, err := oidcHttpClient()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", config.OIDC.RedirectUrl)
+	form.Set("code_verifier", verifier)
+
+	// Public clients don't have a secret and send the client_id instead
+	if config.OIDC.ClientSecret == "" {
+		form.Set("client_id", config.OIDC.ClientId)
+	}
+
+	req, err := http.NewRequest("POST", p.TokenEndpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if config.OIDC.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(config.OIDC.ClientId),
+			url.QueryEscape(config.OIDC.ClientSecret))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	result := struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("Token endpoint returned %s", resp.Status)
+	}
+	if result.Error != "" {
+		return "", fmt.Errorf("Token endpoint error '%s' (%s)",
+			result.Error, result.ErrorDescription)
+	}
+	if resp.StatusCode != 200 || result.IdToken == "" {
+		return "", fmt.Errorf("Token endpoint returned no ID token (%s)",
+			resp.Status)
+	}
+
+	return result.IdToken, nil
+}
+
+// oidcLogin finds the user named by the ID token's claims. Users are
+// created the first time they log in and their details, role and groups
+// are updated every time.
+func (api *Api) oidcLogin(claims map[string]interface{}) (User, error) {
+
+	c := config.OIDC
+
+	login := oidcClaim(claims, c.LoginClaim)
+	if login == "" || strings.ContainsAny(login, "/ ") {
+		return User{}, fmt.Errorf("Claim '%s' is not a usable login",
+			c.LoginClaim)
+	}
+
+	user := User{}
+	mutex.Lock()
+	isNew := api.db.Where(User{Login: login}).First(&user).RecordNotFound()
+	mutex.Unlock()
+
+	if isNew {
+		user = User{
+			Login:      login,
+			Enabled:    true,
+			Role:       c.DefaultRole,
+			AuthSource: AUTH_OIDC,
+		}
+	} else if user.AuthSource != AUTH_OIDC {
+		return User{}, fmt.Errorf("'%s' is not an OIDC user", login)
+	} else if !user.Enabled {
+		return User{}, fmt.Errorf("'%s' is disabled", login)
+	}
+
+	groups := oidcClaimList(claims, c.GroupsClaim)
+	same := func(a, b string) bool { return a == b }
+
+	user.Forename = oidcClaim(claims, c.ForenameClaim)
+	user.Surname = oidcClaim(claims, c.SurnameClaim)
+	user.Email = oidcClaim(claims, c.EmailClaim)
+	user.Role = mappedRole(groups, c.GroupRoles, same, c.DefaultRole,
+		user.Role)
+
+	mutex.Lock()
+	if err := api.db.Save(&user).Error; err != nil {
+		mutex.Unlock()
+		return User{}, err
+	}
+	mutex.Unlock()
+
+	if isNew {
+		logit(fmt.Sprintf("Created user '%s' with role '%s' from OIDC",
+			login, user.Role))
+	}
+
+	api.syncMappedGroups(user, groups, c.GroupMap, same, "OIDC group")
+
+	return user, nil
+}
+
+// oidcRedirect sends the browser to the manager's run or admin page
+func oidcRedirect(w rest.ResponseWriter, iface string, query url.Values) {
+
+	if iface != "admin" {
+		iface = "run"
+	}
+
+	w.Header().Set("Location", "/manager/"+iface+"?"+query.Encode())
+	w.WriteHeader(302)
+}
+
+// GetOidc processes "GET /oidc" queries. The login page uses it to show
+// a single sign-on button.
+func (api *Api) GetOidc(w rest.ResponseWriter, r *rest.Request) {
+
+	w.WriteJson(map[string]interface{}{
+		"Enabled": config.OIDC.Enabled,
+		"Name":    config.OIDC.Name,
+	})
+}
+
+// OidcLogin processes "GET /oidc/login" queries. It sends the browser to
+// the provider. The interface parameter, run or admin, is where the
+// browser goes afterwards.
+func (api *Api) OidcLogin(w rest.ResponseWriter, r *rest.Request) {
+
+	if !config.OIDC.Enabled {
+		rest.Error(w, "Single sign-on is not enabled.", 400)
+		return
+	}
+
+	p, err := oidcDiscover()
+	if err != nil {
+		logit("OIDC discovery failed: " + err.Error())
+		rest.Error(w, "Single sign-on is not available.", 500)
+		return
+	}
+
+	state, err1 := oidcRandom(32)
+	nonce, err2 := oidcRandom(32)
+	verifier, err3 := oidcRandom(32)
+	if err1 != nil || err2 != nil || err3 != nil {
+		rest.Error(w, "Random number generator failed.", 500)
+		return
+	}
+
+	oidcMutex.Lock()
+	for s, login := range oidcLogins {
+		if time.Now().After(login.Expires) {
+			delete(oidcLogins, s)
+		}
+	}
+	oidcLogins[state] = oidcLogin{
+		Nonce:     nonce,
+		Verifier:  verifier,
+		Interface: r.URL.Query().Get("interface"),
+		Expires:   time.Now().Add(OIDC_LOGIN_TIMEOUT),
+	}
+	oidcMutex.Unlock()
+
+	authUrl, err := url.Parse(p.AuthorizationEndpoint)
+	if err != nil {
+		rest.Error(w, err.Error(), 500)
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	q := authUrl.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", config.OIDC.ClientId)
+	q.Set("redirect_uri", config.OIDC.RedirectUrl)
+	q.Set("scope", strings.Join(config.OIDC.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge",
+		base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	authUrl.RawQuery = q.Encode()
+
+	// The callback must come back to the browser that started the login
+
+	cookie := &http.Cookie{
+		Name:     OIDC_STATE_COOKIE,
+		Value:    state,
+		Path:     "/api/oidc/",
+		MaxAge:   int(OIDC_LOGIN_TIMEOUT.Seconds()),
+		Secure:   config.SSLEnabled,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	w.Header().Add("Set-Cookie", cookie.String())
+
+	w.Header().Set("Location", authUrl.String())
+	w.WriteHeader(302)
+}
+
+// OidcCallback processes "GET /oidc/callback" queries, where the
+// provider sends the browser back to. Errors are passed on to the login
+// page in the oidc_error parameter.
+func (api *Api) OidcCallback(w rest.ResponseWriter, r *rest.Request) {
+
+	q := r.URL.Query()
+	state := q.Get("state")
+
+	oidcMutex.Lock()
+	login, ok := oidcLogins[state]
+	delete(oidcLogins, state)
+	oidcMutex.Unlock()
+
+	fail := func(reason string) {
+		logit("OIDC login failed: " + reason)
+		oidcRedirect(w, login.Interface,
+			url.Values{"oidc_error": {"Single sign-on failed."}})
+	}
+
+	cookie, err := r.Cookie(OIDC_STATE_COOKIE)
+	if !ok || time.Now().After(login.Expires) {
+		fail("Unknown or expired state")
+		return
+	} else if err != nil || cookie.Value != state {
+		fail("State does not match the browser's cookie")
+		return
+	} else if q.Get("error") != "" {
+		fail(fmt.Sprintf("Provider error '%s' (%s)", q.Get("error"),
+			q.Get("error_description")))
+		return
+	}
+
+	token, err := oidcExchange(q.Get("code"), login.Verifier)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	claims, err := oidcVerify(token, login.Nonce)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	user, err := api.oidcLogin(claims)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+
+	// Two-factor authentication is left to the provider
+
+	session, err := api.newSession(user, false, r)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+
+	ticket, err := oidcRandom(32)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+
+	oidcMutex.Lock()
+	for t, tk := range oidcTickets {
+		if time.Now().After(tk.Expires) {
+			delete(oidcTickets, t)
+		}
+	}
+	oidcTickets[ticket] = oidcTicket{
+		Login:   user.Login,
+		GUID:    session.Guid,
+		Role:    user.Role,
+		Expires: time.Now().Add(OIDC_TICKET_TIMEOUT),
+	}
+	oidcMutex.Unlock()
+
+	logit("User '" + user.Login + "' logged in with OIDC")
+	api.LogActivity(session.Id, "User '"+user.Login+
+		"' logged in with OIDC.")
+
+	oidcRedirect(w, login.Interface, url.Values{"oidc_ticket": {ticket}})
+}
+
+// OidcTicket processes "POST /oidc/ticket" queries. It swaps the ticket
+// from the callback for the session's Login, GUID and Role.
+func (api *Api) OidcTicket(w rest.ResponseWriter, r *rest.Request) {
+
+	data := struct{ Ticket string }{}
+	if err := r.DecodeJsonPayload(&data); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	}
+
+	oidcMutex.Lock()
+	ticket, ok := oidcTickets[data.Ticket]
+	delete(oidcTickets, data.Ticket)
+	oidcMutex.Unlock()
+
+	if !ok || time.Now().After(ticket.Expires) {
+		rest.Error(w, "Invalid or expired ticket.", 400)
+		return
+	}
+
+	setSessionCookie(w, ticket.GUID)
+
+	w.WriteJson(struct{ Login, GUID, Role string }{ticket.Login,
+		ticket.GUID, ticket.Role})
+}
@@ -24,31 +24,52 @@ import (
 
 func (api *Api) GetAllOutputLines(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	session := authSession(r)
+	var errl error = nil
 
-	// Admin is not allowed
-	if login == "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	//session := Session{}
-	var errl error = nil
-	//if session,errl = api.CheckLogin( login, guid ); errl != nil {
-	if _, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_OUTPUT, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
+	// Only output from jobs in environments the user can read
+
+	readable := api.db
+	if !api.allEnvs(session, false) {
+		readable = api.db.Where("job_id in (SELECT jobs.id FROM jobs "+
+			"WHERE jobs.env_id in ("+envPermSQL(false)+"))",
+			session.UserId)
+	}
+	if session.TokenEnvId != 0 {
+		readable = readable.Where("job_id in (SELECT jobs.id FROM jobs "+
+			"WHERE jobs.env_id = ?)", session.TokenEnvId)
+	}
 
 	outputlines := []OutputLine{}
 	qs := r.URL.Query() // Query string - map[string][]string
 	if len(qs["job_id"]) > 0 {
 		srch := qs["job_id"][0]
+
+		job := Job{}
+		mutex.Lock()
+		if api.db.First(&job, "id = ?", srch).RecordNotFound() {
+			mutex.Unlock()
+			rest.Error(w, "Job ID not found.", 400)
+			return
+		}
+		mutex.Unlock()
+
+		if !api.canReadEnv(session, job.EnvId) {
+			rest.Error(w, "Not allowed. You can't see jobs in this "+
+				"environment.", 400)
+			return
+		}
+
 		if len(qs["top"]) > 0 {
 			mutex.Lock()
 			api.db.Order("serial").Limit(qs["top"][0]).Find(&outputlines,
@@ -67,7 +88,7 @@ func (api *Api) GetAllOutputLines(w rest.ResponseWriter, r *rest.Request) {
 		}
 	} else {
 		mutex.Lock()
-		err := api.db.Order("serial").Find(&outputlines)
+		err := readable.Order("serial").Find(&outputlines)
 		mutex.Unlock()
 		if err.Error != nil {
 			if !err.RecordNotFound() {
@@ -94,46 +115,77 @@ func (api *Api) GetAllOutputLines(w rest.ResponseWriter, r *rest.Request) {
 	w.WriteJson(&u)
 }
 
-func (api *Api) AddOutputLine(w rest.ResponseWriter, r *rest.Request) {
+// What a worker sends for each line of output
+type OutputLineReport struct {
+	Serial int64
+	JobId  int64
+	Text   string
+	JobKey string // The key sent to the worker with the job
+}
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+// saveOutputLine saves a line of output unless the job already has a
+// line with the same serial number. Workers send lines again if they're
+// not sure we got them. The check and the save are done under one lock
+// so a line sent twice at once is only saved once.
+func (api *Api) saveOutputLine(line OutputLine) error {
 
-	// Admin is not allowed
-	if login == "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	count := 0
+	api.db.Model(OutputLine{}).Where("job_id = ? and serial = ?",
+		line.JobId, line.Serial).Count(&count)
+	if count > 0 {
+		return nil
 	}
 
-	// Check credentials
-	//session := Session{}
+	return api.db.Save(&line).Error
+}
+
+func (api *Api) AddOutputLine(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware, without the session
+	// expiry check
+	session := authSession(r)
 	var errl error
-	if _, errl = api.CheckLoginNoExpiry(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_OUTPUT, ACTION_REPORT)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	//defer api.TouchSession( guid )
-
-	outputLineData := OutputLine{}
+	payload := OutputLineReport{}
 
-	if err := r.DecodeJsonPayload(&outputLineData); err != nil {
+	if err := r.DecodeJsonPayload(&payload); err != nil {
 		rest.Error(w, "Invalid data format received.", 400)
 		return
-	} else if outputLineData.JobId == 0 {
+	} else if payload.JobId == 0 {
 		rest.Error(w, "Incorrect data format received.", 400)
 		return
 	}
 
+	// Only the worker the job was sent to can add to its output
+
+	if _, err := api.keyedJob(payload.JobId, payload.JobKey); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	outputLineData := OutputLine{
+		Serial: payload.Serial,
+		JobId:  payload.JobId,
+		Text:   payload.Text,
+	}
+
 	// Add OutputLine
 
-	mutex.Lock()
-	if err := api.db.Save(&outputLineData).Error; err != nil {
-		mutex.Unlock()
+	if err := api.saveOutputLine(outputLineData); err != nil {
 		rest.Error(w, err.Error(), 400)
 		return
 	}
-	mutex.Unlock()
 
 	//text := ""
 	//fmt.Sprintf( text,"%d",outputLineData.JobId )
@@ -152,27 +204,19 @@ func (api *Api) UpdateOutputLine(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) DeleteOutputLine(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
-
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	// Credentials were checked by AuthMiddleware
 
-	// Admin is not allowed
+	session := authSession(r)
+	var errl error
 
-	if login == "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_OUTPUT, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Delete
 
 	id := 0
@@ -30,28 +30,19 @@ import (
 
 func (api *Api) GetAllPerms(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	session := authSession(r)
+	var errl error = nil
 
-	// Only admin is allowed
+	// Check the user's role allows it
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
-
-	//session := Session{}
-	var errl error = nil
-	//if session,errl = api.CheckLogin( login, guid ); errl != nil {
-	if _, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_PERMS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	qs := r.URL.Query() // Query string - map[string][]string
 	var id int64 = 0
 
@@ -83,6 +74,10 @@ func (api *Api) GetAllPerms(w rest.ResponseWriter, r *rest.Request) {
 		mutex.Lock()
 		api.db.Order("user_id").Find(&perms, "user_id = ?", id)
 		mutex.Unlock()
+	} else if len(qs["group_id"]) > 0 {
+		mutex.Lock()
+		api.db.Order("env_id").Find(&perms, "group_id = ?", qs["group_id"][0])
+		mutex.Unlock()
 		/*
 		   if api.db.Order("user_id").
 		      Find(&perms, "user_id = ?", srch).RecordNotFound() {
@@ -110,18 +105,28 @@ func (api *Api) GetAllPerms(w rest.ResponseWriter, r *rest.Request) {
 		u[i] = make(map[string]interface{})
 		u[i]["Id"] = perms[i].Id
 		u[i]["UserId"] = perms[i].UserId
+		u[i]["GroupId"] = perms[i].GroupId
 		u[i]["EnvId"] = perms[i].EnvId
 		u[i]["Writeable"] = perms[i].Writeable
 		u[i]["Enabled"] = perms[i].Enabled
 		u[i]["CreatedAt"] = perms[i].CreatedAt
 
-		user := User{}
-		mutex.Lock()
-		api.db.Model(&perms[i]).Related(&user)
-		mutex.Unlock()
-
-		u[i]["UserLogin"] = user.Login
-		u[i]["UserEnabled"] = user.Enabled
+		if perms[i].GroupId != 0 {
+			group := Group{}
+			mutex.Lock()
+			api.db.Model(&perms[i]).Related(&group)
+			mutex.Unlock()
+
+			u[i]["GroupName"] = group.Name
+		} else {
+			user := User{}
+			mutex.Lock()
+			api.db.Model(&perms[i]).Related(&user)
+			mutex.Unlock()
+
+			u[i]["UserLogin"] = user.Login
+			u[i]["UserEnabled"] = user.Enabled
+		}
 
 		env := Env{}
 		mutex.Lock()
@@ -148,27 +153,19 @@ func (api *Api) GetAllPerms(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) AddPerm(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
-
-	// Only admin is allowed
+	session := authSession(r)
+	var errl error
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_PERMS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Can't add if it exists already
 
 	permData := Perm{}
@@ -176,14 +173,19 @@ func (api *Api) AddPerm(w rest.ResponseWriter, r *rest.Request) {
 	if err := r.DecodeJsonPayload(&permData); err != nil {
 		rest.Error(w, "Invalid data format received.", 400)
 		return
-	} else if permData.UserId == 0 {
-		rest.Error(w, "Incorrect data format received.", 400)
+	}
+
+	if _, err := api.checkGrantee(permData.UserId,
+		permData.GroupId); err != nil {
+		rest.Error(w, err.Error(), 400)
 		return
 	}
+
 	perm := Perm{}
 	mutex.Lock()
-	if !api.db.Find(&perm, "env_id = ? and user_id = ?", permData.EnvId,
-		permData.UserId).RecordNotFound() {
+	if !api.db.Find(&perm, "env_id = ? and user_id = ? and group_id = ?",
+		permData.EnvId, permData.UserId,
+		permData.GroupId).RecordNotFound() {
 		mutex.Unlock()
 		rest.Error(w, "Record exists.", 400)
 		return
@@ -209,27 +211,19 @@ func (api *Api) AddPerm(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) UpdatePerm(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
-
-	// Only admin is allowed
+	session := authSession(r)
+	var errl error
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_PERMS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Ensure user exists
 
 	id := r.PathParam("id")
@@ -258,6 +252,11 @@ func (api *Api) UpdatePerm(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
+	if _, err := api.checkGrantee(perm.UserId, perm.GroupId); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
 	// Force the use of the path id over an id in the payload
 	Id, _ := strconv.Atoi(id)
 	perm.Id = int64(Id)
@@ -280,27 +279,19 @@ func (api *Api) UpdatePerm(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) DeletePerm(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	session := authSession(r)
+	var errl error
 
-	// Only admin is allowed
+	// Check the user's role allows it
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
+	errl = api.Authorize(session, RESOURCE_PERMS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
-		return
-	}
-
-	defer api.TouchSession(guid)
-
 	// Delete
 
 	id := 0
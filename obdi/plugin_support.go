@@ -215,26 +215,19 @@ func (api *Api) GenericGetEndpoint(w rest.ResponseWriter, r *rest.Request) {
 	port := strconv.FormatInt(api.Port(), 10)
 	defer api.DecrementPort()
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	session := authSession(r)
+	var errl error = nil
 
-	// Admin is not allowed
-	if login == "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	var errl error = nil
-	if _, errl = api.CheckLogin(login, guid); errl != nil {
-		logit(errl.Error())
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_PLUGINS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// If the plugin isn't available try to compile it
 
 	endpoint := r.PathParam("endpoint")
@@ -292,26 +285,19 @@ func (api *Api) GenericPostEndpoint(w rest.ResponseWriter, r *rest.Request) {
 	port := strconv.FormatInt(api.Port(), 10)
 	defer api.DecrementPort()
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	session := authSession(r)
+	var errl error = nil
 
-	// Admin is not allowed
-	if login == "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	var errl error = nil
-	if _, errl = api.CheckLogin(login, guid); errl != nil {
-		logit(errl.Error())
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_PLUGINS, ACTION_RUN)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// If the plugin isn't available try to compile it
 
 	endpoint := r.PathParam("endpoint")
@@ -369,26 +355,19 @@ func (api *Api) GenericDeleteEndpoint(w rest.ResponseWriter, r *rest.Request) {
 	port := strconv.FormatInt(api.Port(), 10)
 	defer api.DecrementPort()
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	session := authSession(r)
+	var errl error = nil
 
-	// Admin is not allowed
-	if login == "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	var errl error = nil
-	if _, errl = api.CheckLogin(login, guid); errl != nil {
-		logit(errl.Error())
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_PLUGINS, ACTION_RUN)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// If the plugin isn't available try to compile it
 
 	endpoint := r.PathParam("endpoint")
@@ -446,26 +425,19 @@ func (api *Api) GenericPutEndpoint(w rest.ResponseWriter, r *rest.Request) {
 	port := strconv.FormatInt(api.Port(), 10)
 	defer api.DecrementPort()
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	session := authSession(r)
+	var errl error = nil
 
-	// Admin is not allowed
-	if login == "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	var errl error = nil
-	if _, errl = api.CheckLogin(login, guid); errl != nil {
-		logit(errl.Error())
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_PLUGINS, ACTION_RUN)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// If the plugin isn't available try to compile it
 
 	endpoint := r.PathParam("endpoint")
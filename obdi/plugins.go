@@ -26,30 +26,19 @@ import (
 
 func (api *Api) GetAllPlugins(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
-
-	// Anyone can view plugins
+	session := authSession(r)
+	var errl error = nil
 
-	/*
-	   if login != "admin" {
-	       rest.Error(w, "Not allowed", 400)
-	       return
-	   }
-	*/
+	// Check the user's role allows it
 
-	//session := Session{}
-	var errl error = nil
-	//if session,errl = api.CheckLogin( login, guid ); errl != nil {
-	if _, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_PLUGINS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	plugins := []Plugin{}
 	qs := r.URL.Query() // Query string - map[string][]string
 	if len(qs["name"]) > 0 {
@@ -102,27 +91,19 @@ func (api *Api) GetAllPlugins(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) AddPlugin(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	session := authSession(r)
+	var errl error
 
-	// Only admin is allowed
+	// Check the user's role allows it
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
+	errl = api.Authorize(session, RESOURCE_PLUGINS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
-		return
-	}
-
-	defer api.TouchSession(guid)
-
 	// Can't add if it exists already
 
 	pluginData := Plugin{}
@@ -170,27 +151,19 @@ func (api *Api) AddPlugin(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) UpdatePlugin(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
-
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	// Credentials were checked by AuthMiddleware
 
-	// Only admin is allowed
+	session := authSession(r)
+	var errl error
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_PLUGINS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Ensure user exists
 
 	id := r.PathParam("id")
@@ -254,27 +227,19 @@ func (api *Api) UpdatePlugin(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) DeletePlugin(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
-
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	// Credentials were checked by AuthMiddleware
 
-	// Only admin is allowed
+	session := authSession(r)
+	var errl error
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_PLUGINS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Delete
 
 	id := 0
@@ -0,0 +1,234 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
+	"net/http"
+	"time"
+)
+
+// What's sent back to a pull mode worker
+type PullReply struct {
+	Jobs  []Jobsend // Jobs to start
+	Kills []Jobkill // Jobs to kill
+}
+
+// requeueUncollected puts jobs back in the queue when the worker that
+// collected them hasn't reported on them within pull_lease seconds. The
+// pull reply may never have reached it. The caller holds the mutex.
+func (api *Api) requeueUncollected(env Env) error {
+
+	lease := time.Now().Add(-time.Duration(config.PullLease) * time.Second)
+
+	jobs := []Job{}
+	if err := api.db.Find(&jobs, "env_id = ? and collected = 1 and "+
+		"collected_at < ?", env.Id, lease); err.Error != nil &&
+		!err.RecordNotFound() {
+		return err.Error
+	}
+	for i := range jobs {
+		logit(fmt.Sprintf("Job %d: No reply from worker '%s'. Queued again.",
+			jobs[i].Id, jobs[i].WorkerName))
+		jobs[i].Pending = true
+		jobs[i].Collected = false
+		jobs[i].WorkerId = 0
+		jobs[i].WorkerName = ""
+		jobs[i].KeyHash = "" // The worker that had it can't report now
+		jobs[i].StatusReason = "Waiting for a worker to collect the job"
+		if err := api.db.Save(&jobs[i]).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// collectPending claims a job, and any kill requests, waiting for a
+// pull mode worker in the environment. Claiming is done under the mutex
+// so each job is only handed to one worker. Only one job is handed out
+// per request so that jobs are shared between the environment's workers.
+// The job stays collected, not started, until the worker reports on it.
+func (api *Api) collectPending(env Env, worker Worker) (PullReply, error) {
+
+	reply := PullReply{Jobs: []Jobsend{}, Kills: []Jobkill{}}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err := api.requeueUncollected(env); err != nil {
+		return reply, err
+	}
+
+	jobs := []Job{}
+	if err := api.db.Order("id").Limit(1).Find(&jobs,
+		"env_id = ? and pending = 1", env.Id); err.Error != nil &&
+		!err.RecordNotFound() {
+		return reply, err.Error
+	}
+	for i := range jobs {
+		key, keyHash, err := newJobKey()
+		if err != nil {
+			return reply, err
+		}
+		script := Script{}
+		if err := api.db.Find(&script, jobs[i].ScriptId); err.Error != nil {
+			jobs[i].Status = STATUS_ERROR
+			jobs[i].StatusReason = "Script ID not found"
+		} else {
+			jobs[i].StatusReason = "Collected by worker"
+			jobs[i].WorkerId = worker.Id
+			jobs[i].WorkerName = worker.Name
+			jobs[i].KeyHash = keyHash
+			jobs[i].Collected = true
+			jobs[i].CollectedAt = time.Now()
+			reply.Jobs = append(reply.Jobs,
+				newJobsend(jobs[i], script, key))
+		}
+		jobs[i].Pending = false
+		if err := api.db.Save(&jobs[i]).Error; err != nil {
+			return reply, err
+		}
+	}
+
+	kills := []Job{}
+	if err := api.db.Order("id").Find(&kills,
+		"env_id = ? and kill_pending = 1 and worker_id in (0,?)",
+		env.Id, worker.Id); err.Error != nil && !err.RecordNotFound() {
+		return reply, err.Error
+	}
+	for i := range kills {
+		reply.Kills = append(reply.Kills, Jobkill{
+			JobID: kills[i].Id,
+		})
+		kills[i].KillPending = false
+		if err := api.db.Save(&kills[i]).Error; err != nil {
+			return reply, err
+		}
+	}
+
+	return reply, nil
+}
+
+// PullJobs processes "GET /pull" queries from pull mode workers.
+//
+// The worker names itself and its environment with the worker_name,
+// dc_sys_name and env_sys_name query strings. The request is held open
+// until there's something for the worker to do, or until pull_timeout
+// seconds have passed, in which case an empty reply is sent.
+func (api *Api) PullJobs(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_WORKERS, ACTION_REPORT)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	qs := r.URL.Query() // Query string - map[string][]string
+	if len(qs["dc_sys_name"]) == 0 || len(qs["env_sys_name"]) == 0 ||
+		len(qs["worker_name"]) == 0 {
+		rest.Error(w, "worker_name, dc_sys_name and env_sys_name must "+
+			"be specified", 400)
+		return
+	}
+
+	env, err := api.findEnv(qs["dc_sys_name"][0], qs["env_sys_name"][0])
+	if err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	if !env.PullMode {
+		rest.Error(w, "Environment is not in pull mode.", 400)
+		return
+	}
+
+	// Workers are added to the pool when they register
+
+	worker := Worker{}
+	mutex.Lock()
+	if api.db.Find(&worker, "env_id = ? and name = ?", env.Id,
+		qs["worker_name"][0]).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Worker is not registered in this environment.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	if !worker.Enabled {
+		rest.Error(w, "Worker is disabled.", 400)
+		return
+	}
+
+	api.waitForJobs(w, r, env, worker)
+}
+
+// waitForJobs holds a pull request open until there's a job or kill
+// request for the worker, or pull_timeout is reached
+func (api *Api) waitForJobs(w rest.ResponseWriter, r *rest.Request,
+	env Env, worker Worker) {
+
+	if worker.Key == "" {
+		worker.Key = env.WorkerKey
+	}
+	if worker.Key == "" {
+		rest.Error(w, "WorkerKey not set for this worker.", 400)
+		return
+	}
+
+	deadline := time.Now().Add(time.Duration(config.PullTimeout) *
+		time.Second)
+
+	for {
+		reply, err := api.collectPending(env, worker)
+		if err != nil {
+			rest.Error(w, err.Error(), 500)
+			return
+		}
+		if len(reply.Jobs) > 0 || len(reply.Kills) > 0 ||
+			time.Now().After(deadline) {
+			api.writeSigned(w, r, reply, worker)
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// writeSigned sends a pull reply signed with the worker's key, so the
+// worker knows the jobs came from us and haven't been changed
+func (api *Api) writeSigned(w rest.ResponseWriter, r *rest.Request,
+	v interface{}, worker Worker) {
+
+	body, err := w.EncodeJson(v)
+	if err != nil {
+		rest.Error(w, err.Error(), 500)
+		return
+	}
+
+	signHeaders(w.Header(), worker.Key, worker.Name, "GET", r.RequestURI,
+		body)
+	w.WriteHeader(200)
+	w.(http.ResponseWriter).Write(body)
+}
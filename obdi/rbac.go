@@ -0,0 +1,251 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+)
+
+// Every user has one role. What a role allows is in rolePerms.
+const (
+	ROLE_ADMIN    = "admin"    // Manage everything and run jobs
+	ROLE_OPERATOR = "operator" // Run jobs in environments they have a Perm for
+	ROLE_VIEWER   = "viewer"   // See jobs in environments they have a Perm for
+	ROLE_AUDITOR  = "auditor"  // See everything, change nothing
+	ROLE_WORKER   = "worker"   // The account a worker logs in with
+)
+
+// Actions
+const (
+	ACTION_READ   = "read"
+	ACTION_WRITE  = "write"  // Add, update and delete
+	ACTION_RUN    = "run"    // Start and kill jobs, use plugins
+	ACTION_REPORT = "report" // Workers register and send job status
+)
+
+// Resources
+const (
+	RESOURCE_USERS   = "users"
+	RESOURCE_DCS     = "dcs"
+	RESOURCE_ENVS    = "envs"
+	RESOURCE_PERMS   = "perms" // Env and script permissions, and groups
+	RESOURCE_CAPS    = "caps"  // Dc and Env capabilities and their maps
+	RESOURCE_SCRIPTS = "scripts"
+	RESOURCE_JOBS    = "jobs"
+	RESOURCE_OUTPUT  = "outputlines"
+	RESOURCE_WORKERS = "workers"
+	RESOURCE_PLUGINS = "plugins"
+	RESOURCE_FILES   = "files"
+)
+
+var (
+	readOnly  = []string{ACTION_READ}
+	readWrite = []string{ACTION_READ, ACTION_WRITE}
+	readRun   = []string{ACTION_READ, ACTION_RUN}
+	allOf     = []string{ACTION_READ, ACTION_WRITE, ACTION_RUN}
+)
+
+// The permission matrix. Role to resource to allowed actions.
+var rolePerms = map[string]map[string][]string{
+	ROLE_ADMIN: {
+		RESOURCE_USERS:   readWrite,
+		RESOURCE_DCS:     readWrite,
+		RESOURCE_ENVS:    readWrite,
+		RESOURCE_PERMS:   readWrite,
+		RESOURCE_CAPS:    readWrite,
+		RESOURCE_SCRIPTS: readWrite,
+		RESOURCE_JOBS:    allOf,
+		RESOURCE_OUTPUT:  readWrite,
+		RESOURCE_WORKERS: readWrite,
+		RESOURCE_PLUGINS: allOf,
+		RESOURCE_FILES:   readWrite,
+	},
+	ROLE_OPERATOR: {
+		RESOURCE_ENVS:    readOnly,
+		RESOURCE_SCRIPTS: readOnly,
+		RESOURCE_JOBS:    readRun,
+		RESOURCE_OUTPUT:  readOnly,
+		RESOURCE_PLUGINS: readRun,
+		RESOURCE_FILES:   readOnly,
+	},
+	ROLE_VIEWER: {
+		RESOURCE_ENVS:    readOnly,
+		RESOURCE_SCRIPTS: readOnly,
+		RESOURCE_JOBS:    readOnly,
+		RESOURCE_OUTPUT:  readOnly,
+		RESOURCE_PLUGINS: readOnly,
+		RESOURCE_FILES:   readOnly,
+	},
+	ROLE_AUDITOR: {
+		RESOURCE_USERS:   readOnly,
+		RESOURCE_DCS:     readOnly,
+		RESOURCE_ENVS:    readOnly,
+		RESOURCE_PERMS:   readOnly,
+		RESOURCE_CAPS:    readOnly,
+		RESOURCE_SCRIPTS: readOnly,
+		RESOURCE_JOBS:    readOnly,
+		RESOURCE_OUTPUT:  readOnly,
+		RESOURCE_WORKERS: readOnly,
+		RESOURCE_PLUGINS: readOnly,
+		RESOURCE_FILES:   readOnly,
+	},
+	ROLE_WORKER: {
+		RESOURCE_SCRIPTS: readOnly,
+		RESOURCE_JOBS:    {ACTION_REPORT},
+		RESOURCE_OUTPUT:  {ACTION_REPORT},
+		RESOURCE_WORKERS: {ACTION_REPORT},
+	},
+}
+
+// checkRole returns an error unless role is one of the roles
+func checkRole(role string) error {
+
+	if _, ok := rolePerms[role]; ok {
+		return nil
+	}
+
+	roles := []string{ROLE_ADMIN, ROLE_OPERATOR, ROLE_VIEWER, ROLE_AUDITOR,
+		ROLE_WORKER}
+
+	return ApiError{"Role must be one of " + strings.Join(roles, ", ")}
+}
+
+// Roles in the order they are picked when a user's external groups map
+// to more than one
+var roleOrder = []string{ROLE_ADMIN, ROLE_OPERATOR, ROLE_AUDITOR,
+	ROLE_VIEWER, ROLE_WORKER}
+
+// mappedRole returns the role that the groups of an LDAP or OIDC user
+// map to in groupRoles, or defaultRole if none do. Without any
+// groupRoles the role is left alone for an admin to change.
+func mappedRole(groups []string, groupRoles map[string]string,
+	same func(a, b string) bool, defaultRole, role string) string {
+
+	if len(groupRoles) == 0 {
+		return role
+	}
+
+	mapped := make(map[string]bool)
+	for name, r := range groupRoles {
+		for _, group := range groups {
+			if same(name, group) {
+				mapped[r] = true
+			}
+		}
+	}
+
+	for _, r := range roleOrder {
+		if mapped[r] {
+			return r
+		}
+	}
+
+	return defaultRole
+}
+
+// roleAllows returns true if the role allows the action on the resource
+func roleAllows(role, resource, action string) bool {
+
+	for _, allowed := range rolePerms[role][resource] {
+		if allowed == action {
+			return true
+		}
+	}
+
+	return false
+}
+
+// roleIncludes returns true if role can do everything other can
+func roleIncludes(role, other string) bool {
+
+	for resource, actions := range rolePerms[other] {
+		for _, action := range actions {
+			if !roleAllows(role, resource, action) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// userRole returns the role of the session's user
+func (api *Api) userRole(session Session) string {
+
+	user := User{}
+	mutex.Lock()
+	api.db.First(&user, session.UserId)
+	mutex.Unlock()
+
+	return user.Role
+}
+
+// sessionRole returns the role of the session's user, or of the API
+// token used for the session. A token's role stops working if the user's
+// role no longer includes it.
+func (api *Api) sessionRole(session Session) string {
+
+	role := api.userRole(session)
+
+	if session.TokenRole != "" {
+		if roleIncludes(role, session.TokenRole) {
+			return session.TokenRole
+		}
+		return ""
+	}
+
+	return role
+}
+
+// Authorize returns an error unless the session's user has a role that
+// allows the action on the resource. Every handler checks this after
+// AuthMiddleware has checked the credentials.
+func (api *Api) Authorize(session Session, resource, action string) error {
+
+	if roleAllows(api.sessionRole(session), resource, action) {
+		return nil
+	}
+
+	return ApiError{"Not allowed"}
+}
+
+// otherAdmins returns the number of enabled admins apart from the user
+func (api *Api) otherAdmins(userId int64) int {
+
+	count := 0
+	mutex.Lock()
+	api.db.Model(User{}).Where("role = ? and enabled = 1 and id != ?",
+		ROLE_ADMIN, userId).Count(&count)
+	mutex.Unlock()
+
+	return count
+}
+
+// allEnvs returns true if the session's user can see, or run jobs in,
+// every environment without needing a Perm for it. An API token's role
+// limits what can be done, not where, so it's the user's role.
+func (api *Api) allEnvs(session Session, writeable bool) bool {
+
+	switch api.userRole(session) {
+	case ROLE_ADMIN:
+		return true
+	case ROLE_AUDITOR:
+		return !writeable
+	}
+
+	return false
+}
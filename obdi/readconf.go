@@ -17,27 +17,52 @@
 package main
 
 import (
-	"os"
-	//"fmt"
+	"fmt"
 	"github.com/mclarkson/obdi/external/BurntSushi/toml"
+	"os"
+	"regexp"
 )
 
 var config Config
 
 type Config struct {
-	Dbname            string `toml:"database_path"`
-	PluginDbPath      string `toml:"plugin_database_path"`
-	ListenAddr        string `toml:"listen_address"`
-	SessionTimeout    int    `toml:"session_timeout"`
-	StaticContent     string `toml:"static_content"`
-	SSLEnabled        bool   `toml:"ssl_enabled"`
-	SSLCertFile       string `toml:"ssl_cert"`
-	SSLKeyFile        string `toml:"ssl_key"`
-	GoPluginDir       string `toml:"go_plugin_dir"`
-	GoPluginSource    string `toml:"go_plugin_source"`
-	GoPluginPortStart int64  `toml:"go_plugin_port_start"`
-	GoRoot            string `toml:"go_root"`
-	TransportTimeout  int64  `toml:"transport_timeout"` // Not used
+	Dbname            string   `toml:"database_path"`
+	PluginDbPath      string   `toml:"plugin_database_path"`
+	ListenAddr        string   `toml:"listen_address"`
+	SessionTimeout    int      `toml:"session_timeout"`
+	StaticContent     string   `toml:"static_content"`
+	SSLEnabled        bool     `toml:"ssl_enabled"`
+	SSLCertFile       string   `toml:"ssl_cert"`
+	SSLKeyFile        string   `toml:"ssl_key"`
+	GoPluginDir       string   `toml:"go_plugin_dir"`
+	GoPluginSource    string   `toml:"go_plugin_source"`
+	GoPluginPortStart int64    `toml:"go_plugin_port_start"`
+	GoRoot            string   `toml:"go_root"`
+	PullTimeout       int64    `toml:"pull_timeout"`
+	PullLease         int64    `toml:"pull_lease"`
+	WorkerTimeout     int64    `toml:"worker_timeout"`
+	WorkerCA          string   `toml:"worker_ca"`
+	WorkerPins        []string `toml:"worker_pins"`
+	WorkerClientCert  string   `toml:"worker_client_cert"`
+	WorkerClientKey   string   `toml:"worker_client_key"`
+	WorkerInsecure    bool     `toml:"worker_insecure"`
+	SSLClientCA       string   `toml:"ssl_client_ca"`
+	WorkerClientUsers []string `toml:"worker_client_users"`
+	ScriptSyncDir     string   `toml:"script_sync_dir"`
+	ScriptSyncGitPull bool     `toml:"script_sync_git_pull"`
+	ScriptMaxSize     int64    `toml:"script_max_size"`
+	TransportTimeout  int64    `toml:"transport_timeout"` // Not used
+
+	// Refuse the login and GUID in the URL, see auth.go
+	DisablePathCredentials bool `toml:"disable_path_credentials"`
+
+	// Interpreter name to syntax check command, e.g. "bash -n"
+	ScriptCheckers map[string]string `toml:"script_checkers"`
+	ScriptLint     []LintRule        `toml:"script_lint"`
+
+	LDAP LdapConfig `toml:"ldap"`
+	OIDC OidcConfig `toml:"oidc"`
+	TOTP TotpConfig `toml:"totp"`
 }
 
 func init() {
@@ -57,4 +82,38 @@ func (c *Config) Read_config() {
 		//fmt.Printf( "%s: %s\n", txt, err )
 		os.Exit(1)
 	}
+
+	if c.PullTimeout == 0 {
+		c.PullTimeout = 30
+	}
+	if c.PullLease == 0 {
+		c.PullLease = 120
+	}
+	if c.WorkerTimeout == 0 {
+		c.WorkerTimeout = 90
+	}
+	if c.ScriptMaxSize == 0 {
+		c.ScriptMaxSize = 1024 * 1024
+	}
+	if c.TOTP.Issuer == "" {
+		c.TOTP.Issuer = "Obdi"
+	}
+	if len(c.ScriptCheckers) == 0 {
+		c.ScriptCheckers = defaultScriptCheckers
+	}
+	for _, rule := range c.ScriptLint {
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			logit(fmt.Sprintf("Invalid script_lint pattern '%s' (%s)",
+				rule.Pattern, err.Error()))
+			os.Exit(1)
+		}
+	}
+	if err := c.LDAP.ldapDefaults(); err != nil {
+		logit("Invalid [ldap] settings: " + err.Error())
+		os.Exit(1)
+	}
+	if err := c.OIDC.oidcDefaults(); err != nil {
+		logit("Invalid [oidc] settings: " + err.Error())
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,363 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
+	"strconv"
+)
+
+// addRevision saves the script's current source as a new revision and
+// updates Script.Revision. Call before saving the script.
+func (api *Api) addRevision(script *Script, author, comment string) error {
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	last := ScriptRevision{}
+	api.db.Where("script_id = ?", script.Id).Order("revision desc").
+		First(&last)
+
+	rev := ScriptRevision{
+		ScriptId:    script.Id,
+		Revision:    last.Revision + 1,
+		Source:      script.Source,
+		Hash:        scriptHash(script.Source),
+		Interpreter: script.Interpreter,
+		Signature:   script.Signature,
+		Author:      author,
+		Comment:     comment,
+	}
+	if err := api.db.Save(&rev).Error; err != nil {
+		return err
+	}
+
+	script.Revision = rev.Revision
+
+	return nil
+}
+
+// ensureRevision makes sure a script saved before revisions were kept
+// has a first revision
+func (api *Api) ensureRevision(script *Script) error {
+
+	if script.Revision != 0 {
+		return nil
+	}
+
+	if err := api.addRevision(script, "",
+		"Saved before revision history was kept"); err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	return api.db.Save(script).Error
+}
+
+// findRevision loads one revision of a script
+func (api *Api) findRevision(scriptId int64, revision int64) (
+	ScriptRevision, error) {
+
+	rev := ScriptRevision{}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if api.db.Where("script_id = ? and revision = ?", scriptId, revision).
+		First(&rev).RecordNotFound() {
+		return rev, ApiError{fmt.Sprintf("Revision %d not found.",
+			revision)}
+	}
+
+	return rev, nil
+}
+
+// revisionParams returns the script id, and the revision if there is
+// one, from the path
+func revisionParams(r *rest.Request) (int64, int64, error) {
+
+	id, err := strconv.ParseInt(r.PathParam("id"), 10, 64)
+	if err != nil {
+		return 0, 0, ApiError{"Invalid id."}
+	}
+
+	if r.PathParam("rev") == "" {
+		return id, 0, nil
+	}
+
+	rev, err := strconv.ParseInt(r.PathParam("rev"), 10, 64)
+	if err != nil {
+		return 0, 0, ApiError{"Invalid revision."}
+	}
+
+	return id, rev, nil
+}
+
+// GetAllRevisions processes "GET /scripts/:id/revisions" queries.
+func (api *Api) GetAllRevisions(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error = nil
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_SCRIPTS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	id, _, err := revisionParams(r)
+	if err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	if _, err := api.visibleScript(session, id); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	revs := []ScriptRevision{}
+	mutex.Lock()
+	api.db.Order("revision desc").Find(&revs, "script_id = ?", id)
+	mutex.Unlock()
+
+	// The source is left out. Fetch a single revision to see it.
+
+	u := make([]map[string]interface{}, len(revs))
+	for i := range revs {
+		u[i] = make(map[string]interface{})
+		u[i]["Id"] = revs[i].Id
+		u[i]["ScriptId"] = revs[i].ScriptId
+		u[i]["Revision"] = revs[i].Revision
+		u[i]["Hash"] = revs[i].Hash
+		u[i]["Interpreter"] = revs[i].Interpreter
+		u[i]["Signed"] = revs[i].Signature != ""
+		u[i]["Author"] = revs[i].Author
+		u[i]["Comment"] = revs[i].Comment
+		u[i]["CreatedAt"] = revs[i].CreatedAt
+	}
+
+	w.WriteJson(&u)
+}
+
+// GetRevision processes "GET /scripts/:id/revisions/:rev" queries.
+func (api *Api) GetRevision(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error = nil
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_SCRIPTS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	id, revision, err := revisionParams(r)
+	if err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	if _, err := api.visibleScript(session, id); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	rev, err := api.findRevision(id, revision)
+	if err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	w.WriteJson(rev)
+}
+
+// DiffRevisions processes "GET /scripts/:id/diff?from=N&to=M" queries.
+//
+// A unified diff between two revisions is returned. 'to' defaults to
+// the latest revision and 'from' to the one before 'to'.
+func (api *Api) DiffRevisions(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error = nil
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_SCRIPTS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	id, _, err := revisionParams(r)
+	if err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	script, err := api.visibleScript(session, id)
+	if err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	qs := r.URL.Query() // Query string - map[string][]string
+
+	to := script.Revision
+	if len(qs["to"]) > 0 {
+		if to, err = strconv.ParseInt(qs["to"][0], 10, 64); err != nil {
+			rest.Error(w, "Invalid 'to' revision.", 400)
+			return
+		}
+	}
+	from := to - 1
+	if len(qs["from"]) > 0 {
+		if from, err = strconv.ParseInt(qs["from"][0], 10, 64); err != nil {
+			rest.Error(w, "Invalid 'from' revision.", 400)
+			return
+		}
+	}
+
+	toRev, err := api.findRevision(id, to)
+	if err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	// Diffing the first revision shows all of it as added
+	fromRev := ScriptRevision{}
+	if from > 0 {
+		if fromRev, err = api.findRevision(id, from); err != nil {
+			rest.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	diff, err := unifiedDiff(
+		fmt.Sprintf("%s (revision %d)", script.Name, from),
+		fmt.Sprintf("%s (revision %d)", script.Name, to),
+		string(fromRev.Source), string(toRev.Source))
+	if err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	w.WriteJson(map[string]interface{}{
+		"ScriptId": id,
+		"From":     from,
+		"To":       to,
+		"Diff":     diff,
+	})
+}
+
+// RestoreRevision processes "POST /scripts/:id/revisions/:rev/restore"
+// queries.
+//
+// The old revision's source becomes a new revision. History is never
+// rewritten.
+func (api *Api) RestoreRevision(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	login := r.PathParam("login")
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_SCRIPTS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	id, revision, err := revisionParams(r)
+	if err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	script := Script{}
+	mutex.Lock()
+	if api.db.First(&script, id).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	if script.Managed {
+		rest.Error(w, managedError(script).Error(), 400)
+		return
+	}
+
+	if err := api.ensureRevision(&script); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	rev, err := api.findRevision(id, revision)
+	if err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	// An optional comment can be sent
+	data := struct{ Comment string }{}
+	r.DecodeJsonPayload(&data)
+	if data.Comment == "" {
+		data.Comment = fmt.Sprintf("Restored revision %d", revision)
+	}
+
+	script.Source = rev.Source
+	script.Interpreter = rev.Interpreter
+	script.Signature = rev.Signature
+	script.Hash = rev.Hash
+	script.Type = detectScriptType(script.Source)
+	validateScript(&script)
+
+	if err := api.addRevision(&script, login, data.Comment); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	mutex.Lock()
+	if err := api.db.Save(&script).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	api.LogActivity(session.Id, fmt.Sprintf("Restored revision %d of "+
+		"script '%s' as revision %d.", revision, script.Name,
+		script.Revision))
+
+	script.Source = []byte{}
+	w.WriteJson(script)
+}
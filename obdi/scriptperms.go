@@ -0,0 +1,521 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
+	"github.com/mclarkson/obdi/external/jinzhu/gorm"
+	"strconv"
+)
+
+// Scripts can be run by anyone who can write to the environment until
+// they are restricted. Then only the users a ScriptPerm names can run
+// them, and only in the environments it names. A ScriptPerm for a group
+// names everyone in the group. Admins can run every script.
+//
+// Adding a ScriptPerm restricts the script. Deleting the last one
+// doesn't, so nobody but admins can run it until it's unrestricted with
+// SetScriptRestricted.
+
+// writeableEnvIds returns the environments the session's user can run
+// jobs in
+func (api *Api) writeableEnvIds(session Session) []int64 {
+
+	query := api.db.Model(Env{})
+	if !api.allEnvs(session, true) {
+		query = query.Where("envs.id in ("+envPermSQL(true)+")",
+			session.UserId)
+	}
+	if session.TokenEnvId != 0 {
+		query = query.Where("envs.id = ?", session.TokenEnvId)
+	}
+
+	ids := []int64{}
+	mutex.Lock()
+	query.Pluck("id", &ids)
+	mutex.Unlock()
+
+	return ids
+}
+
+// scriptEnvIds returns the environments the session's user can run each
+// script in. Scripts the user can't run anywhere are left out.
+func (api *Api) scriptEnvIds(session Session,
+	scripts []Script) map[int64][]int64 {
+
+	envIds := api.writeableEnvIds(session)
+	all := api.allEnvs(session, true)
+
+	grants := []ScriptPerm{}
+	query := api.grantsFor(session.UserId)
+	mutex.Lock()
+	query.Find(&grants)
+	mutex.Unlock()
+
+	allowed := make(map[int64][]int64)
+
+	for _, script := range scripts {
+
+		if !script.Restricted || all {
+			if len(envIds) > 0 {
+				allowed[script.Id] = envIds
+			}
+			continue
+		}
+
+		for _, envId := range envIds {
+			for _, grant := range grants {
+				if grant.ScriptId == script.Id &&
+					(grant.EnvId == 0 || grant.EnvId == envId) {
+					allowed[script.Id] = append(allowed[script.Id], envId)
+					break
+				}
+			}
+		}
+	}
+
+	return allowed
+}
+
+// canRunScript returns true if the session's user can run the script in
+// the environment. Check canWriteEnv as well.
+func (api *Api) canRunScript(session Session, scriptId, envId int64) bool {
+
+	if api.allEnvs(session, true) {
+		return true
+	}
+
+	script := Script{}
+	mutex.Lock()
+	if api.db.First(&script, scriptId).RecordNotFound() {
+		mutex.Unlock()
+		return false
+	}
+	mutex.Unlock()
+
+	if !script.Restricted {
+		return true
+	}
+
+	count := 0
+	query := api.grantsFor(session.UserId).Model(ScriptPerm{})
+	mutex.Lock()
+	query.Where("script_id = ? and (env_id = 0 or env_id = ?)", scriptId,
+		envId).Count(&count)
+	mutex.Unlock()
+
+	return count > 0
+}
+
+// canSeeScript returns true if the session's user can see the script
+// and its source. Users see the scripts GetAllScripts lists for them,
+// the ones they can run. Admins and auditors see them all.
+func (api *Api) canSeeScript(session Session, script Script) bool {
+
+	if api.allEnvs(session, false) {
+		return true
+	}
+
+	_, ok := api.scriptEnvIds(session, []Script{script})[script.Id]
+
+	return ok
+}
+
+// visibleScript loads a script, including a deleted one so its
+// revisions can be seen, if the session's user can see it
+func (api *Api) visibleScript(session Session, id int64) (Script, error) {
+
+	script := Script{}
+	mutex.Lock()
+	if api.db.Unscoped().First(&script, id).RecordNotFound() {
+		mutex.Unlock()
+		return script, ApiError{"Record not found."}
+	}
+	mutex.Unlock()
+
+	if !api.canSeeScript(session, script) {
+		return script, ApiError{"Not allowed. You can't run this script."}
+	}
+
+	return script, nil
+}
+
+// restrictScript restricts a script. It's done whenever a ScriptPerm is
+// added for the script.
+func (api *Api) restrictScript(scriptId int64) error {
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return api.db.Model(&Script{Id: scriptId}).
+		UpdateColumn("restricted", true).Error
+}
+
+// grantsFor returns a query for the rows naming the user, directly or
+// through one of the user's groups. Use it for Perms or ScriptPerms.
+func (api *Api) grantsFor(userId int64) *gorm.DB {
+
+	groupIds := api.userGroupIds(userId)
+	if len(groupIds) == 0 {
+		return api.db.Where("user_id = ?", userId)
+	}
+
+	return api.db.Where("(user_id = ? or group_id in (?))", userId,
+		groupIds)
+}
+
+func (api *Api) GetAllScriptPerms(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error = nil
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_PERMS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	qs := r.URL.Query() // Query string - map[string][]string
+
+	perms := []ScriptPerm{}
+	query := api.db.Order("script_id, group_id, user_id")
+
+	if len(qs["script_id"]) > 0 {
+		query = query.Where("script_id = ?", qs["script_id"][0])
+	}
+	if len(qs["user_id"]) > 0 {
+		query = query.Where("user_id = ?", qs["user_id"][0])
+	}
+	if len(qs["group_id"]) > 0 {
+		query = query.Where("group_id = ?", qs["group_id"][0])
+	}
+
+	// No results is not an error
+	mutex.Lock()
+	err := query.Find(&perms)
+	mutex.Unlock()
+	if err.Error != nil {
+		if !err.RecordNotFound() {
+			rest.Error(w, err.Error.Error(), 500)
+			return
+		}
+	}
+
+	// Create a slice of maps from users struct
+	// to selectively copy database fields for display
+
+	u := make([]map[string]interface{}, len(perms))
+	for i := range perms {
+		u[i] = make(map[string]interface{})
+		u[i]["Id"] = perms[i].Id
+		u[i]["ScriptId"] = perms[i].ScriptId
+		u[i]["UserId"] = perms[i].UserId
+		u[i]["GroupId"] = perms[i].GroupId
+		u[i]["EnvId"] = perms[i].EnvId
+		u[i]["CreatedAt"] = perms[i].CreatedAt
+
+		script := Script{}
+		mutex.Lock()
+		api.db.Model(&perms[i]).Related(&script)
+		mutex.Unlock()
+
+		u[i]["ScriptName"] = script.Name
+
+		if perms[i].GroupId != 0 {
+			group := Group{}
+			mutex.Lock()
+			api.db.Model(&perms[i]).Related(&group)
+			mutex.Unlock()
+
+			u[i]["GroupName"] = group.Name
+		} else {
+			user := User{}
+			mutex.Lock()
+			api.db.Model(&perms[i]).Related(&user)
+			mutex.Unlock()
+
+			u[i]["UserLogin"] = user.Login
+		}
+
+		// EnvId 0 is any environment
+		if perms[i].EnvId != 0 {
+			env := Env{}
+			mutex.Lock()
+			api.db.Model(&perms[i]).Related(&env)
+			mutex.Unlock()
+
+			u[i]["EnvSysName"] = env.SysName
+			u[i]["EnvDispName"] = env.DispName
+		}
+	}
+
+	w.WriteJson(&u)
+}
+
+func (api *Api) AddScriptPerm(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_PERMS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	// Can't add if it exists already
+
+	permData := ScriptPerm{}
+
+	if err := r.DecodeJsonPayload(&permData); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	} else if permData.ScriptId == 0 {
+		rest.Error(w, "Incorrect data format received.", 400)
+		return
+	}
+
+	script := Script{}
+	mutex.Lock()
+	if api.db.First(&script, permData.ScriptId).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Script not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	grantee, err := api.checkGrantee(permData.UserId, permData.GroupId)
+	if err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	perm := ScriptPerm{}
+	mutex.Lock()
+	if !api.db.Find(&perm, "script_id = ? and user_id = ? and "+
+		"group_id = ? and env_id = ?", permData.ScriptId, permData.UserId,
+		permData.GroupId, permData.EnvId).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record exists.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	// Add perm, which restricts the script
+
+	mutex.Lock()
+	if err := api.db.Save(&permData).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	if err := api.restrictScript(permData.ScriptId); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	text := fmt.Sprintf("Allowed '%s' to run script '%s'. "+
+		"ScriptPermID = '%d'.", grantee, script.Name, permData.Id)
+
+	api.LogActivity(session.Id, text)
+	w.WriteJson(permData)
+}
+
+func (api *Api) UpdateScriptPerm(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_PERMS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	id := r.PathParam("id")
+
+	// Check that the id string is a number
+	if _, err := strconv.Atoi(id); err != nil {
+		rest.Error(w, "Invalid id.", 400)
+		return
+	}
+
+	// Load data from db, then ...
+	perm := ScriptPerm{}
+	mutex.Lock()
+	if api.db.Find(&perm, id).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	// ... overwrite any sent fields
+	if err := r.DecodeJsonPayload(&perm); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	}
+
+	if _, err := api.checkGrantee(perm.UserId, perm.GroupId); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	// Force the use of the path id over an id in the payload
+	Id, _ := strconv.Atoi(id)
+	perm.Id = int64(Id)
+
+	mutex.Lock()
+	if err := api.db.Save(&perm).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	// It may be for a different script now
+	if err := api.restrictScript(perm.ScriptId); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	text := fmt.Sprintf("Updated script permission. ScriptPermID = '%d'.",
+		perm.Id)
+
+	api.LogActivity(session.Id, text)
+
+	w.WriteJson("Success")
+}
+
+func (api *Api) DeleteScriptPerm(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_PERMS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	// Delete
+
+	id := 0
+	if id, errl = strconv.Atoi(r.PathParam("id")); errl != nil {
+		rest.Error(w, "Invalid id.", 400)
+		return
+	}
+
+	perm := ScriptPerm{}
+	mutex.Lock()
+	if api.db.First(&perm, id).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	mutex.Lock()
+	if err := api.db.Delete(&perm).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	text := fmt.Sprintf("Deleted script permission. ScriptPermID = '%d'.",
+		perm.Id)
+
+	api.LogActivity(session.Id, text)
+
+	w.WriteJson("Success")
+}
+
+// SetScriptRestricted processes "PUT /scripts/:id/restricted" queries.
+//
+// Send {"Restricted": false} to let anyone who can run jobs in an
+// environment run the script there, whatever ScriptPerms it has.
+func (api *Api) SetScriptRestricted(w rest.ResponseWriter,
+	r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_PERMS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	id := 0
+	if id, errl = strconv.Atoi(r.PathParam("id")); errl != nil {
+		rest.Error(w, "Invalid id.", 400)
+		return
+	}
+
+	data := struct{ Restricted bool }{}
+	if err := r.DecodeJsonPayload(&data); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	}
+
+	script := Script{}
+	mutex.Lock()
+	if api.db.First(&script, id).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record not found.", 400)
+		return
+	}
+	if err := api.db.Model(&script).UpdateColumn("restricted",
+		data.Restricted).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	text := fmt.Sprintf("Unrestricted script '%s'.", script.Name)
+	if data.Restricted {
+		text = fmt.Sprintf("Restricted script '%s'.", script.Name)
+	}
+	api.LogActivity(session.Id, text)
+
+	w.WriteJson("Success")
+}
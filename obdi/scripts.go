@@ -19,6 +19,8 @@ package main
 // All api calls have the username and GUID to be sent as part of the request
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	//"bytes"
 	//"net/url"
@@ -26,37 +28,58 @@ import (
 	//"github.com/jinzhu/gorm"
 	//"database/sql"
 	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
-	"io/ioutil"
-	"os"
-	"os/exec"
 	"strconv"
 )
 
-func (api *Api) GetAllScripts(w rest.ResponseWriter, r *rest.Request) {
+// scriptHash returns the hex encoded SHA-256 of a script's source.
+// Workers cache scripts by this hash.
+func scriptHash(source []byte) string {
+	sum := sha256.Sum256(source)
+	return hex.EncodeToString(sum[:])
+}
 
-	// Check credentials
+// scriptByHash returns the script, or an old revision of it, whose
+// source has the hash
+func (api *Api) scriptByHash(hash string) (Script, error) {
+	script := Script{}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !api.db.Where("hash = ?", hash).First(&script).RecordNotFound() {
+		return script, nil
+	}
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	// The script may have changed since the job was sent, so look
+	// through the old revisions too
+	rev := ScriptRevision{}
+	if api.db.Where("hash = ?", hash).First(&rev).RecordNotFound() {
+		return script, ApiError{"Script not found."}
+	}
+	if api.db.First(&script, rev.ScriptId).RecordNotFound() {
+		return script, ApiError{"Script not found."}
+	}
+	script.Source = rev.Source
+	script.Hash = rev.Hash
+	script.Interpreter = rev.Interpreter
+	script.Signature = rev.Signature
+	script.Revision = rev.Revision
+	return script, nil
+}
 
-	// Anyone can read the list of scripts
+func (api *Api) GetAllScripts(w rest.ResponseWriter, r *rest.Request) {
 
-	/*
-	   if login != "admin" {
-	       rest.Error(w, "Not allowed", 400)
-	       return
-	   }*/
+	// Credentials were checked by AuthMiddleware
 
-	//session := Session{}
+	session := authSession(r)
 	var errl error = nil
-	//if session,errl = api.CheckLogin( login, guid ); errl != nil {
-	if _, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_SCRIPTS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	scripts := []Script{}
 	qs := r.URL.Query() // Query string - map[string][]string
 	if len(qs["id"]) > 0 {
@@ -96,12 +119,31 @@ func (api *Api) GetAllScripts(w rest.ResponseWriter, r *rest.Request) {
 		}
 	}
 
+	// Users only see the scripts they can run, with the environments
+	// they can run them in. Admins and auditors see them all.
+
+	allScripts := api.allEnvs(session, false)
+	envIds := api.scriptEnvIds(session, scripts)
+	if !allScripts {
+		runnable := []Script{}
+		for i := range scripts {
+			if _, ok := envIds[scripts[i].Id]; ok {
+				runnable = append(runnable, scripts[i])
+			}
+		}
+		scripts = runnable
+	}
+
 	// Create a slice of maps from users struct
 	// to selectively copy database fields for display
 
 	u := make([]map[string]interface{}, len(scripts))
 	for i := range scripts {
 		u[i] = make(map[string]interface{})
+		if allScripts {
+			u[i]["Restricted"] = scripts[i].Restricted
+		}
+		u[i]["EnvIds"] = envIds[scripts[i].Id]
 		u[i]["Id"] = scripts[i].Id
 		u[i]["Name"] = scripts[i].Name
 		u[i]["Desc"] = scripts[i].Desc
@@ -112,6 +154,16 @@ func (api *Api) GetAllScripts(w rest.ResponseWriter, r *rest.Request) {
 			u[i]["Source"] = scripts[i].Source
 		}
 		u[i]["Type"] = scripts[i].Type
+		u[i]["Interpreter"] = scripts[i].Interpreter
+		u[i]["Signature"] = scripts[i].Signature
+		u[i]["Hash"] = scripts[i].Hash
+		u[i]["Revision"] = scripts[i].Revision
+		u[i]["Managed"] = scripts[i].Managed
+		u[i]["SyncPath"] = scripts[i].SyncPath
+		u[i]["ValidationOk"] = scripts[i].ValidationOk
+		u[i]["ValidationReport"] = scripts[i].ValidationReport
+		u[i]["ValidationOverride"] = scripts[i].ValidationOverride
+		u[i]["ValidatedAt"] = scripts[i].ValidatedAt
 	}
 
 	// Too much noise
@@ -121,27 +173,21 @@ func (api *Api) GetAllScripts(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) AddScript(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
 
 	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
 
-	// Only admin is allowed
+	// Check the user's role allows it
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
+	errl = api.Authorize(session, RESOURCE_SCRIPTS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
-		return
-	}
-
-	defer api.TouchSession(guid)
-
 	// Can't add if it exists already
 
 	scriptData := Script{}
@@ -162,22 +208,29 @@ func (api *Api) AddScript(w rest.ResponseWriter, r *rest.Request) {
 	}
 	mutex.Unlock()
 
-	// Work out type:
-	//   Write to disk then use unix 'file -b' (brief)
-
-	if err := ioutil.WriteFile(os.TempDir()+"/obdi_scriptcheck",
-		scriptData.Source, 0644); err != nil {
-		scriptData.Type = "Unknown type of script"
-	} else {
-		runCmd := exec.Command("file", "-b", os.TempDir()+"/obdi_scriptcheck")
-		output, err := runCmd.Output()
-		if err != nil {
-			scriptData.Type = "Unknown type of script"
-		} else {
-			scriptData.Type = string(output)
-		}
+	if err := checkInterpreter(scriptData.Interpreter); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
 	}
 
+	// Only a sync adds managed scripts
+	scriptData.Managed = false
+	scriptData.SyncPath = ""
+
+	// Restricting a script is a permission, see SetScriptRestricted
+	scriptData.Restricted = false
+
+	// Work out type
+
+	scriptData.Type = detectScriptType(scriptData.Source)
+
+	scriptData.Hash = scriptHash(scriptData.Source)
+
+	// Failing validation doesn't stop the script being saved, only
+	// run
+
+	validateScript(&scriptData)
+
 	// Add script
 
 	mutex.Lock()
@@ -188,6 +241,22 @@ func (api *Api) AddScript(w rest.ResponseWriter, r *rest.Request) {
 	}
 	mutex.Unlock()
 
+	// Keep the first revision. The script id is needed first.
+
+	if err := api.addRevision(&scriptData, login,
+		scriptData.Comment); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	mutex.Lock()
+	if err := api.db.Save(&scriptData).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
 	// Try to start the script
 
 	text := fmt.Sprintf("Added new script, %s.", scriptData.Name)
@@ -199,27 +268,21 @@ func (api *Api) AddScript(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) UpdateScript(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	session := authSession(r)
+	var errl error
 
-	// Only admin is allowed
+	login := r.PathParam("login")
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_SCRIPTS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Ensure user exists
 
 	id := r.PathParam("id")
@@ -241,7 +304,20 @@ func (api *Api) UpdateScript(w rest.ResponseWriter, r *rest.Request) {
 	}
 	mutex.Unlock()
 
+	if script.Managed {
+		rest.Error(w, managedError(script).Error(), 400)
+		return
+	}
+
+	if err := api.ensureRevision(&script); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	old := script
+
 	// ... overwrite any sent fields
+	script.Comment = ""
 	if err := r.DecodeJsonPayload(&script); err != nil {
 		//rest.Error(w, err.Error(), 400)
 		rest.Error(w, "Invalid data format received.", 400)
@@ -258,31 +334,62 @@ func (api *Api) UpdateScript(w rest.ResponseWriter, r *rest.Request) {
 	}
 	mutex.Unlock()
 
-	// Work out type:
-	//   Write to disk then use unix 'file -b' (brief)
+	if err := checkInterpreter(script.Interpreter); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	// Work out type
 
 	if len(script.Source) > 0 {
-		if err := ioutil.WriteFile(os.TempDir()+"/obdi_scriptcheck",
-			script.Source, 0644); err != nil {
-			script.Type = "Write file failed. Type of script unknown. (" +
-				err.Error() + ")"
-		} else {
-			runCmd := exec.Command("file", "-b",
-				os.TempDir()+"/obdi_scriptcheck")
-			output, err := runCmd.Output()
-			if err != nil {
-				script.Type = "Unix 'file' failed. Type of script unknown." +
-					" (" + err.Error() + ")"
-			} else {
-				script.Type = string(output)
-			}
-		}
+		script.Type = detectScriptType(script.Source)
 	}
 
+	script.Hash = scriptHash(script.Source)
+
 	// Force the use of the path id over an id in the payload
 	Id, _ := strconv.Atoi(id)
 	script.Id = int64(Id)
 
+	// Revisions can only be added, not set. Restore an old one instead.
+	script.Revision = old.Revision
+
+	// Restricting a script is a permission, see SetScriptRestricted
+	script.Restricted = old.Restricted
+
+	// Only a sync manages scripts
+	script.Managed = false
+	script.SyncPath = ""
+
+	// A signature only covers the source and interpreter it was made
+	// for. Changing either needs a new signature.
+
+	changed := script.Hash != old.Hash ||
+		script.Interpreter != old.Interpreter
+	if changed && script.Signature == old.Signature {
+		script.Signature = ""
+	}
+
+	// Validation results can't be sent. Use the validation endpoints.
+
+	script.ValidationOk = old.ValidationOk
+	script.ValidationReport = old.ValidationReport
+	script.ValidationOverride = old.ValidationOverride
+	script.ValidatedAt = old.ValidatedAt
+	if changed || script.ValidatedAt.IsZero() {
+		validateScript(&script)
+	}
+
+	// Only changes to what runs, or its signature, need a new revision
+
+	if changed || script.Signature != old.Signature {
+		if err := api.addRevision(&script, login,
+			script.Comment); err != nil {
+			rest.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
 	mutex.Lock()
 	if err := api.db.Save(&script).Error; err != nil {
 		mutex.Unlock()
@@ -299,27 +406,19 @@ func (api *Api) UpdateScript(w rest.ResponseWriter, r *rest.Request) {
 
 func (api *Api) DeleteScript(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
-
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	// Credentials were checked by AuthMiddleware
 
-	// Only admin is allowed
+	session := authSession(r)
+	var errl error
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_SCRIPTS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Delete
 
 	id := 0
@@ -337,6 +436,11 @@ func (api *Api) DeleteScript(w rest.ResponseWriter, r *rest.Request) {
 	}
 	mutex.Unlock()
 
+	if script.Managed {
+		rest.Error(w, managedError(script).Error(), 400)
+		return
+	}
+
 	mutex.Lock()
 	if err := api.db.Delete(&script).Error; err != nil {
 		mutex.Unlock()
@@ -350,3 +454,54 @@ func (api *Api) DeleteScript(w rest.ResponseWriter, r *rest.Request) {
 
 	w.WriteJson("Success")
 }
+
+// GetScriptByHash processes "GET /scripts/hash/:hash" queries.
+//
+// Workers fetch scripts they don't have in their cache. They send the
+// job_id and job_key of the job the script is for, see keyedJob. Other
+// users can only fetch scripts they can see, see canSeeScript.
+func (api *Api) GetScriptByHash(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error = nil
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_SCRIPTS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	hash := r.PathParam("hash")
+	worker := api.userRole(session) == ROLE_WORKER
+
+	if worker {
+		qs := r.URL.Query() // Query string - map[string][]string
+		jobId, _ := strconv.ParseInt(qs.Get("job_id"), 10, 64)
+		job, err := api.keyedJob(jobId, qs.Get("job_key"))
+		if err != nil || job.ScriptHash != hash {
+			rest.Error(w, "Not allowed", 400)
+			return
+		}
+	}
+
+	script, err := api.scriptByHash(hash)
+	if err != nil {
+		rest.Error(w, err.Error(), 404)
+		return
+	}
+
+	if !worker && !api.canSeeScript(session, script) {
+		rest.Error(w, "Not allowed. You can't run this script.", 400)
+		return
+	}
+
+	w.WriteJson(map[string]interface{}{
+		"Name":   script.Name,
+		"Hash":   script.Hash,
+		"Source": script.Source,
+	})
+}
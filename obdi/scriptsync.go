@@ -0,0 +1,441 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/mclarkson/obdi/external/BurntSushi/toml"
+	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A sidecar manifest for 'name.sh' is 'name.sh.obdi.toml'
+const SYNC_MANIFEST_SUFFIX = ".obdi.toml"
+
+// obdi-sign writes the signature for 'name.sh' to 'name.sh.sig'
+const SYNC_SIGNATURE_SUFFIX = ".sig"
+
+// Only one sync runs at a time
+var syncMutex sync.Mutex
+
+// Script details from a header block or sidecar manifest
+type SyncMeta struct {
+	Name        string `toml:"name"`
+	Desc        string `toml:"desc"`
+	Interpreter string `toml:"interpreter"`
+}
+
+// A script found in the sync directory
+type SyncFile struct {
+	Path      string // Relative to script_sync_dir
+	Source    []byte
+	Meta      SyncMeta
+	Signature string
+}
+
+// What a sync did. Skipped entries include the reason.
+type SyncResult struct {
+	Added     []string
+	Updated   []string
+	Removed   []string
+	Skipped   []string
+	Unchanged int
+	Commit    string // The git commit synced from, if it's a checkout
+}
+
+// parseSyncHeader reads script details from the comment block at the
+// top of a script, e.g.
+//
+//	#!/bin/bash
+//	# obdi-name: lvm-list
+//	# obdi-desc: List logical volumes
+//	# obdi-interpreter: bash
+//
+// The block ends at the first line that isn't a comment.
+func parseSyncHeader(source []byte, meta *SyncMeta) {
+
+	scanner := bufio.NewScanner(bytes.NewReader(source))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+		if !strings.HasPrefix(line, "obdi-") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i == -1 {
+			continue
+		}
+		value := strings.TrimSpace(line[i+1:])
+		switch strings.TrimSpace(line[5:i]) {
+		case "name":
+			meta.Name = value
+		case "desc":
+			meta.Desc = value
+		case "interpreter":
+			meta.Interpreter = value
+		}
+	}
+}
+
+// readSyncDir finds the scripts in dir. A file is a script if it starts
+// with a #! line or has a sidecar manifest. Values in the manifest
+// override the header block. The name defaults to the file name.
+//
+// The paths and names of files that were skipped are returned in held,
+// so the scripts they were synced to aren't removed.
+func readSyncDir(dir string) (files []SyncFile, skipped []string,
+	held map[string]bool, err error) {
+
+	files = []SyncFile{}
+	skipped = []string{}
+	held = make(map[string]bool)
+
+	hold := func(rel, name string) {
+		held[rel] = true
+		if name != "" {
+			held[name] = true
+		}
+	}
+
+	err = filepath.Walk(dir, func(p string, info os.FileInfo,
+		err error) error {
+
+		if err != nil {
+			return err
+		}
+
+		// Skip .git and other hidden files
+		if p != dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.Mode().IsRegular() ||
+			strings.HasSuffix(p, SYNC_MANIFEST_SUFFIX) ||
+			strings.HasSuffix(p, SYNC_SIGNATURE_SUFFIX) {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(dir, p)
+
+		manifest, err := ioutil.ReadFile(p + SYNC_MANIFEST_SUFFIX)
+		hasManifest := err == nil
+
+		if info.Size() > config.ScriptMaxSize {
+			if hasManifest {
+				meta := SyncMeta{}
+				toml.Decode(string(manifest), &meta)
+				hold(rel, meta.Name)
+				skipped = append(skipped, fmt.Sprintf(
+					"%s: bigger than %d bytes", rel, config.ScriptMaxSize))
+			} else {
+				hold(rel, "") // Quietly, it's probably not a script
+			}
+			return nil
+		}
+
+		source, err := ioutil.ReadFile(p)
+		if err != nil {
+			hold(rel, filepath.Base(p))
+			skipped = append(skipped, rel+": "+err.Error())
+			return nil
+		}
+
+		if !hasManifest && !bytes.HasPrefix(source, []byte("#!")) {
+			return nil
+		}
+
+		file := SyncFile{Path: rel, Source: source}
+		parseSyncHeader(source, &file.Meta)
+		if hasManifest {
+			if _, err := toml.Decode(string(manifest),
+				&file.Meta); err != nil {
+				hold(rel, file.Meta.Name)
+				hold(rel, filepath.Base(p))
+				skipped = append(skipped, rel+SYNC_MANIFEST_SUFFIX+": "+
+					err.Error())
+				return nil
+			}
+		}
+		if file.Meta.Name == "" {
+			file.Meta.Name = filepath.Base(p)
+		}
+		if err := checkInterpreter(file.Meta.Interpreter); err != nil {
+			hold(rel, file.Meta.Name)
+			skipped = append(skipped, rel+": "+err.Error())
+			return nil
+		}
+
+		if sig, err := ioutil.ReadFile(p +
+			SYNC_SIGNATURE_SUFFIX); err == nil {
+			file.Signature = strings.TrimSpace(string(sig))
+		}
+
+		files = append(files, file)
+
+		return nil
+	})
+
+	return files, skipped, held, err
+}
+
+// gitCommit returns the commit checked out in dir, or "" if it isn't a
+// git checkout
+func gitCommit(dir string) string {
+
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		return ""
+	}
+
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "--short",
+		"HEAD").Output()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+// syncScripts makes the managed scripts match the files in dir.
+//
+// Scripts that were added with the GUI are left alone unless adopt is
+// set, when a file with the same name takes them over.
+func (api *Api) syncScripts(dir, author string, adopt bool) (
+	SyncResult, error) {
+
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+
+	result := SyncResult{
+		Added:   []string{},
+		Updated: []string{},
+		Removed: []string{},
+	}
+
+	if config.ScriptSyncGitPull {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			out, err := exec.Command("git", "-C", dir, "pull",
+				"--ff-only").CombinedOutput()
+			if err != nil {
+				return result, ApiError{fmt.Sprintf("git pull failed: %s",
+					strings.TrimSpace(string(out)))}
+			}
+		}
+	}
+
+	files, skipped, held, err := readSyncDir(dir)
+	if err != nil {
+		return result, err
+	}
+	result.Skipped = skipped
+	result.Commit = gitCommit(dir)
+
+	comment := "Synced from " + dir
+	if result.Commit != "" {
+		comment += " at commit " + result.Commit
+	}
+
+	seen := make(map[string]bool)
+
+	for _, file := range files {
+
+		name := file.Meta.Name
+
+		if seen[name] {
+			result.Skipped = append(result.Skipped, fmt.Sprintf(
+				"%s: another file is also named '%s'", file.Path, name))
+			continue
+		}
+		seen[name] = true
+
+		script := Script{}
+		mutex.Lock()
+		found := !api.db.Find(&script, "name = ?", name).RecordNotFound()
+		mutex.Unlock()
+
+		if found && !script.Managed && !adopt {
+			result.Skipped = append(result.Skipped, fmt.Sprintf(
+				"%s: script '%s' was not added by sync", file.Path, name))
+			continue
+		}
+
+		hash := scriptHash(file.Source)
+
+		if found && script.Managed && script.Hash == hash &&
+			script.Interpreter == file.Meta.Interpreter &&
+			script.Desc == file.Meta.Desc && script.SyncPath == file.Path &&
+			script.Signature == file.Signature {
+			result.Unchanged++
+			continue
+		}
+
+		if found {
+			if err := api.ensureRevision(&script); err != nil {
+				return result, err
+			}
+		}
+
+		changed := !found || script.Hash != hash ||
+			script.Interpreter != file.Meta.Interpreter ||
+			script.Signature != file.Signature
+
+		script.Name = name
+		script.Desc = file.Meta.Desc
+		script.Source = file.Source
+		script.Interpreter = file.Meta.Interpreter
+		script.Signature = file.Signature
+		script.Hash = hash
+		script.Type = detectScriptType(file.Source)
+		script.Managed = true
+		script.SyncPath = file.Path
+
+		if changed || script.ValidatedAt.IsZero() {
+			validateScript(&script)
+		}
+
+		// New scripts need an id before a revision can be added
+
+		if !found {
+			mutex.Lock()
+			if err := api.db.Save(&script).Error; err != nil {
+				mutex.Unlock()
+				return result, err
+			}
+			mutex.Unlock()
+		}
+
+		if changed {
+			if err := api.addRevision(&script, author,
+				comment); err != nil {
+				return result, err
+			}
+		}
+
+		mutex.Lock()
+		if err := api.db.Save(&script).Error; err != nil {
+			mutex.Unlock()
+			return result, err
+		}
+		mutex.Unlock()
+
+		if found {
+			result.Updated = append(result.Updated, name)
+		} else {
+			result.Added = append(result.Added, name)
+		}
+	}
+
+	// Managed scripts that have gone from the directory are deleted.
+	// Their revisions are kept. Scripts whose file was skipped are kept,
+	// as are all of them if no files were found, in case the directory
+	// is missing or broken rather than empty on purpose.
+
+	managed := []Script{}
+	mutex.Lock()
+	api.db.Find(&managed, "managed = ?", true)
+	mutex.Unlock()
+
+	if len(files) == 0 && len(managed) > 0 {
+		return result, ApiError{fmt.Sprintf("No scripts found in '%s'. "+
+			"Not removing the %d synced scripts.", dir, len(managed))}
+	}
+
+	for i := range managed {
+		if seen[managed[i].Name] || held[managed[i].Name] ||
+			held[managed[i].SyncPath] {
+			continue
+		}
+		mutex.Lock()
+		if err := api.db.Delete(&managed[i]).Error; err != nil {
+			mutex.Unlock()
+			return result, err
+		}
+		mutex.Unlock()
+		result.Removed = append(result.Removed, managed[i].Name)
+	}
+
+	sort.Strings(result.Added)
+	sort.Strings(result.Updated)
+	sort.Strings(result.Removed)
+
+	return result, nil
+}
+
+// managedError is returned when a synced script is changed in the GUI
+func managedError(script Script) error {
+	return ApiError{fmt.Sprintf("Script '%s' is synced from '%s'. "+
+		"Change it there and sync again.", script.Name, script.SyncPath)}
+}
+
+// SyncScripts processes "POST /scripts/sync" queries.
+//
+// Scripts are synced from the script_sync_dir directory. Add
+// '?adopt=true' to take over scripts of the same name that were added
+// with the GUI.
+func (api *Api) SyncScripts(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	login := r.PathParam("login")
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_SCRIPTS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	if config.ScriptSyncDir == "" {
+		rest.Error(w, "Script sync is not configured. "+
+			"Set script_sync_dir in obdi.conf.", 400)
+		return
+	}
+
+	qs := r.URL.Query() // Query string - map[string][]string
+	adopt := len(qs["adopt"]) > 0 && qs["adopt"][0] == "true"
+
+	result, err := api.syncScripts(config.ScriptSyncDir, login, adopt)
+	if err != nil {
+		logit("Script sync failed: " + err.Error())
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	api.LogActivity(session.Id, fmt.Sprintf("Synced scripts from %s. "+
+		"%d added, %d updated, %d removed, %d skipped.",
+		config.ScriptSyncDir, len(result.Added), len(result.Updated),
+		len(result.Removed), len(result.Skipped)))
+
+	w.WriteJson(result)
+}
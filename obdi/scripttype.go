@@ -0,0 +1,119 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// Interpreters that can be named without a path. Workers map these to
+// a path with their [interpreters] setting.
+var interpreterNames = []string{"bash", "sh", "python", "perl"}
+
+// checkInterpreter returns an error unless the interpreter is empty, a
+// known name or an absolute path
+func checkInterpreter(interpreter string) error {
+
+	if interpreter == "" {
+		return nil
+	}
+
+	for _, name := range interpreterNames {
+		if interpreter == name {
+			return nil
+		}
+	}
+
+	if strings.HasPrefix(interpreter, "/") &&
+		!strings.ContainsAny(interpreter, " \t\n") &&
+		path.Clean(interpreter) == interpreter {
+		return nil
+	}
+
+	return ApiError{"Interpreter must be one of " +
+		strings.Join(interpreterNames, ", ") + " or a full path"}
+}
+
+// detectScriptType describes the type of a script from its contents.
+// It's only a guide for the user, workers use the interpreter or the
+// script's #! line.
+func detectScriptType(source []byte) string {
+
+	if len(source) == 0 {
+		return "empty"
+	}
+
+	if bytes.HasPrefix(source, []byte("\x7fELF")) {
+		return "ELF executable"
+	}
+
+	if bytes.IndexByte(source, 0) != -1 || !utf8.Valid(source) {
+		return "data"
+	}
+
+	if !bytes.HasPrefix(source, []byte("#!")) {
+		return "text, no #! line"
+	}
+
+	interpreter := shebangInterpreter(source)
+	if interpreter == "" {
+		return "text, empty #! line"
+	}
+
+	switch {
+	case interpreter == "bash":
+		return "Bourne-Again shell script"
+	case interpreter == "sh":
+		return "POSIX shell script"
+	case strings.HasPrefix(interpreter, "python"):
+		return "Python script"
+	case strings.HasPrefix(interpreter, "perl"):
+		return "Perl script"
+	}
+
+	return interpreter + " script"
+}
+
+// shebangInterpreter returns the name of the interpreter on a script's
+// #! line, e.g. 'python3' for '#!/usr/bin/env python3', or "" if there
+// isn't one
+func shebangInterpreter(source []byte) string {
+
+	if !bytes.HasPrefix(source, []byte("#!")) {
+		return ""
+	}
+
+	line := string(source[2:])
+	if i := strings.IndexByte(line, '\n'); i != -1 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	// '#!/usr/bin/env python' names the interpreter in the argument
+	interpreter := path.Base(fields[0])
+	if interpreter == "env" && len(fields) > 1 {
+		interpreter = path.Base(fields[1])
+	}
+
+	return interpreter
+}
@@ -0,0 +1,169 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// A user can be logged in from several places at once, each with its own
+// session. Users can list and revoke their own sessions, and those who
+// can change users can revoke anyone's. Sessions that have expired are
+// purged in the background.
+
+import (
+	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	SESSION_AGENT_MAX     = 256 // Longer user agents are cut short
+	SESSION_PURGE_MINUTES = 5   // How often expired sessions are purged
+	SESSION_WORKER_GRACE  = 10  // Minutes workers can send output after
+)
+
+// clientIp returns the address the request came from, without the port
+func clientIp(r *rest.Request) string {
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// sessionExpiry returns the time before which sessions have expired
+func sessionExpiry() time.Time {
+	return time.Now().Add(-time.Duration(config.SessionTimeout) *
+		time.Minute)
+}
+
+// purgeSessions deletes expired sessions every SESSION_PURGE_MINUTES,
+// once they're past SESSION_WORKER_GRACE too. It doesn't return.
+// Workers log in again if a job's session is purged.
+func (api *Api) purgeSessions() {
+
+	for {
+		purge := sessionExpiry().Add(-SESSION_WORKER_GRACE * time.Minute)
+		mutex.Lock()
+		api.db.Where("updated_at < ?", purge).Delete(&Session{})
+		mutex.Unlock()
+
+		time.Sleep(SESSION_PURGE_MINUTES * time.Minute)
+	}
+}
+
+// GetAllSessions processes "GET /sessions" queries. Users see their own
+// sessions. Those who can read users can see anyone's with user_id.
+func (api *Api) GetAllSessions(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	userId := session.UserId
+	qs := r.URL.Query() // Query string - map[string][]string
+	if len(qs["user_id"]) > 0 {
+		errl = api.Authorize(session, RESOURCE_USERS, ACTION_READ)
+		if errl != nil {
+			rest.Error(w, errl.Error(), 400)
+			return
+		}
+		id, err := strconv.ParseInt(qs["user_id"][0], 10, 64)
+		if err != nil {
+			rest.Error(w, "Invalid user_id.", 400)
+			return
+		}
+		userId = id
+	}
+
+	sessions := []Session{}
+	mutex.Lock()
+	api.db.Order("updated_at desc").Find(&sessions,
+		"user_id = ? and updated_at >= ?", userId, sessionExpiry())
+	mutex.Unlock()
+
+	// Create a slice of maps from sessions struct
+	// to selectively copy database fields for display
+
+	u := make([]map[string]interface{}, len(sessions))
+	for i := range sessions {
+		u[i] = make(map[string]interface{})
+		u[i]["Id"] = sessions[i].Id
+		u[i]["UserId"] = sessions[i].UserId
+		u[i]["ClientIp"] = sessions[i].ClientIp
+		u[i]["UserAgent"] = sessions[i].UserAgent
+		u[i]["Restricted"] = sessions[i].Restricted
+		u[i]["CreatedAt"] = sessions[i].CreatedAt
+		u[i]["LastUsedAt"] = sessions[i].UpdatedAt
+		u[i]["Current"] = sessions[i].Id == session.Id
+	}
+
+	w.WriteJson(&u)
+}
+
+// DeleteSession processes "DELETE /sessions/:id" queries. It logs the
+// session out.
+func (api *Api) DeleteSession(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	id := r.PathParam("id")
+
+	// Check that the id string is a number
+	if _, err := strconv.Atoi(id); err != nil {
+		rest.Error(w, "Invalid id.", 400)
+		return
+	}
+
+	old := Session{}
+	mutex.Lock()
+	if api.db.Find(&old, id).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	if old.UserId != session.UserId {
+		errl = api.Authorize(session, RESOURCE_USERS, ACTION_WRITE)
+		if errl != nil {
+			rest.Error(w, errl.Error(), 400)
+			return
+		}
+	}
+
+	mutex.Lock()
+	if err := api.db.Delete(&old).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	if old.Id == session.Id {
+		setSessionCookie(w, "")
+	}
+
+	api.LogActivity(session.Id, "Revoked session "+id+" from "+
+		old.ClientIp+".")
+
+	w.WriteJson("Success")
+}
@@ -0,0 +1,40 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/mclarkson/obdi/common"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// signHeaders adds the signature headers for a message to h, see
+// common.Signature. worker is the name of the worker the message is for
+// and uri is the request URI, the path and any query string, that the
+// worker sees.
+func signHeaders(h http.Header, key, worker, method, uri string,
+	body []byte) {
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := NewGUID()
+	h.Set(common.HEADER_TIMESTAMP, timestamp)
+	h.Set(common.HEADER_NONCE, nonce)
+	h.Set(common.HEADER_WORKER, worker)
+	h.Set(common.HEADER_SIGNATURE, common.Signature(key, worker, method,
+		uri, timestamp, nonce, body))
+}
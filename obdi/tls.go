@@ -0,0 +1,138 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"github.com/mclarkson/obdi/common"
+	"net/http"
+	"sync"
+)
+
+var (
+	workerClient     *http.Client
+	workerClientErr  error
+	workerClientOnce sync.Once
+)
+
+// workerTLSConfig builds the TLS settings used to connect to workers.
+//
+// The worker's certificate is checked against worker_ca, or the system
+// CAs if that isn't set. If worker_pins is set the certificate must
+// also match a pin. Pins can be used without a CA, for self-signed
+// certificates. Checking is only turned off when worker_insecure is set.
+func workerTLSConfig() (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{}
+
+	if config.WorkerInsecure {
+		logit("WARNING: worker_insecure is set. Worker certificates " +
+			"are not checked.")
+		tlsConfig.InsecureSkipVerify = true
+	} else {
+		if config.WorkerCA != "" {
+			pool, err := common.LoadCertPool(config.WorkerCA)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if len(config.WorkerPins) > 0 {
+			if config.WorkerCA == "" {
+				// Pin only. The pin check replaces the CA check.
+				tlsConfig.InsecureSkipVerify = true
+			}
+			tlsConfig.VerifyPeerCertificate = common.CheckPins(config.WorkerPins)
+		}
+	}
+
+	// Identify ourselves to workers that ask for a client certificate
+	if config.WorkerClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.WorkerClientCert,
+			config.WorkerClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// httpClient returns the client used to send requests to workers. It's
+// built once and reused so connections can be kept alive.
+func httpClient() (*http.Client, error) {
+	workerClientOnce.Do(func() {
+		tlsConfig, err := workerTLSConfig()
+		if err != nil {
+			workerClientErr = ApiError{
+				"TLS setup failed ('" + err.Error() + "')"}
+			logit(workerClientErr.Error())
+			return
+		}
+		workerClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+	})
+	return workerClient, workerClientErr
+}
+
+// listenerTLSConfig builds the TLS settings for the manager's listener.
+// Browsers don't have client certificates so one is only checked when
+// it's sent. Logins listed in worker_client_users must send one, see
+// checkClientCert.
+func listenerTLSConfig() (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{}
+
+	if config.SSLClientCA != "" {
+		pool, err := common.LoadCertPool(config.SSLClientCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// checkClientCert returns an error if the login must use a client
+// certificate and the request didn't come with a verified one issued to
+// it. The certificate's common name, or one of its DNS or email subject
+// alternative names, must be the login, so one worker's certificate
+// can't be used to log in as another.
+func checkClientCert(login string, r *http.Request) error {
+	for _, user := range config.WorkerClientUsers {
+		if user != login {
+			continue
+		}
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return ApiError{"A client certificate is required for " +
+				"this user."}
+		}
+		for _, name := range common.CertNames(
+			r.TLS.VerifiedChains[0][0]) {
+			if name == login {
+				return nil
+			}
+		}
+		return ApiError{"The client certificate was not issued to " +
+			"this user."}
+	}
+	return nil
+}
@@ -0,0 +1,682 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// Two-factor authentication with time-based one-time passwords (RFC
+// 6238), the codes shown by authenticator apps.
+//
+// A user sets it up by asking for a secret, adding it to an app, then
+// sending a code from the app to confirm it. Confirming turns it on and
+// sends back recovery codes. After that DoLogin asks for a code after
+// the password, see TotpLogin. A recovery code can be used once instead
+// of a code. Too many wrong codes lock the user out, see totpAttempt.
+//
+// It's required for everyone if [totp] required is set, and for users
+// that can run jobs in an environment with TotpRequired set. Users that
+// must use it but haven't set it up get a restricted session, which can
+// only set it up. Workers and OIDC users never need it.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TotpConfig struct {
+	Required bool   `toml:"required"` // For everyone apart from workers
+	Issuer   string `toml:"issuer"`   // Shown in authenticator apps
+}
+
+const (
+	TOTP_PERIOD         = 30 // Seconds
+	TOTP_DIGITS         = 6
+	TOTP_RECOVERY_CODES = 10
+	TOTP_MAX_ATTEMPTS   = 5 // Wrong codes before the password is needed
+	TOTP_LOGIN_TIMEOUT  = 5 * time.Minute
+	TOTP_MAX_FAILURES   = 5 // Wrong codes in a row before a lockout
+	TOTP_LOCKOUT        = 15 * time.Minute
+	TOTP_MAX_LOCKOUT    = 24 * time.Hour
+)
+
+// A login waiting for its code
+type totpLogin struct {
+	UserId   int64
+	Attempts int
+	Expires  time.Time
+}
+
+var (
+	totpMutex  = &sync.Mutex{}
+	totpLogins = map[string]totpLogin{}
+
+	totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// totpCode returns the code for a time step. This is HOTP, RFC 4226,
+// with the step as the counter.
+func totpCode(secret []byte, step int64) string {
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// totpNewSecret returns a random 160 bit secret, base32 encoded
+func totpNewSecret() (string, error) {
+
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpURI returns the otpauth URI for the secret. Authenticator apps
+// read it from a QR code, or it can be typed in.
+func totpURI(login, secret string) string {
+
+	issuer := config.TOTP.Issuer
+
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", strconv.Itoa(TOTP_DIGITS))
+	q.Set("period", strconv.Itoa(TOTP_PERIOD))
+
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+login) + "?" +
+		q.Encode()
+}
+
+// totpCheckCode returns true if the code is right for now, or the step
+// either side to allow for clock drift. Each step's code only works
+// once, so the last step used is read, checked and saved under the
+// mutex.
+func (api *Api) totpCheckCode(user *User, code string) bool {
+
+	if len(code) != TOTP_DIGITS {
+		return false
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	current := User{}
+	if api.db.First(&current, user.Id).RecordNotFound() {
+		return false
+	}
+
+	secret, err := totpEncoding.DecodeString(current.TotpSecret)
+	if err != nil || len(secret) == 0 {
+		return false
+	}
+
+	now := time.Now().Unix() / TOTP_PERIOD
+	for step := now - 1; step <= now+1; step++ {
+		if step > current.TotpLastStep && hmac.Equal(
+			[]byte(totpCode(secret, step)), []byte(code)) {
+			if api.db.Model(&current).UpdateColumn("totp_last_step",
+				step).Error != nil {
+				return false
+			}
+			user.TotpLastStep = step
+			return true
+		}
+	}
+
+	return false
+}
+
+// totpAttempt counts a code sent at login as wrong before it's checked,
+// so guesses can't be made in parallel. Every TOTP_MAX_FAILURES wrong
+// codes in a row lock the user out, whatever login token is used, for
+// TOTP_LOCKOUT doubling each time up to TOTP_MAX_LOCKOUT. An error is
+// returned if the user is locked out.
+func (api *Api) totpAttempt(userId int64) (User, error) {
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	user := User{}
+	if api.db.First(&user, userId).RecordNotFound() {
+		return user, ApiError{"Login again."}
+	}
+
+	if time.Now().Before(user.TotpLockedUntil) {
+		return user, ApiError{"Too many wrong codes. Try again after " +
+			user.TotpLockedUntil.Format(time.RFC1123) + "."}
+	}
+
+	user.TotpFailures++
+	if user.TotpFailures%TOTP_MAX_FAILURES == 0 {
+		lockout := TOTP_LOCKOUT
+		for n := user.TotpFailures / TOTP_MAX_FAILURES; n > 1 &&
+			lockout < TOTP_MAX_LOCKOUT; n-- {
+			lockout *= 2
+		}
+		if lockout > TOTP_MAX_LOCKOUT {
+			lockout = TOTP_MAX_LOCKOUT
+		}
+		user.TotpLockedUntil = time.Now().Add(lockout)
+		logit(fmt.Sprintf("Too many wrong two-factor codes for '%s'. "+
+			"Locked out for %s.", user.Login, lockout))
+	}
+
+	err := api.db.Model(&user).UpdateColumns(map[string]interface{}{
+		"totp_failures":     user.TotpFailures,
+		"totp_locked_until": user.TotpLockedUntil,
+	}).Error
+
+	return user, err
+}
+
+// totpClearFailures forgets the user's wrong codes after a right one
+func (api *Api) totpClearFailures(user User) {
+
+	mutex.Lock()
+	api.db.Model(&user).UpdateColumns(map[string]interface{}{
+		"totp_failures":     0,
+		"totp_locked_until": time.Time{},
+	})
+	mutex.Unlock()
+}
+
+// totpNormCode makes a recovery code as typed match the stored hash
+func totpNormCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.Replace(code, "-", "", -1)
+}
+
+// totpUseRecoveryCode returns true if the code is one of the user's
+// recovery codes, and deletes it
+func (api *Api) totpUseRecoveryCode(user User, code string) bool {
+
+	rc := TotpRecoveryCode{}
+	mutex.Lock()
+	if api.db.Where("user_id = ? and code_hash = ?", user.Id,
+		hashToken(totpNormCode(code))).First(&rc).RecordNotFound() {
+		mutex.Unlock()
+		return false
+	}
+	api.db.Delete(&rc)
+	mutex.Unlock()
+
+	logit("User '" + user.Login + "' used a recovery code")
+
+	return true
+}
+
+// totpVerify returns true if the code is a code from the user's app or
+// one of the user's recovery codes
+func (api *Api) totpVerify(user *User, code string) bool {
+	return api.totpCheckCode(user, code) ||
+		api.totpUseRecoveryCode(*user, code)
+}
+
+// newRecoveryCodes replaces the user's recovery codes
+func (api *Api) newRecoveryCodes(userId int64) ([]string, error) {
+
+	mutex.Lock()
+	api.db.Where("user_id = ?", userId).Delete(TotpRecoveryCode{})
+	mutex.Unlock()
+
+	codes := []string{}
+	for i := 0; i < TOTP_RECOVERY_CODES; i++ {
+
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+
+		rc := TotpRecoveryCode{UserId: userId, CodeHash: hashToken(code)}
+		mutex.Lock()
+		if err := api.db.Save(&rc).Error; err != nil {
+			mutex.Unlock()
+			return nil, err
+		}
+		mutex.Unlock()
+
+		codes = append(codes, code[:4]+"-"+code[4:])
+	}
+
+	return codes, nil
+}
+
+// totpExemption returns why the user is never asked for a code, or ""
+// if they can be. OIDC users are exempt even where it's required, so
+// the effective permissions view shows this.
+func totpExemption(user User) string {
+
+	switch {
+	case user.Role == ROLE_WORKER:
+		return "Workers don't use two-factor authentication."
+	case user.AuthSource == AUTH_OIDC:
+		return "Left to the single sign-on provider."
+	}
+
+	return ""
+}
+
+// totpRequired returns true if the user must use two-factor
+// authentication
+func (api *Api) totpRequired(user User) bool {
+
+	if totpExemption(user) != "" {
+		return false
+	}
+	if config.TOTP.Required {
+		return true
+	}
+
+	// Admins can run jobs everywhere
+
+	query := api.db.Model(Env{}).Where("totp_required = 1")
+	if user.Role != ROLE_ADMIN {
+		query = query.Where("envs.id in ("+envPermSQL(true)+")", user.Id)
+	}
+
+	count := 0
+	mutex.Lock()
+	query.Count(&count)
+	mutex.Unlock()
+
+	return count > 0
+}
+
+// totpChallenge remembers that the user's password was right and returns
+// a token to send with the code
+func totpChallenge(user User) (string, error) {
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	totpMutex.Lock()
+	for t, login := range totpLogins {
+		if time.Now().After(login.Expires) {
+			delete(totpLogins, t)
+		}
+	}
+	totpLogins[token] = totpLogin{
+		UserId:  user.Id,
+		Expires: time.Now().Add(TOTP_LOGIN_TIMEOUT),
+	}
+	totpMutex.Unlock()
+
+	return token, nil
+}
+
+// totpSessionUser returns the session and user for the self service
+// handlers. AuthMiddleware lets restricted sessions through to them so
+// users can set up two-factor authentication when they have to.
+func (api *Api) totpSessionUser(r *rest.Request) (Session, User, error) {
+
+	session := authSession(r)
+
+	user := User{}
+	mutex.Lock()
+	if api.db.First(&user, session.UserId).RecordNotFound() {
+		mutex.Unlock()
+		return session, user, ApiError{"User not found."}
+	}
+	mutex.Unlock()
+
+	return session, user, nil
+}
+
+// TotpLogin processes "POST /login/totp" queries, the second step of
+// logging in. It takes the Token from DoLogin and a Code, and sends the
+// GUID as DoLogin does.
+func (api *Api) TotpLogin(w rest.ResponseWriter, r *rest.Request) {
+
+	data := struct{ Token, Code string }{}
+	if err := r.DecodeJsonPayload(&data); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	}
+
+	// Count the attempt before checking the code so guesses can't be
+	// made in parallel
+
+	totpMutex.Lock()
+	login, ok := totpLogins[data.Token]
+	if ok && (time.Now().After(login.Expires) ||
+		login.Attempts >= TOTP_MAX_ATTEMPTS) {
+		delete(totpLogins, data.Token)
+		ok = false
+	}
+	if ok {
+		login.Attempts++
+		totpLogins[data.Token] = login
+	}
+	totpMutex.Unlock()
+
+	if !ok {
+		rest.Error(w, "Login again.", 400)
+		return
+	}
+
+	user, err := api.totpAttempt(login.UserId)
+	if err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	if !user.TotpEnabled || !api.totpVerify(&user, data.Code) {
+		logit("Wrong two-factor code for '" + user.Login + "'")
+		rest.Error(w, "Invalid code.", 400)
+		return
+	}
+
+	api.totpClearFailures(user)
+
+	totpMutex.Lock()
+	delete(totpLogins, data.Token)
+	totpMutex.Unlock()
+
+	api.startSession(w, r, user)
+}
+
+// GetTotp processes "GET /totp" queries. It shows the user's two-factor
+// authentication status.
+func (api *Api) GetTotp(w rest.ResponseWriter, r *rest.Request) {
+
+	session, user, err := api.totpSessionUser(r)
+	if err != nil {
+		rest.Error(w, err.Error(), 401)
+		return
+	}
+
+	defer api.TouchSession(session.Guid)
+
+	count := 0
+	mutex.Lock()
+	api.db.Model(TotpRecoveryCode{}).Where("user_id = ?", user.Id).
+		Count(&count)
+	mutex.Unlock()
+
+	w.WriteJson(map[string]interface{}{
+		"Enabled":       user.TotpEnabled,
+		"Required":      api.totpRequired(user),
+		"RecoveryCodes": count,
+	})
+}
+
+// SetupTotp processes "POST /totp" queries. It makes a new secret, which
+// is used once ConfirmTotp is sent a code for it.
+func (api *Api) SetupTotp(w rest.ResponseWriter, r *rest.Request) {
+
+	session, user, err := api.totpSessionUser(r)
+	if err != nil {
+		rest.Error(w, err.Error(), 401)
+		return
+	}
+
+	defer api.TouchSession(session.Guid)
+
+	if user.AuthSource == AUTH_OIDC {
+		rest.Error(w, "Use the single sign-on provider's two-factor "+
+			"authentication.", 400)
+		return
+	}
+	if user.TotpEnabled {
+		rest.Error(w, "Two-factor authentication is already set up.", 400)
+		return
+	}
+
+	secret, err := totpNewSecret()
+	if err != nil {
+		rest.Error(w, err.Error(), 500)
+		return
+	}
+
+	user.TotpSecret = secret
+	user.TotpLastStep = 0
+	mutex.Lock()
+	if err := api.db.Save(&user).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	w.WriteJson(map[string]string{
+		"Secret": secret,
+		"URI":    totpURI(user.Login, secret),
+	})
+}
+
+// ConfirmTotp processes "POST /totp/confirm" queries. A Code for the
+// secret from SetupTotp turns two-factor authentication on. The recovery
+// codes are sent back, and this is the only time they can be seen.
+func (api *Api) ConfirmTotp(w rest.ResponseWriter, r *rest.Request) {
+
+	session, user, err := api.totpSessionUser(r)
+	if err != nil {
+		rest.Error(w, err.Error(), 401)
+		return
+	}
+
+	defer api.TouchSession(session.Guid)
+
+	data := struct{ Code string }{}
+	if err := r.DecodeJsonPayload(&data); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	}
+
+	if user.TotpEnabled || user.TotpSecret == "" {
+		rest.Error(w, "Ask for a new secret first.", 400)
+		return
+	}
+	if !api.totpCheckCode(&user, data.Code) {
+		rest.Error(w, "Invalid code.", 400)
+		return
+	}
+
+	user.TotpEnabled = true
+	mutex.Lock()
+	if err := api.db.Save(&user).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	codes, err := api.newRecoveryCodes(user.Id)
+	if err != nil {
+		rest.Error(w, err.Error(), 500)
+		return
+	}
+
+	// The session can be used for everything now
+
+	if session.Restricted {
+		session.Restricted = false
+		mutex.Lock()
+		api.db.Save(&session)
+		mutex.Unlock()
+	}
+
+	api.LogActivity(session.Id, "Set up two-factor authentication for '"+
+		user.Login+"'.")
+
+	w.WriteJson(map[string]interface{}{"RecoveryCodes": codes})
+}
+
+// NewTotpRecoveryCodes processes "POST /totp/recoverycodes" queries. It
+// takes a Code and replaces the user's recovery codes.
+func (api *Api) NewTotpRecoveryCodes(w rest.ResponseWriter,
+	r *rest.Request) {
+
+	session, user, err := api.totpSessionUser(r)
+	if err != nil {
+		rest.Error(w, err.Error(), 401)
+		return
+	}
+
+	defer api.TouchSession(session.Guid)
+
+	data := struct{ Code string }{}
+	if err := r.DecodeJsonPayload(&data); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	}
+
+	if !user.TotpEnabled || !api.totpVerify(&user, data.Code) {
+		rest.Error(w, "Invalid code.", 400)
+		return
+	}
+
+	codes, err := api.newRecoveryCodes(user.Id)
+	if err != nil {
+		rest.Error(w, err.Error(), 500)
+		return
+	}
+
+	api.LogActivity(session.Id, "Made new recovery codes for '"+
+		user.Login+"'.")
+
+	w.WriteJson(map[string]interface{}{"RecoveryCodes": codes})
+}
+
+// DisableTotp processes "POST /totp/disable" queries. It takes a Code
+// and turns two-factor authentication off, unless the user must use it.
+func (api *Api) DisableTotp(w rest.ResponseWriter, r *rest.Request) {
+
+	session, user, err := api.totpSessionUser(r)
+	if err != nil {
+		rest.Error(w, err.Error(), 401)
+		return
+	}
+
+	defer api.TouchSession(session.Guid)
+
+	data := struct{ Code string }{}
+	if err := r.DecodeJsonPayload(&data); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	}
+
+	if api.totpRequired(user) {
+		rest.Error(w, "Two-factor authentication is required.", 400)
+		return
+	}
+	if !user.TotpEnabled || !api.totpVerify(&user, data.Code) {
+		rest.Error(w, "Invalid code.", 400)
+		return
+	}
+
+	if err := api.clearTotp(user); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	api.LogActivity(session.Id, "Turned off two-factor authentication "+
+		"for '"+user.Login+"'.")
+
+	w.WriteJson("Success")
+}
+
+// clearTotp turns off the user's two-factor authentication and deletes
+// the recovery codes
+func (api *Api) clearTotp(user User) error {
+
+	user.TotpSecret = ""
+	user.TotpEnabled = false
+	user.TotpLastStep = 0
+	user.TotpFailures = 0
+	user.TotpLockedUntil = time.Time{}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err := api.db.Save(&user).Error; err != nil {
+		return err
+	}
+
+	return api.db.Where("user_id = ?", user.Id).
+		Delete(TotpRecoveryCode{}).Error
+}
+
+// ResetTotp processes "DELETE /users/:id/totp" queries. It's for users
+// that have lost their authenticator and recovery codes. They have to
+// set it up again at their next login if it's required.
+func (api *Api) ResetTotp(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_USERS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	id := r.PathParam("id")
+
+	// Check that the id string is a number
+	if _, err := strconv.Atoi(id); err != nil {
+		rest.Error(w, "Invalid id.", 400)
+		return
+	}
+
+	user := User{}
+	mutex.Lock()
+	if api.db.Find(&user, id).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	if err := api.clearTotp(user); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	api.LogActivity(session.Id, "Reset two-factor authentication for '"+
+		user.Login+"'.")
+
+	w.WriteJson("Success")
+}
@@ -33,28 +33,19 @@ import (
 //
 func (api *Api) GetAllUsers(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	session := authSession(r)
+	var errl error = nil
 
-	// Only admin is allowed
+	// Check the user's role allows it
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
+	errl = api.Authorize(session, RESOURCE_USERS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	//session := Session{}
-	var errl error = nil
-	//if session,errl = api.CheckLogin( login, guid ); errl != nil {
-	if _, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
-		return
-	}
-
-	defer api.TouchSession(guid)
-
 	users := []User{}
 	qs := r.URL.Query() // map[string][]string
 	if len(qs["login"]) > 0 {
@@ -88,6 +79,9 @@ func (api *Api) GetAllUsers(w rest.ResponseWriter, r *rest.Request) {
 		u[i]["Forename"] = users[i].Forename
 		u[i]["Surname"] = users[i].Surname
 		u[i]["Enabled"] = users[i].Enabled
+		u[i]["Role"] = users[i].Role
+		u[i]["AuthSource"] = users[i].AuthSource
+		u[i]["TotpEnabled"] = users[i].TotpEnabled
 		u[i]["CreatedAt"] = users[i].CreatedAt
 		u[i]["Email"] = users[i].Email
 	}
@@ -101,27 +95,19 @@ func (api *Api) GetAllUsers(w rest.ResponseWriter, r *rest.Request) {
 //
 func (api *Api) AddUser(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
-
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	// Credentials were checked by AuthMiddleware
 
-	// Only admin is allowed
+	session := authSession(r)
+	var errl error
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_USERS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Can't add if it exists already
 
 	userData := User{}
@@ -144,15 +130,38 @@ func (api *Api) AddUser(w rest.ResponseWriter, r *rest.Request) {
 
 	// Add user
 
-	if len(userData.Passhash) == 0 {
+	if len(userData.AuthSource) == 0 {
+		userData.AuthSource = AUTH_LOCAL
+	}
+	if err := checkAuthSource(userData.AuthSource); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	// LDAP and OIDC users' passwords are checked by the LDAP server or
+	// the OIDC provider
+
+	if userData.AuthSource != AUTH_LOCAL {
+		userData.Passhash = ""
+	} else if len(userData.Passhash) == 0 {
 		rest.Error(w, "Empty password not allowed.", 400)
 		return
 	}
 
-	c := &Crypt{}
-	c.Pass = []byte(userData.Passhash)
-	c.Crypt()
-	userData.Passhash = string(c.Hash)
+	if len(userData.Role) == 0 {
+		userData.Role = ROLE_OPERATOR
+	}
+	if err := checkRole(userData.Role); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	if userData.AuthSource == AUTH_LOCAL {
+		c := &Crypt{}
+		c.Pass = []byte(userData.Passhash)
+		c.Crypt()
+		userData.Passhash = string(c.Hash)
+	}
 
 	mutex.Lock()
 	if err := api.db.Save(&userData).Error; err != nil {
@@ -170,27 +179,19 @@ func (api *Api) AddUser(w rest.ResponseWriter, r *rest.Request) {
 //
 func (api *Api) UpdateUser(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
-
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	// Credentials were checked by AuthMiddleware
 
-	// Only admin is allowed
+	session := authSession(r)
+	var errl error
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
-		return
-	}
+	// Check the user's role allows it
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
+	errl = api.Authorize(session, RESOURCE_USERS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	defer api.TouchSession(guid)
-
 	// Ensure user exists
 
 	id := r.PathParam("id")
@@ -216,6 +217,8 @@ func (api *Api) UpdateUser(w rest.ResponseWriter, r *rest.Request) {
 	// merge with 'user' manually. This will remove
 	// the 'password can't begin with $' limitation.
 
+	old := user
+
 	// ... overwrite any sent fields
 	if err := r.DecodeJsonPayload(&user); err != nil {
 		//rest.Error(w, err.Error(), 400)
@@ -223,9 +226,32 @@ func (api *Api) UpdateUser(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
+	if err := checkRole(user.Role); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	if len(user.AuthSource) == 0 {
+		user.AuthSource = AUTH_LOCAL
+	}
+	if err := checkAuthSource(user.AuthSource); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	// Don't leave nobody able to manage users
+
+	if old.Role == ROLE_ADMIN && old.Enabled &&
+		(user.Role != ROLE_ADMIN || !user.Enabled) &&
+		api.otherAdmins(old.Id) == 0 {
+		rest.Error(w, "This is the last enabled admin.", 400)
+		return
+	}
+
 	// Add user
 
-	if !strings.HasPrefix(user.Passhash, "$") {
+	if user.AuthSource != AUTH_LOCAL {
+		user.Passhash = ""
+	} else if !strings.HasPrefix(user.Passhash, "$") {
 		c := &Crypt{}
 		c.Pass = []byte(user.Passhash)
 		c.Crypt()
@@ -254,27 +280,19 @@ func (api *Api) UpdateUser(w rest.ResponseWriter, r *rest.Request) {
 //
 func (api *Api) DeleteUser(w rest.ResponseWriter, r *rest.Request) {
 
-	// Check credentials
+	// Credentials were checked by AuthMiddleware
 
-	login := r.PathParam("login")
-	guid := r.PathParam("GUID")
+	session := authSession(r)
+	var errl error
 
-	// Only admin is allowed
+	// Check the user's role allows it
 
-	if login != "admin" {
-		rest.Error(w, "Not allowed", 400)
+	errl = api.Authorize(session, RESOURCE_USERS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
 		return
 	}
 
-	session := Session{}
-	var errl error
-	if session, errl = api.CheckLogin(login, guid); errl != nil {
-		rest.Error(w, errl.Error(), 401)
-		return
-	}
-
-	defer api.TouchSession(guid)
-
 	// Delete
 
 	id := 0
@@ -292,12 +310,22 @@ func (api *Api) DeleteUser(w rest.ResponseWriter, r *rest.Request) {
 	}
 	mutex.Unlock()
 
+	if user.Role == ROLE_ADMIN && user.Enabled &&
+		api.otherAdmins(user.Id) == 0 {
+		rest.Error(w, "This is the last enabled admin.", 400)
+		return
+	}
+
 	mutex.Lock()
 	if err := api.db.Delete(&user).Error; err != nil {
 		mutex.Unlock()
 		rest.Error(w, err.Error(), 400)
 		return
 	}
+	api.db.Where("user_id = ?", user.Id).Delete(&GroupMember{})
+	api.db.Where("user_id = ?", user.Id).Delete(&TotpRecoveryCode{})
+	api.db.Where("user_id = ?", user.Id).Delete(&ApiToken{})
+	api.db.Where("user_id = ?", user.Id).Delete(&Session{})
 	mutex.Unlock()
 
 	api.LogActivity(session.Id,
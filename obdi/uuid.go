@@ -24,3 +24,8 @@ import (
 func NewGUID() string {
 	return uuid.New()
 }
+
+// IsGUID returns true if s looks like a GUID from NewGUID
+func IsGUID(s string) bool {
+	return uuid.Parse(s) != nil
+}
@@ -0,0 +1,374 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Syntax checks used when the [script_checkers] setting is missing.
+// 'perl -c' runs BEGIN blocks so it has to be turned on in obdi.conf.
+var defaultScriptCheckers = map[string]string{
+	"bash":   "bash -n",
+	"sh":     "sh -n",
+	"python": "python3 -m py_compile",
+}
+
+// How long a syntax check can take
+const SCRIPT_CHECK_TIMEOUT = 10 * time.Second
+
+// Only this much of a syntax check's output is kept
+const MAX_CHECK_OUTPUT = 2000
+
+// A [[script_lint]] rule from obdi.conf
+type LintRule struct {
+	Pattern     string `toml:"pattern"`     // Regular expression
+	Message     string `toml:"message"`     // Shown when a line matches
+	Interpreter string `toml:"interpreter"` // Only check these scripts
+	Severity    string `toml:"severity"`    // "error" or "warning"
+}
+
+// scriptLanguage returns the interpreter a script runs with, without
+// its path or version, e.g. 'python' for '#!/usr/bin/python3'
+func scriptLanguage(script Script) string {
+
+	name := path.Base(script.Interpreter)
+	if script.Interpreter == "" {
+		name = shebangInterpreter(script.Source)
+	}
+
+	switch {
+	case strings.HasPrefix(name, "python"):
+		return "python"
+	case strings.HasPrefix(name, "perl"):
+		return "perl"
+	}
+
+	return name
+}
+
+// syntaxCheck runs the checker for the script's language. It returns
+// the checker's output if the check failed.
+func syntaxCheck(checker string, source []byte) (bool, string, error) {
+
+	args := strings.Fields(checker)
+
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return false, "", err
+	}
+
+	dir, err := ioutil.TempDir("", "obdi_check_")
+	if err != nil {
+		return false, "", err
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "script")
+	if err := ioutil.WriteFile(file, source, 0600); err != nil {
+		return false, "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		SCRIPT_CHECK_TIMEOUT)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], append(args[1:], file)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return false, "", ApiError{"Timed out"}
+	}
+	if err == nil {
+		return true, "", nil
+	}
+
+	// Show where the error is, not our temporary file
+	text := strings.TrimSpace(strings.Replace(string(out), file,
+		"script", -1))
+	if len(text) > MAX_CHECK_OUTPUT {
+		text = text[:MAX_CHECK_OUTPUT] + "..."
+	}
+	if text == "" {
+		text = err.Error()
+	}
+
+	return false, text, nil
+}
+
+// validateScript checks a script and stores the results on it. Any
+// override is cleared, it was for the old source. The script isn't
+// saved.
+func validateScript(script *Script) {
+
+	errs := []string{}
+	warns := []string{}
+
+	source := script.Source
+	lang := scriptLanguage(*script)
+	binary := bytes.HasPrefix(source, []byte("\x7fELF"))
+
+	if len(source) == 0 {
+		errs = append(errs, "The script is empty.")
+	}
+
+	if int64(len(source)) > config.ScriptMaxSize {
+		errs = append(errs, fmt.Sprintf("The script is %d bytes. The "+
+			"limit is %d bytes.", len(source), config.ScriptMaxSize))
+	}
+
+	// Shebang checks
+
+	firstLine := string(source)
+	if i := strings.IndexByte(firstLine, '\n'); i != -1 {
+		firstLine = firstLine[:i]
+	}
+
+	switch {
+	case binary || len(source) == 0:
+	case script.Interpreter == "" &&
+		!bytes.HasPrefix(source, []byte("#!")):
+		errs = append(errs, "There is no #! line and no interpreter "+
+			"is set.")
+	case script.Interpreter == "" && shebangInterpreter(source) == "":
+		errs = append(errs, "The #! line is empty.")
+	case script.Interpreter == "" && strings.HasSuffix(firstLine, "\r"):
+		errs = append(errs, "The #! line ends with a carriage return. "+
+			"Convert the script to Unix line endings.")
+	case script.Interpreter != "" && shebangInterpreter(source) != "" &&
+		scriptLanguage(Script{Source: source}) != lang:
+		warns = append(warns, fmt.Sprintf("The #! line names '%s' "+
+			"but the script runs with '%s'.", shebangInterpreter(source),
+			script.Interpreter))
+	}
+
+	// Syntax check with the matching interpreter
+
+	if checker, ok := config.ScriptCheckers[lang]; ok && !binary &&
+		len(source) > 0 {
+		ok, output, err := syntaxCheck(checker, source)
+		switch {
+		case err != nil:
+			warns = append(warns, fmt.Sprintf("Not syntax checked. "+
+				"'%s' failed on the Manager ('%s').", checker, err))
+		case !ok:
+			errs = append(errs, fmt.Sprintf("Syntax check '%s' failed:\n%s",
+				checker, output))
+		}
+	} else if lang != "" && !binary {
+		warns = append(warns, fmt.Sprintf("Not syntax checked. There is "+
+			"no checker for '%s' scripts.", lang))
+	}
+
+	// Lint rules
+
+	if !binary {
+		lines := strings.Split(string(source), "\n")
+		for _, rule := range config.ScriptLint {
+			if rule.Interpreter != "" && rule.Interpreter != lang {
+				continue
+			}
+			re := regexp.MustCompile(rule.Pattern) // Checked in Read_config
+			for i, line := range lines {
+				if !re.MatchString(line) {
+					continue
+				}
+				text := fmt.Sprintf("Line %d: %s", i+1, rule.Message)
+				if rule.Severity == "error" {
+					errs = append(errs, text)
+				} else {
+					warns = append(warns, text)
+				}
+			}
+		}
+	}
+
+	report := []string{}
+	for _, e := range errs {
+		report = append(report, "ERROR: "+e)
+	}
+	for _, w := range warns {
+		report = append(report, "WARNING: "+w)
+	}
+
+	script.ValidationOk = len(errs) == 0
+	script.ValidationReport = strings.Join(report, "\n")
+	script.ValidationOverride = false
+	script.ValidatedAt = time.Now()
+}
+
+// checkValidated returns an error if the script failed validation and
+// an admin hasn't overridden it. Scripts saved before validation was
+// added are validated first.
+func (api *Api) checkValidated(script *Script) error {
+
+	if script.ValidatedAt.IsZero() {
+		validateScript(script)
+		mutex.Lock()
+		err := api.db.Save(script).Error
+		mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	if script.ValidationOk || script.ValidationOverride {
+		return nil
+	}
+
+	return ApiError{fmt.Sprintf("Script '%s' failed validation. Fix it, "+
+		"or ask an admin to override the check.\n%s", script.Name,
+		script.ValidationReport)}
+}
+
+// validationOutput is what's shown for a script's validation
+func validationOutput(script Script) map[string]interface{} {
+	return map[string]interface{}{
+		"Id":                 script.Id,
+		"Name":               script.Name,
+		"ValidationOk":       script.ValidationOk,
+		"ValidationReport":   script.ValidationReport,
+		"ValidationOverride": script.ValidationOverride,
+		"ValidatedAt":        script.ValidatedAt,
+	}
+}
+
+// ValidateScript processes "POST /scripts/:id/validate" queries.
+//
+// Scripts are validated when they're saved. This checks them again, for
+// when the checks in obdi.conf have changed.
+func (api *Api) ValidateScript(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_SCRIPTS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathParam("id"), 10, 64)
+	if err != nil {
+		rest.Error(w, "Invalid id.", 400)
+		return
+	}
+
+	script := Script{}
+	mutex.Lock()
+	if api.db.First(&script, id).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	// Keep an override if the result hasn't changed
+	override := script.ValidationOverride && !script.ValidationOk
+	validateScript(&script)
+	script.ValidationOverride = override && !script.ValidationOk
+
+	mutex.Lock()
+	if err := api.db.Save(&script).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	api.LogActivity(session.Id, fmt.Sprintf("Validated script '%s' "+
+		"(passed: %t).", script.Name, script.ValidationOk))
+
+	w.WriteJson(validationOutput(script))
+}
+
+// OverrideValidation processes "PUT /scripts/:id/validation" queries.
+//
+// Send {"Override":true} to let a script that failed validation run.
+// The override is cleared when the script changes.
+func (api *Api) OverrideValidation(w rest.ResponseWriter,
+	r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_SCRIPTS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathParam("id"), 10, 64)
+	if err != nil {
+		rest.Error(w, "Invalid id.", 400)
+		return
+	}
+
+	data := struct{ Override bool }{}
+	if err := r.DecodeJsonPayload(&data); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	}
+
+	script := Script{}
+	mutex.Lock()
+	if api.db.First(&script, id).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	script.ValidationOverride = data.Override
+
+	mutex.Lock()
+	if err := api.db.Save(&script).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	if data.Override {
+		api.LogActivity(session.Id, fmt.Sprintf("Overrode validation of "+
+			"script '%s'. It can run even if it failed.", script.Name))
+	} else {
+		api.LogActivity(session.Id, fmt.Sprintf("Removed validation "+
+			"override of script '%s'.", script.Name))
+	}
+
+	w.WriteJson(validationOutput(script))
+}
@@ -0,0 +1,395 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// Workers can use an API token instead of logging in as a user. The
+// token identifies the worker, not a user, and is only accepted on the
+// /worker routes. A worker using a token can only report on jobs that
+// were sent to it.
+//
+// Workers that log in as a user all share the login, so can't be told
+// apart. Instead each job is sent with a random key that the worker
+// sends back when it reports on the job.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
+	"strconv"
+	"strings"
+)
+
+// What a worker may change about a job
+type JobStatus struct {
+	Status        int64
+	StatusReason  string
+	StatusPercent int64
+	Errors        int64
+	JobKey        string // Only needed by workers that log in as a user
+}
+
+// hashToken returns the hex encoded SHA-256 of a worker token. Only the
+// hash is stored.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckWorkerToken returns the worker that owns the token sent in the
+// Authorization header
+func (api *Api) CheckWorkerToken(r *rest.Request) (Worker, error) {
+
+	worker := Worker{}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return worker, ApiError{"Invalid credentials."}
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	if token == "" {
+		return worker, ApiError{"Invalid credentials."}
+	}
+
+	mutex.Lock()
+	if api.db.Where("token_hash = ?", hashToken(token)).
+		First(&worker).RecordNotFound() {
+		mutex.Unlock()
+		return worker, ApiError{"Invalid credentials."}
+	}
+	mutex.Unlock()
+
+	if !worker.Enabled {
+		return worker, ApiError{"Worker is disabled."}
+	}
+
+	return worker, nil
+}
+
+// workerJob returns a job, or an error if the job wasn't sent to the
+// worker
+func (api *Api) workerJob(worker Worker, jobId int64) (Job, error) {
+
+	job := Job{}
+	mutex.Lock()
+	if api.db.First(&job, jobId).RecordNotFound() {
+		mutex.Unlock()
+		return job, ApiError{"Job ID not found."}
+	}
+	mutex.Unlock()
+
+	if job.WorkerId != worker.Id {
+		return job, ApiError{"Not allowed"}
+	}
+
+	return job, nil
+}
+
+// newJobKey returns a key to send to a worker with a job, and the hash
+// of the key to save in the job
+func newJobKey() (string, string, error) {
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key := hex.EncodeToString(b)
+
+	return key, hashToken(key), nil
+}
+
+// keyedJob returns a job, or an error if the key isn't the one that was
+// sent to the worker with the job
+func (api *Api) keyedJob(jobId int64, key string) (Job, error) {
+
+	job := Job{}
+	mutex.Lock()
+	if api.db.First(&job, jobId).RecordNotFound() {
+		mutex.Unlock()
+		return job, ApiError{"Job ID not found."}
+	}
+	mutex.Unlock()
+
+	if key == "" || job.KeyHash == "" || hashToken(key) != job.KeyHash {
+		return job, ApiError{"Not allowed"}
+	}
+
+	return job, nil
+}
+
+// setJobStatus copies what a worker may change onto the job. Jobs that
+// have finished can't be changed.
+func setJobStatus(job *Job, status JobStatus) error {
+
+	switch job.Status {
+	case STATUS_USERCANCELLED, STATUS_SYSCANCELLED, STATUS_OK,
+		STATUS_ERROR:
+		return ApiError{"Job has finished."}
+	}
+
+	job.Status = status.Status
+	job.StatusReason = status.StatusReason
+	job.StatusPercent = status.StatusPercent
+	job.Errors = status.Errors
+	job.Collected = false // It got there, see requeueUncollected
+
+	return nil
+}
+
+// NewWorkerToken processes "POST /workers/:id/token" queries.
+//
+// A new token is made for the worker, replacing any old one. The token
+// is only shown this once.
+func (api *Api) NewWorkerToken(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_WORKERS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	id := 0
+	if id, errl = strconv.Atoi(r.PathParam("id")); errl != nil {
+		rest.Error(w, "Invalid id.", 400)
+		return
+	}
+
+	worker := Worker{}
+	mutex.Lock()
+	if api.db.First(&worker, id).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		rest.Error(w, err.Error(), 500)
+		return
+	}
+	token := hex.EncodeToString(b)
+
+	worker.TokenHash = hashToken(token)
+	mutex.Lock()
+	if err := api.db.Save(&worker).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	api.LogActivity(session.Id,
+		"Created a new API token for worker '"+worker.Name+"'.")
+
+	w.WriteJson(map[string]string{"Token": token})
+}
+
+// RegisterWorkerByToken processes "POST /worker/register" queries.
+func (api *Api) RegisterWorkerByToken(w rest.ResponseWriter,
+	r *rest.Request) {
+	api.updateWorkerByToken(w, r, true)
+}
+
+// WorkerHeartbeatByToken processes "POST /worker/heartbeat" queries.
+func (api *Api) WorkerHeartbeatByToken(w rest.ResponseWriter,
+	r *rest.Request) {
+	api.updateWorkerByToken(w, r, false)
+}
+
+func (api *Api) updateWorkerByToken(w rest.ResponseWriter, r *rest.Request,
+	register bool) {
+
+	worker, err := api.CheckWorkerToken(r)
+	if err != nil {
+		rest.Error(w, err.Error(), 401)
+		return
+	}
+
+	heartbeat := Heartbeat{}
+
+	if err := r.DecodeJsonPayload(&heartbeat); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	}
+
+	if err := api.saveHeartbeat(&worker, heartbeat, true); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	if register {
+		logit(fmt.Sprintf("Worker '%s' (version %s) registered.",
+			worker.Name, worker.Version))
+	}
+
+	w.WriteJson(worker)
+}
+
+// PullJobsByToken processes "GET /worker/pull" queries.
+func (api *Api) PullJobsByToken(w rest.ResponseWriter, r *rest.Request) {
+
+	worker, err := api.CheckWorkerToken(r)
+	if err != nil {
+		rest.Error(w, err.Error(), 401)
+		return
+	}
+
+	env := Env{}
+	mutex.Lock()
+	if api.db.First(&env, worker.EnvId).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Environment not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	if !env.PullMode {
+		rest.Error(w, "Environment is not in pull mode.", 400)
+		return
+	}
+
+	api.waitForJobs(w, r, env, worker)
+}
+
+// AddOutputLineByToken processes "POST /worker/outputlines" queries.
+func (api *Api) AddOutputLineByToken(w rest.ResponseWriter,
+	r *rest.Request) {
+
+	worker, err := api.CheckWorkerToken(r)
+	if err != nil {
+		rest.Error(w, err.Error(), 401)
+		return
+	}
+
+	outputLineData := OutputLine{}
+
+	if err := r.DecodeJsonPayload(&outputLineData); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	} else if outputLineData.JobId == 0 {
+		rest.Error(w, "Incorrect data format received.", 400)
+		return
+	}
+
+	if _, err := api.workerJob(worker, outputLineData.JobId); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	// Lines can only be added, never overwritten
+	outputLineData.Id = 0
+
+	if err := api.saveOutputLine(outputLineData); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	w.WriteJson("Success")
+}
+
+// UpdateJobByToken processes "PUT /worker/jobs/:id" queries.
+//
+// Only the job's status can be changed, and only until the job has
+// finished.
+func (api *Api) UpdateJobByToken(w rest.ResponseWriter, r *rest.Request) {
+
+	worker, err := api.CheckWorkerToken(r)
+	if err != nil {
+		rest.Error(w, err.Error(), 401)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathParam("id"), 10, 64)
+	if err != nil {
+		rest.Error(w, "Invalid id.", 400)
+		return
+	}
+
+	job, err := api.workerJob(worker, id)
+	if err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	status := JobStatus{}
+	if err := r.DecodeJsonPayload(&status); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	}
+
+	if err := setJobStatus(&job, status); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	mutex.Lock()
+	if err := api.db.Save(&job).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	w.WriteJson(job)
+}
+
+// GetScriptByToken processes "GET /worker/scripts/hash/:hash" queries.
+//
+// A worker can only fetch the script of a job that was sent to it.
+func (api *Api) GetScriptByToken(w rest.ResponseWriter, r *rest.Request) {
+
+	worker, err := api.CheckWorkerToken(r)
+	if err != nil {
+		rest.Error(w, err.Error(), 401)
+		return
+	}
+
+	hash := r.PathParam("hash")
+
+	count := 0
+	mutex.Lock()
+	api.db.Model(Job{}).Where("worker_id = ? and script_hash = ? and "+
+		"status in (?,?)", worker.Id, hash, STATUS_NOTSTARTED,
+		STATUS_INPROGRESS).Count(&count)
+	mutex.Unlock()
+
+	if count == 0 {
+		rest.Error(w, "Not allowed", 400)
+		return
+	}
+
+	script, err := api.scriptByHash(hash)
+	if err != nil {
+		rest.Error(w, err.Error(), 404)
+		return
+	}
+
+	w.WriteJson(map[string]interface{}{
+		"Name":   script.Name,
+		"Hash":   script.Hash,
+		"Source": script.Source,
+	})
+}
@@ -0,0 +1,647 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"github.com/mclarkson/obdi/external/ant0ine/go-json-rest/rest"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Sent by workers when they start and then every heartbeat_interval
+type Heartbeat struct {
+	DcSysName   string
+	EnvSysName  string
+	Name        string
+	Url         string
+	Hostname    string
+	Version     string
+	RunningJobs int64
+	Load        float64
+}
+
+// Healthy is true if the worker has sent a heartbeat recently
+func (wk Worker) Healthy() bool {
+	return time.Now().Sub(wk.LastSeen) <
+		time.Duration(config.WorkerTimeout)*time.Second
+}
+
+// findEnv looks up an environment from its data centre and environment
+// system names
+func (api *Api) findEnv(dcSysName, envSysName string) (Env, error) {
+
+	dc := Dc{}
+	env := Env{}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if api.db.Find(&dc, "sys_name = ?", dcSysName).RecordNotFound() {
+		return env, ApiError{"Data centre not found."}
+	}
+	if api.db.Find(&env, "sys_name = ? and dc_id = ?",
+		envSysName, dc.Id).RecordNotFound() {
+		return env, ApiError{"Environment not found."}
+	}
+
+	return env, nil
+}
+
+// envWorkers returns the workers registered for an environment, the
+// most recently seen first
+func (api *Api) envWorkers(envId int64) []Worker {
+	workers := []Worker{}
+	mutex.Lock()
+	api.db.Order("last_seen desc").Find(&workers, "env_id = ?", envId)
+	mutex.Unlock()
+	return workers
+}
+
+// activeJobs returns the number of jobs that have been sent to a worker
+// and haven't finished yet
+func (api *Api) activeJobs(workerId int64) int64 {
+	count := int64(0)
+	mutex.Lock()
+	api.db.Model(Job{}).Where("worker_id = ? and status in (?,?)", workerId,
+		STATUS_NOTSTARTED, STATUS_INPROGRESS).Count(&count)
+	mutex.Unlock()
+	return count
+}
+
+// pickWorkers returns the workers that a job for the environment can be
+// sent to, best first.
+//
+// Disabled workers, and workers that have stopped sending heartbeats,
+// are left out. Workers that have never sent a heartbeat (older workers
+// don't) are used after the healthy ones. Within those groups the
+// worker with the fewest running jobs for its weight is first.
+//
+// Environments with no enabled workers in their pool use Env.WorkerUrl
+// and Env.WorkerKey. This includes workers that registered themselves
+// and are waiting for an admin to enable them. Workers with no URL or
+// key of their own use these too. Set needUrl to false for pull mode,
+// where workers connect to us.
+func (api *Api) pickWorkers(env Env, needUrl bool) ([]Worker, error) {
+
+	workers := []Worker{}
+	for _, worker := range api.envWorkers(env.Id) {
+		if worker.Enabled {
+			workers = append(workers, worker)
+		}
+	}
+
+	if len(workers) == 0 {
+		if (env.WorkerUrl == "" && needUrl) || env.WorkerKey == "" {
+			if len(api.envWorkers(env.Id)) > 0 {
+				txt := fmt.Sprintf("All workers for environment '%s' "+
+					"are disabled.", env.SysName)
+				return workers, ApiError{txt}
+			}
+			return workers, ApiError{
+				"WorkerUrl or WorkerKey not set for this environment"}
+		}
+		return []Worker{{
+			Name:    env.SysName,
+			Url:     env.WorkerUrl,
+			Key:     env.WorkerKey,
+			Weight:  1,
+			Enabled: true,
+		}}, nil
+	}
+
+	type candidate struct {
+		worker  Worker
+		healthy bool
+		score   float64
+	}
+	candidates := []candidate{}
+
+	for _, worker := range workers {
+		if !worker.Healthy() && !worker.LastSeen.IsZero() {
+			continue
+		}
+		if worker.Url == "" {
+			worker.Url = env.WorkerUrl
+		}
+		if worker.Key == "" {
+			worker.Key = env.WorkerKey
+		}
+		if (worker.Url == "" && needUrl) || worker.Key == "" {
+			continue
+		}
+		weight := worker.Weight
+		if weight < 1 {
+			weight = 1
+		}
+		candidates = append(candidates, candidate{
+			worker:  worker,
+			healthy: worker.Healthy(),
+			score:   float64(api.activeJobs(worker.Id)) / float64(weight),
+		})
+	}
+
+	if len(candidates) == 0 {
+		for _, worker := range workers {
+			if !worker.Healthy() && !worker.LastSeen.IsZero() {
+				txt := fmt.Sprintf("The workers for environment '%s' are "+
+					"offline. A worker was last seen at %s ('%s' on host "+
+					"'%s').", env.SysName,
+					worker.LastSeen.Format(time.RFC1123), worker.Name,
+					worker.Hostname)
+				return []Worker{}, ApiError{txt}
+			}
+		}
+		txt := fmt.Sprintf("No worker in environment '%s' has a "+
+			"WorkerUrl and WorkerKey set.", env.SysName)
+		return []Worker{}, ApiError{txt}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.healthy != b.healthy {
+			return a.healthy
+		}
+		if a.score != b.score {
+			return a.score < b.score
+		}
+		return a.worker.Load < b.worker.Load
+	})
+
+	picked := make([]Worker, len(candidates))
+	for i := range candidates {
+		picked[i] = candidates[i].worker
+	}
+
+	return picked, nil
+}
+
+// jobWorker returns the worker a job was sent to, with the URL and key
+// filled in from the environment if the worker doesn't have its own
+func (api *Api) jobWorker(job Job, env Env) Worker {
+
+	worker := Worker{}
+	if job.WorkerId > 0 {
+		mutex.Lock()
+		api.db.Unscoped().First(&worker, job.WorkerId)
+		mutex.Unlock()
+	}
+	if worker.Url == "" {
+		worker.Url = env.WorkerUrl
+	}
+	if worker.Key == "" {
+		worker.Key = env.WorkerKey
+	}
+	if worker.Id == 0 {
+		// Not in the pool. Named after the environment, as in
+		// pickWorkers.
+		worker.Name = env.SysName
+	}
+
+	return worker
+}
+
+// saveHeartbeat records what the worker told us about itself. Jobs are
+// sent to the worker's URL, so only a worker using its own API token can
+// set it. Any other URL is kept in ReportedUrl for an admin to approve.
+func (api *Api) saveHeartbeat(worker *Worker, heartbeat Heartbeat,
+	byToken bool) error {
+
+	worker.ReportedUrl = heartbeat.Url
+
+	// The admin's choice of URL wins over the worker's
+	if byToken && worker.Url == "" {
+		worker.Url = heartbeat.Url
+	}
+	worker.Hostname = heartbeat.Hostname
+	worker.Version = heartbeat.Version
+	worker.RunningJobs = heartbeat.RunningJobs
+	worker.Load = heartbeat.Load
+	worker.LastSeen = time.Now()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	return api.db.Save(worker).Error
+}
+
+func (api *Api) updateWorker(w rest.ResponseWriter, r *rest.Request,
+	register bool) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_WORKERS, ACTION_REPORT)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	heartbeat := Heartbeat{}
+
+	if err := r.DecodeJsonPayload(&heartbeat); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	} else if len(heartbeat.Name) == 0 {
+		rest.Error(w, "Incorrect data format received.", 400)
+		return
+	}
+
+	env, err := api.findEnv(heartbeat.DcSysName, heartbeat.EnvSysName)
+	if err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	// Add the worker if it's new, otherwise update it. Any worker login
+	// can do this, so new workers don't get jobs until an admin has
+	// checked them, set their URL and enabled them.
+
+	worker := Worker{}
+	mutex.Lock()
+	if api.db.Where(Worker{EnvId: env.Id, Name: heartbeat.Name}).
+		First(&worker).RecordNotFound() {
+		worker = Worker{
+			EnvId:   env.Id,
+			Name:    heartbeat.Name,
+			Weight:  1,
+			Enabled: false,
+		}
+	}
+	mutex.Unlock()
+
+	if err := api.saveHeartbeat(&worker, heartbeat, false); err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+
+	if register {
+		text := fmt.Sprintf("Worker '%s' (version %s) registered for '%s/%s'.",
+			worker.Name, worker.Version, heartbeat.DcSysName,
+			heartbeat.EnvSysName)
+		if !worker.Enabled {
+			text += " It's disabled until an admin enables it. Jobs " +
+				"go to the environment's WorkerUrl until then."
+		}
+		logit(text)
+		api.LogActivity(session.Id, text)
+	}
+
+	// Not the whole worker, that has its key
+	w.WriteJson(map[string]interface{}{
+		"Id":      worker.Id,
+		"Name":    worker.Name,
+		"Enabled": worker.Enabled,
+	})
+}
+
+// RegisterWorker processes "POST /workers/register" queries.
+//
+// Workers register when they start.
+func (api *Api) RegisterWorker(w rest.ResponseWriter, r *rest.Request) {
+	api.updateWorker(w, r, true)
+}
+
+// WorkerHeartbeat processes "POST /workers/heartbeat" queries.
+//
+// Workers send a heartbeat every heartbeat_interval seconds.
+func (api *Api) WorkerHeartbeat(w rest.ResponseWriter, r *rest.Request) {
+	api.updateWorker(w, r, false)
+}
+
+// GetAllWorkers processes "GET /workers" queries. Workers' keys can sign
+// jobs so they aren't sent, only whether one is set.
+func (api *Api) GetAllWorkers(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error = nil
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_WORKERS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	workers := []Worker{}
+	qs := r.URL.Query() // Query string - map[string][]string
+	if len(qs["env_id"]) > 0 {
+		srch := qs["env_id"][0]
+		mutex.Lock()
+		api.db.Order("name").Find(&workers, "env_id = ?", srch)
+		mutex.Unlock()
+	} else {
+		// No results is not an error
+		mutex.Lock()
+		err := api.db.Order("env_id,name").Find(&workers)
+		mutex.Unlock()
+		if err.Error != nil {
+			if !err.RecordNotFound() {
+				rest.Error(w, err.Error.Error(), 500)
+				return
+			}
+		}
+	}
+
+	// Create a slice of maps from workers struct
+	// to selectively copy database fields for display
+
+	u := make([]map[string]interface{}, len(workers))
+	for i := range workers {
+		u[i] = make(map[string]interface{})
+		u[i]["Id"] = workers[i].Id
+		u[i]["EnvId"] = workers[i].EnvId
+		u[i]["Name"] = workers[i].Name
+		u[i]["Url"] = workers[i].Url
+		u[i]["ReportedUrl"] = workers[i].ReportedUrl
+		u[i]["KeySet"] = workers[i].Key != "" // Never the key itself
+		u[i]["Weight"] = workers[i].Weight
+		u[i]["Enabled"] = workers[i].Enabled
+		u[i]["ActiveJobs"] = api.activeJobs(workers[i].Id)
+		u[i]["Hostname"] = workers[i].Hostname
+		u[i]["Version"] = workers[i].Version
+		u[i]["RunningJobs"] = workers[i].RunningJobs
+		u[i]["Load"] = workers[i].Load
+		u[i]["LastSeen"] = workers[i].LastSeen
+		u[i]["Healthy"] = workers[i].Healthy()
+
+		env := Env{}
+		mutex.Lock()
+		api.db.Model(&workers[i]).Related(&env)
+		mutex.Unlock()
+
+		u[i]["EnvSysName"] = env.SysName
+		u[i]["EnvDispName"] = env.DispName
+	}
+
+	w.WriteJson(&u)
+}
+
+// AddWorker processes "POST /workers" queries.
+func (api *Api) AddWorker(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_WORKERS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	// Can't add if it exists already
+
+	workerData := Worker{}
+
+	if err := r.DecodeJsonPayload(&workerData); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	} else if len(workerData.Name) == 0 || workerData.EnvId == 0 {
+		rest.Error(w, "Incorrect data format received.", 400)
+		return
+	}
+	worker := Worker{}
+	mutex.Lock()
+	if !api.db.Find(&worker, "name = ? and env_id = ?",
+		workerData.Name, workerData.EnvId).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record exists.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	if workerData.Weight < 1 {
+		workerData.Weight = 1
+	}
+
+	// Add worker
+
+	mutex.Lock()
+	if err := api.db.Save(&workerData).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	text := fmt.Sprintf("Added new worker '%s' to environment %d.",
+		workerData.Name, workerData.EnvId)
+	api.LogActivity(session.Id, text)
+	w.WriteJson(workerData)
+}
+
+// UpdateWorker processes "PUT /workers/:id" queries. Keys aren't listed
+// by GetAllWorkers, so sending a new Key here is how it's rotated.
+func (api *Api) UpdateWorker(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_WORKERS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	id := r.PathParam("id")
+
+	// Check that the id string is a number
+	if _, err := strconv.Atoi(id); err != nil {
+		rest.Error(w, "Invalid id.", 400)
+		return
+	}
+
+	// Load data from db, then ...
+	worker := Worker{}
+	mutex.Lock()
+	if api.db.Find(&worker, id).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	// ... overwrite any sent fields
+	if err := r.DecodeJsonPayload(&worker); err != nil {
+		rest.Error(w, "Invalid data format received.", 400)
+		return
+	}
+
+	// Force the use of the path id over an id in the payload
+	Id, _ := strconv.Atoi(id)
+	worker.Id = int64(Id)
+
+	mutex.Lock()
+	if err := api.db.Save(&worker).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	api.LogActivity(session.Id,
+		"Updated worker details for '"+worker.Name+"'.")
+
+	w.WriteJson("Success")
+}
+
+// DeleteWorker processes "DELETE /workers/:id" queries.
+func (api *Api) DeleteWorker(w rest.ResponseWriter, r *rest.Request) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_WORKERS, ACTION_WRITE)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	// Delete
+
+	id := 0
+	if id, errl = strconv.Atoi(r.PathParam("id")); errl != nil {
+		rest.Error(w, "Invalid id.", 400)
+		return
+	}
+
+	worker := Worker{}
+	mutex.Lock()
+	if api.db.First(&worker, id).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	mutex.Lock()
+	if err := api.db.Delete(&worker).Error; err != nil {
+		mutex.Unlock()
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	mutex.Unlock()
+
+	api.LogActivity(session.Id, "Deleted worker '"+worker.Name+"'.")
+
+	w.WriteJson("Success")
+}
+
+// GetWorkerHealth processes "GET /workers/:id/health" queries.
+//
+// The worker's /health endpoint is queried and the result returned.
+func (api *Api) GetWorkerHealth(w rest.ResponseWriter, r *rest.Request) {
+	api.queryWorker(w, r, "health")
+}
+
+// GetWorkerJob processes "GET /workers/:id/jobs/:jobid" queries.
+//
+// The live process details of a running job are fetched from the
+// worker.
+func (api *Api) GetWorkerJob(w rest.ResponseWriter, r *rest.Request) {
+
+	jobid, err := strconv.ParseInt(r.PathParam("jobid"), 10, 64)
+	if err != nil {
+		rest.Error(w, "Invalid job id.", 400)
+		return
+	}
+
+	api.queryWorker(w, r, fmt.Sprintf("jobs/%d", jobid))
+}
+
+// queryWorker sends a signed GET request to a worker and passes the
+// reply back
+func (api *Api) queryWorker(w rest.ResponseWriter, r *rest.Request,
+	endpoint string) {
+
+	// Credentials were checked by AuthMiddleware
+
+	session := authSession(r)
+	var errl error
+
+	// Check the user's role allows it
+
+	errl = api.Authorize(session, RESOURCE_WORKERS, ACTION_READ)
+	if errl != nil {
+		rest.Error(w, errl.Error(), 400)
+		return
+	}
+
+	id := 0
+	if id, errl = strconv.Atoi(r.PathParam("id")); errl != nil {
+		rest.Error(w, "Invalid id.", 400)
+		return
+	}
+
+	worker := Worker{}
+	mutex.Lock()
+	if api.db.First(&worker, id).RecordNotFound() {
+		mutex.Unlock()
+		rest.Error(w, "Record not found.", 400)
+		return
+	}
+	mutex.Unlock()
+
+	env := Env{}
+	mutex.Lock()
+	api.db.First(&env, worker.EnvId)
+	mutex.Unlock()
+
+	worker = api.jobWorker(Job{WorkerId: worker.Id}, env)
+	if worker.Url == "" || worker.Key == "" {
+		rest.Error(w, "WorkerUrl or WorkerKey not set for this worker", 400)
+		return
+	}
+
+	resp, err := GET(worker, endpoint)
+	if err != nil {
+		rest.Error(w, err.Error(), 400)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		txt := fmt.Sprintf("Error reading Body ('%s').", err.Error())
+		rest.Error(w, txt, 400)
+		return
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	w.(http.ResponseWriter).Write(body)
+}
@@ -40,8 +40,7 @@ mgrApp.controller("capsCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     $http({
       method: 'DELETE',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/dccaps/" + id
+      url: baseUrl + "/dccaps/" + id
     }).success( function(data, status, headers, config) {
       //$scope.mainokmessage = "The dc was deleted."
       $scope.FillCapsTable();
@@ -76,8 +75,7 @@ mgrApp.controller("capsCtrl", function ($log, $modal, $scope, $http, baseUrl) {
     $http({
       method: 'POST',
       data: $scope.newcap,
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/dccaps"
+      url: baseUrl + "/dccaps"
     }).success( function(data, status, headers, config) {
       //$scope.okmessage = "The dc was added."
       $scope.FillCapsTable();
@@ -109,8 +107,7 @@ mgrApp.controller("capsCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/dccaps"
+      url: baseUrl + "/dccaps"
     }).success( function(data, status, headers, config) {
       $scope.dccaps = data;
     }).error( function(data,status) {
@@ -176,8 +173,7 @@ mgrApp.controller("capsCtrl", function ($log, $modal, $scope, $http, baseUrl) {
     $http({
       method: 'PUT',
       data: $scope.dccap,
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/dccaps/" + $scope.dccap.Id
+      url: baseUrl + "/dccaps/" + $scope.dccap.Id
     }).success( function(data, status, headers, config) {
       //$scope.okmessage = "The dc was added."
       $scope.FillCapsTable();
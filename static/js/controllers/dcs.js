@@ -182,8 +182,7 @@ mgrApp.controller("dcCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     $http({
       method: 'DELETE',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/dcs/" + id
+      url: baseUrl + "/dcs/" + id
     }).success( function(data, status, headers, config) {
       $scope.mainokmessage = "The dc was deleted."
       $scope.FillDCTable();
@@ -249,8 +248,7 @@ mgrApp.controller("dcCtrl", function ($log, $modal, $scope, $http, baseUrl) {
     $http({
       method: 'PUT',
       data: $scope.dc,
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/dcs/" + $scope.dc.Id
+      url: baseUrl + "/dcs/" + $scope.dc.Id
     }).success( function(data, status, headers, config) {
 
       // Cycle through each entry in $scope.newcap.newcapmap array
@@ -310,8 +308,7 @@ mgrApp.controller("dcCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     json = JSON.stringify( json_obj )
     jQuery.ajax({
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/dccapmaps" + id,
+      url: baseUrl + "/dccapmaps" + id,
       data: json,
       type: type,
       processData: false,
@@ -349,8 +346,7 @@ mgrApp.controller("dcCtrl", function ($log, $modal, $scope, $http, baseUrl) {
     $http({
       method: 'POST',
       data: $scope.dc,
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/dcs"
+      url: baseUrl + "/dcs"
     }).success( function(data, status, headers, config) {
 
       id = data.Id;
@@ -395,8 +391,7 @@ mgrApp.controller("dcCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/dccaps"
+      url: baseUrl + "/dccaps"
     }).success( function(data, status, headers, config) {
       $scope.dccaps = data;
     }).error( function(data,status) {
@@ -427,8 +422,7 @@ mgrApp.controller("dcCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/dccapmaps?dc_id=" + id
+      url: baseUrl + "/dccapmaps?dc_id=" + id
     }).success( function(data, status, headers, config) {
       $scope.dccapmaps = data;
     }).error( function(data,status) {
@@ -459,8 +453,7 @@ mgrApp.controller("dcCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/dcs"
+      url: baseUrl + "/dcs"
     }).success( function(data, status, headers, config) {
       $scope.dcs = data;
     }).error( function(data,status) {
@@ -41,8 +41,7 @@ mgrApp.controller("envcapsCtrl", function ($log, $modal, $scope, $http,
 
     $http({
       method: 'DELETE',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envcaps/" + id
+      url: baseUrl + "/envcaps/" + id
     }).success( function(data, status, headers, config) {
       //$scope.mainokmessage = "The dc was deleted."
       $scope.FillCapsTable();
@@ -77,8 +76,7 @@ mgrApp.controller("envcapsCtrl", function ($log, $modal, $scope, $http,
     $http({
       method: 'POST',
       data: $scope.newcap,
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envcaps"
+      url: baseUrl + "/envcaps"
     }).success( function(data, status, headers, config) {
       //$scope.okmessage = "The dc was added."
       $scope.FillCapsTable();
@@ -110,8 +108,7 @@ mgrApp.controller("envcapsCtrl", function ($log, $modal, $scope, $http,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envcaps"
+      url: baseUrl + "/envcaps"
     }).success( function(data, status, headers, config) {
       $scope.envcaps = data;
     }).error( function(data,status) {
@@ -177,8 +174,7 @@ mgrApp.controller("envcapsCtrl", function ($log, $modal, $scope, $http,
     $http({
       method: 'PUT',
       data: $scope.envcap,
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envcaps/" + $scope.envcap.Id
+      url: baseUrl + "/envcaps/" + $scope.envcap.Id
     }).success( function(data, status, headers, config) {
       //$scope.okmessage = "The dc was added."
       $scope.FillCapsTable();
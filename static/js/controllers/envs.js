@@ -159,8 +159,7 @@ mgrApp.controller("envCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     $http({
       method: 'DELETE',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envs/" + id
+      url: baseUrl + "/envs/" + id
     }).success( function(data, status, headers, config) {
       $scope.mainokmessage = "The environment was deleted."
       $scope.FillEnvTable();
@@ -191,8 +190,7 @@ mgrApp.controller("envCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     json = JSON.stringify( json_obj )
     jQuery.ajax({
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envcapmaps" + id,
+      url: baseUrl + "/envcapmaps" + id,
       data: json,
       type: type,
       processData: false,
@@ -232,8 +230,7 @@ mgrApp.controller("envCtrl", function ($log, $modal, $scope, $http, baseUrl) {
     $http({
       method: 'PUT',
       data: $scope.env,
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envs/" + $scope.env.Id
+      url: baseUrl + "/envs/" + $scope.env.Id
     }).success( function(data, status, headers, config) {
 
       // Cycle through each entry in $scope.newcap.newcapmap array
@@ -297,8 +294,7 @@ mgrApp.controller("envCtrl", function ($log, $modal, $scope, $http, baseUrl) {
     $http({
       method: 'POST',
       data: $scope.env,
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envs"
+      url: baseUrl + "/envs"
     }).success( function(data, status, headers, config) {
 
       id = data.Id;
@@ -344,8 +340,7 @@ mgrApp.controller("envCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envcaps"
+      url: baseUrl + "/envcaps"
     }).success( function(data, status, headers, config) {
       $scope.envcaps = data;
     }).error( function(data,status) {
@@ -376,8 +371,7 @@ mgrApp.controller("envCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envcapmaps?env_id=" + id
+      url: baseUrl + "/envcapmaps?env_id=" + id
     }).success( function(data, status, headers, config) {
       $scope.envcapmaps = data;
     }).error( function(data,status) {
@@ -408,8 +402,7 @@ mgrApp.controller("envCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envs"
+      url: baseUrl + "/envs"
     }).success( function(data, status, headers, config) {
       $scope.envs = data;
       $scope.FillDcTable();
@@ -441,8 +434,7 @@ mgrApp.controller("envCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/dcs"
+      url: baseUrl + "/dcs"
     }).success( function(data, status, headers, config) {
       $scope.dcs = data;
     }).error( function(data,status) {
@@ -556,8 +548,7 @@ mgrApp.controller("envCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envcaps"
+      url: baseUrl + "/envcaps"
     }).success( function(data, status, headers, config) {
       $scope.envcaps = data;
     }).error( function(data,status) {
@@ -24,6 +24,7 @@ mgrApp.controller("loginCtrl", function ($scope, $http, baseUrl) {
   $scope.login.pageurl = "login.html";
   $scope.login.error = false;
   $scope.login.errtext = "";
+  $scope.login.step = "";
 
   // ------------------------------------------------------------------------
   $scope.clearlogin = function() {
@@ -39,24 +40,6 @@ mgrApp.controller("loginCtrl", function ($scope, $http, baseUrl) {
     // Fix for browser autocomplete not registering
     $('input').checkAndTriggerAutoFillEvent();
 
-    if( $scope.login.userid != "admin" && window.interface == "admin" ) {
-      $scope.login.userid = '';
-      $scope.login.password = '';
-      $scope.login.error = true;
-      $scope.login.errtext = "You do not have admin access.";
-      $scope.login.pageurl = "login.html";
-      return
-    }
-
-    if( $scope.login.userid == "admin" && window.interface == "run" ) {
-      $scope.login.userid = '';
-      $scope.login.password = '';
-      $scope.login.error = true;
-      $scope.login.errtext = "Admin user is not allowed here.";
-      $scope.login.pageurl = "login.html";
-      return
-    }
-
     creds = {
       Login: $scope.login.userid,
       Password: $scope.login.password
@@ -67,14 +50,17 @@ mgrApp.controller("loginCtrl", function ($scope, $http, baseUrl) {
       method: "POST",
       data: creds
     }).success( function (data) {
-      $scope.login.guid = data.GUID;
       creds = {};
       $scope.login.password = '';
-      if ($scope.login.userid == "admin") {
-        $scope.login.pageurl = "admin.html";
-      } else {
-        $scope.login.pageurl = "run.html";
+      if (data.TOTPRequired) {
+        // The password was right, now a code is needed
+        $scope.login.token = data.Token;
+        $scope.login.code = '';
+        $scope.login.error = false;
+        $scope.login.step = "totp";
+        return;
       }
+      $scope.loggedIn(data);
     }).error( function(data,status) {
       $scope.login.userid = '';
       $scope.login.password = '';
@@ -83,6 +69,9 @@ mgrApp.controller("loginCtrl", function ($scope, $http, baseUrl) {
         $scope.login.errtext = "Server error.";
       } else if (status>=400) {
         $scope.login.errtext = "Invalid Login or Password.";
+        if (data && data.Error == "Use single sign-on to log in.") {
+          $scope.login.errtext = data.Error;
+        }
       } else if (status==0) {
         // This is a guess really
         $scope.login.errtext = "Could not connect to server.";
@@ -90,13 +79,226 @@ mgrApp.controller("loginCtrl", function ($scope, $http, baseUrl) {
     });
   }
 
+  // ------------------------------------------------------------------------
+  $scope.loggedIn = function(data) {
+  // ------------------------------------------------------------------------
+    // Show the page for the user's role
+
+    $scope.login.guid = data.GUID;
+    $scope.login.role = data.Role;
+    if (data.TOTPSetup) {
+      // Only two-factor authentication can be set up until it is
+      $scope.setupTotp(data);
+      return;
+    }
+    $scope.login.step = "";
+    if (window.interface == "admin") {
+      // Admins manage, auditors look
+      if (data.Role == "admin" || data.Role == "auditor") {
+        $scope.login.pageurl = "admin.html";
+      } else {
+        $scope.refuseLogin("You do not have admin access.");
+      }
+    } else {
+      if (data.Role == "worker") {
+        $scope.refuseLogin("Worker accounts are not allowed here.");
+      } else {
+        $scope.login.pageurl = "run.html";
+      }
+    }
+  }
+
+  // ------------------------------------------------------------------------
+  $scope.dototp = function() {
+  // ------------------------------------------------------------------------
+    // The second login step for users with two-factor authentication
+
+    $http({
+      url: baseUrl + "/login/totp",
+      method: "POST",
+      data: { Token: $scope.login.token, Code: $scope.login.code }
+    }).success( function (data) {
+      $scope.login.token = '';
+      $scope.login.code = '';
+      $scope.login.error = false;
+      $scope.loggedIn(data);
+    }).error( function(data,status) {
+      $scope.login.code = '';
+      $scope.login.error = true;
+      if (status>=500) {
+        $scope.login.errtext = "Server error.";
+      } else if (data && data.Error == "Login again.") {
+        $scope.cancelStep();
+        $scope.login.error = true;
+        $scope.login.errtext = "Too many tries or too slow. Login again.";
+      } else {
+        $scope.login.errtext = "Invalid code.";
+      }
+    });
+  }
+
+  // ------------------------------------------------------------------------
+  $scope.setupTotp = function(data) {
+  // ------------------------------------------------------------------------
+    // Get a secret for the user to add to an authenticator app
+
+    $scope.login.pending = data;
+    $scope.login.code = '';
+    $scope.login.step = "totpsetup";
+
+    $http({
+      url: baseUrl + "/totp",
+      method: "POST"
+    }).success( function (data) {
+      $scope.login.totp = data;
+    }).error( function(data,status) {
+      $scope.login.error = true;
+      $scope.login.errtext = (data && data.Error) || "Server error.";
+    });
+  }
+
+  // ------------------------------------------------------------------------
+  $scope.confirmTotp = function() {
+  // ------------------------------------------------------------------------
+
+    $http({
+      url: baseUrl + "/totp/confirm",
+      method: "POST",
+      data: { Code: $scope.login.code }
+    }).success( function (data) {
+      $scope.login.code = '';
+      $scope.login.totp = {};
+      $scope.login.error = false;
+      $scope.login.recoverycodes = data.RecoveryCodes;
+      $scope.login.step = "recoverycodes";
+    }).error( function(data,status) {
+      $scope.login.code = '';
+      $scope.login.error = true;
+      $scope.login.errtext = (data && data.Error) || "Server error.";
+    });
+  }
+
+  // ------------------------------------------------------------------------
+  $scope.finishTotp = function() {
+  // ------------------------------------------------------------------------
+    // Carry on logging in now the session isn't restricted
+
+    var data = $scope.login.pending;
+    data.TOTPSetup = false;
+    $scope.login.pending = {};
+    $scope.login.recoverycodes = [];
+    $scope.loggedIn(data);
+  }
+
+  // ------------------------------------------------------------------------
+  $scope.cancelStep = function() {
+  // ------------------------------------------------------------------------
+    // Back to the password form
+
+    if ($scope.login.guid) {
+      $http({
+        url: baseUrl + "/logout",
+        method: "POST"
+      });
+    }
+    $scope.login.guid = '';
+    $scope.login.token = '';
+    $scope.login.code = '';
+    $scope.login.totp = {};
+    $scope.login.userid = '';
+    $scope.login.error = false;
+    $scope.login.step = "";
+  }
+
+  // ------------------------------------------------------------------------
+  $scope.oidclogin = function() {
+  // ------------------------------------------------------------------------
+    // The provider sends the browser back here with a ticket
+
+    window.location.href = baseUrl + "/oidc/login?interface="
+      + window.interface;
+  }
+
+  // ------------------------------------------------------------------------
+  $scope.oidcReturn = function() {
+  // ------------------------------------------------------------------------
+    // Swap the ticket from a single sign-on login for the GUID
+
+    var ticket = "", oidcerror = "";
+    var params = window.location.search.substring(1).split("&");
+    for (var i = 0; i < params.length; i++) {
+      var kv = params[i].split("=");
+      if (kv[0] == "oidc_ticket") {
+        ticket = decodeURIComponent(kv[1]);
+      } else if (kv[0] == "oidc_error") {
+        oidcerror = decodeURIComponent(kv[1].replace(/\+/g, " "));
+      }
+    }
+    if (ticket == "" && oidcerror == "") {
+      return;
+    }
+
+    // Don't leave the ticket in the address bar or the history
+    window.history.replaceState(null, "", window.location.pathname);
+
+    if (oidcerror != "") {
+      $scope.login.error = true;
+      $scope.login.errtext = oidcerror;
+      return;
+    }
+
+    $http({
+      url: baseUrl + "/oidc/ticket",
+      method: "POST",
+      data: { Ticket: ticket }
+    }).success( function (data) {
+      $scope.login.userid = data.Login;
+      $scope.loggedIn(data);
+    }).error( function(data,status) {
+      $scope.login.error = true;
+      $scope.login.errtext = "Single sign-on failed.";
+    });
+  }
+
+  // ------------------------------------------------------------------------
+  $scope.oidcCheck = function() {
+  // ------------------------------------------------------------------------
+    // Show the single sign-on button if it's enabled
+
+    $scope.login.oidc = {};
+    $http({
+      url: baseUrl + "/oidc",
+      method: "GET"
+    }).success( function (data) {
+      $scope.login.oidc = data;
+    });
+  }
+
+  // ------------------------------------------------------------------------
+  $scope.refuseLogin = function(errtext) {
+  // ------------------------------------------------------------------------
+    // Logged in but the role can't use this interface
+
+    $http({
+      url: baseUrl + "/logout",
+      method: "POST"
+    });
+
+    $scope.login.guid = '';
+    $scope.login.userid = '';
+    $scope.login.role = '';
+    $scope.login.step = '';
+    $scope.login.error = true;
+    $scope.login.errtext = errtext;
+    $scope.login.pageurl = "login.html";
+  }
+
   // ------------------------------------------------------------------------
   $scope.Logout = function() {
   // ------------------------------------------------------------------------
 
     $http({
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-         + "/logout",
+      url: baseUrl + "/logout",
       method: "POST",
       data: creds
     }).success( function (data) {
@@ -125,6 +327,9 @@ mgrApp.controller("loginCtrl", function ($scope, $http, baseUrl) {
     });
   }
 
+  $scope.oidcCheck();
+  $scope.oidcReturn();
+
   // ------------------------------------------------------------------------
   $scope.userOrAdminPage = function() {
   // ------------------------------------------------------------------------
@@ -111,8 +111,7 @@ mgrApp.controller("pluginCtrl", function ($log, $modal, $scope, $http,
 
     $http({
       method: 'DELETE',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/plugins/" + id
+      url: baseUrl + "/plugins/" + id
     }).success( function(data, status, headers, config) {
       $scope.mainokmessage = "The plugin was deleted."
       $scope.FillPluginTable();
@@ -178,8 +177,7 @@ mgrApp.controller("pluginCtrl", function ($log, $modal, $scope, $http,
     $http({
       method: 'PUT',
       data: $scope.plugin,
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/plugins/" + $scope.plugin.Id
+      url: baseUrl + "/plugins/" + $scope.plugin.Id
     }).success( function(data, status, headers, config) {
 
       $scope.okmessage = "Changes were applied."
@@ -212,8 +210,7 @@ mgrApp.controller("pluginCtrl", function ($log, $modal, $scope, $http,
 
     json = JSON.stringify( json_obj )
     jQuery.ajax({
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/plugincapmaps" + id,
+      url: baseUrl + "/plugincapmaps" + id,
       data: json,
       type: type,
       processData: false,
@@ -251,8 +248,7 @@ mgrApp.controller("pluginCtrl", function ($log, $modal, $scope, $http,
     $http({
       method: 'POST',
       data: $scope.plugin,
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/plugins"
+      url: baseUrl + "/plugins"
     }).success( function(data, status, headers, config) {
 
       id = data.Id;
@@ -297,8 +293,7 @@ mgrApp.controller("pluginCtrl", function ($log, $modal, $scope, $http,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/plugins"
+      url: baseUrl + "/plugins"
     }).success( function(data, status, headers, config) {
       $scope.plugins = data;
     }).error( function(data,status) {
@@ -96,8 +96,7 @@ mgrApp.controller("scriptCtrl", function ($log, $modal, $scope, $http,
     $http({
       method: 'POST',
       data: $scope.script,
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/scripts"
+      url: baseUrl + "/scripts"
     }).success( function(data, status, headers, config) {
 
       id = data.Id;
@@ -139,8 +138,7 @@ mgrApp.controller("scriptCtrl", function ($log, $modal, $scope, $http,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/scripts?id=" + $scope.script.Id
+      url: baseUrl + "/scripts?id=" + $scope.script.Id
     }).success( function(data, status, headers, config) {
 
       var link = document.createElement("A");
@@ -190,8 +188,7 @@ mgrApp.controller("scriptCtrl", function ($log, $modal, $scope, $http,
     $http({
       method: 'PUT',
       data: $scope.script,
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/scripts/" + $scope.script.Id
+      url: baseUrl + "/scripts/" + $scope.script.Id
     }).success( function(data, status, headers, config) {
 
       $scope.okmessage = "Changes were applied."
@@ -223,14 +220,89 @@ mgrApp.controller("scriptCtrl", function ($log, $modal, $scope, $http,
     /* */
   }
 
+  // ----------------------------------------------------------------------
+  $scope.SyncScripts = function() {
+  // ----------------------------------------------------------------------
+  // Sync button for syncing scripts from script_sync_dir
+
+    clearMessages();
+
+    $http({
+      method: 'POST',
+      url: baseUrl + "/scripts/sync"
+    }).success( function(data, status, headers, config) {
+
+      $scope.mainokmessage = "Scripts were synced. "
+        + data.Added.length + " added, "
+        + data.Updated.length + " updated, "
+        + data.Removed.length + " removed.";
+      if (data.Skipped.length > 0) {
+        $scope.mainmessage = "Skipped: " + data.Skipped.join("; ");
+      }
+      $scope.FillScriptsTable();
+
+    }).error( function(data,status) {
+      if (status>=500) {
+        $scope.mainmessage = "Server error.";
+      } else if (status==401) {
+        $scope.login.errtext = "Session expired.";
+        $scope.login.error = true;
+        $scope.login.pageurl = "login.html";
+      } else if (status>=400) {
+        $scope.mainmessage = "Server said: " + data['Error'];
+      } else if (status==0) {
+        $scope.mainmessage = "Could not connect to server.";
+      } else {
+        $scope.mainmessage = "Unknown error.";
+      }
+    });
+  }
+
+  // ----------------------------------------------------------------------
+  $scope.Override = function(id,tf) {
+  // ----------------------------------------------------------------------
+  // Let a script that failed validation run, or stop it again
+
+    clearMessages();
+
+    $http({
+      method: 'PUT',
+      data: { Override: tf },
+      url: baseUrl + "/scripts/" + id + "/validation"
+    }).success( function(data, status, headers, config) {
+
+      if (tf) {
+        $scope.mainokmessage = "'" + data.Name + "' can run.";
+      } else {
+        $scope.mainokmessage = "'" + data.Name + "' can't run until it "
+          + "passes validation.";
+      }
+      $scope.FillScriptsTable();
+
+    }).error( function(data,status) {
+      if (status>=500) {
+        $scope.mainmessage = "Server error.";
+      } else if (status==401) {
+        $scope.login.errtext = "Session expired.";
+        $scope.login.error = true;
+        $scope.login.pageurl = "login.html";
+      } else if (status>=400) {
+        $scope.mainmessage = "Server said: " + data['Error'];
+      } else if (status==0) {
+        $scope.mainmessage = "Could not connect to server.";
+      } else {
+        $scope.mainmessage = "Unknown error.";
+      }
+    });
+  }
+
   // ----------------------------------------------------------------------
   $scope.FillScriptsTable = function() {
   // ----------------------------------------------------------------------
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/scripts?nosource=true"
+      url: baseUrl + "/scripts?nosource=true"
     }).success( function(data, status, headers, config) {
       $scope.scripts = data;
     }).error( function(data,status) {
@@ -265,8 +337,7 @@ mgrApp.controller("scriptCtrl", function ($log, $modal, $scope, $http,
 
     $http({
       method: 'DELETE',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/scripts/" + id
+      url: baseUrl + "/scripts/" + id
     }).success( function(data, status, headers, config) {
       $scope.mainokmessage = "The script was deleted."
       $scope.FillScriptsTable();
@@ -153,8 +153,7 @@ mgrApp.controller("sidebarCtrl", function ($scope,$http,baseUrl,$timeout,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/plugins"
+      url: baseUrl + "/plugins"
 			     + '?time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
       $scope.plugins = data;
@@ -32,6 +32,8 @@ mgrApp.controller("userCtrl", function ($log, $modal, $scope, $http, baseUrl) {
     { title:'User Details', content:'frag/adduser-detailstab.html'},
     { title:'Permissions', content:'frag/adduser-permstab.html'}];
 
+  $scope.roles = ["admin", "operator", "viewer", "auditor", "worker"];
+
   $scope.editusertabs = [
     { title:'User Details', content:'frag/edituser-detailstab.html'},
     { title:'Permissions', content:'frag/edituser-permstab.html'}];
@@ -48,8 +50,7 @@ mgrApp.controller("userCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envs"
+      url: baseUrl + "/envs"
     }).success( function(data, status, headers, config) {
       $scope.envs = data;
       if( $scope.edituser > 0 ) {
@@ -93,10 +94,10 @@ mgrApp.controller("userCtrl", function ($log, $modal, $scope, $http, baseUrl) {
   $scope.editUserTabs = function() {
   // ----------------------------------------------------------------------
   // For use in ng-repeat in the edit user tabset.
-  // Strip off the Permissions tab for the admin user.
+  // Strip off the Permissions tab for admins, who can use every env.
 
       tabs = $scope.editusertabs;
-      if( $scope.user.Login == "admin" ) {
+      if( $scope.user.Role == "admin" ) {
           return tabs.slice(0,1);
       }
       return tabs;
@@ -115,7 +116,7 @@ mgrApp.controller("userCtrl", function ($log, $modal, $scope, $http, baseUrl) {
   $scope.AddUser = function(tf) {
   // ----------------------------------------------------------------------
     $scope.adduser = tf;
-    $scope.user = {};
+    $scope.user = { Role: "operator" };
     $scope.FillEnvTable();  // For the Permissions tab
     clearMessages();
   }
@@ -128,8 +129,7 @@ mgrApp.controller("userCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/perms?user_id=" + id
+      url: baseUrl + "/perms?user_id=" + id
     }).success( function(data, status, headers, config) {
       $scope.perms = data;
 
@@ -192,8 +192,7 @@ mgrApp.controller("userCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     $http({
       method: 'DELETE',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/users/" + id
+      url: baseUrl + "/users/" + id
     }).success( function(data, status, headers, config) {
       $scope.mainokmessage = "The user was deleted."
       $scope.FillUserTable();
@@ -218,6 +217,40 @@ mgrApp.controller("userCtrl", function ($log, $modal, $scope, $http, baseUrl) {
     });
   }
 
+  // ----------------------------------------------------------------------
+  $scope.ResetTotp = function( id ) {
+  // ----------------------------------------------------------------------
+    // For users that lost their authenticator and recovery codes
+
+    $scope.mainmessage = "";
+
+    $http({
+      method: 'DELETE',
+      url: baseUrl + "/users/" + id + "/totp"
+    }).success( function(data, status, headers, config) {
+      $scope.mainokmessage = "Two-factor authentication was reset."
+      $scope.FillUserTable();
+    }).error( function(data,status) {
+      if (status>=500) {
+        $scope.errtext = "Server error.";
+        $scope.error = true;
+      } else if (status==401) {
+        $scope.login.errtext = "Session expired.";
+        $scope.login.error = true;
+        $scope.login.pageurl = "login.html";
+      } else if (status>=400) {
+        $scope.message = "Server said: " + data['Error'];
+        $scope.error = true;
+      } else if (status==0) {
+        $scope.errtext = "Could not connect to server.";
+        $scope.error = true;
+      } else {
+        $scope.errtext = "Unknown error.";
+        $scope.error = true;
+      }
+    });
+  }
+
   // ----------------------------------------------------------------------
   $scope.EditApply = function() {
   // ----------------------------------------------------------------------
@@ -242,8 +275,7 @@ mgrApp.controller("userCtrl", function ($log, $modal, $scope, $http, baseUrl) {
     $http({
       method: 'PUT',
       data: $scope.user,
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/users/" + $scope.user.Id
+      url: baseUrl + "/users/" + $scope.user.Id
     }).success( function(data, status, headers, config) {
       $scope.okmessage = "Changes were applied."
       // Write the user Permissions tab
@@ -327,8 +359,7 @@ mgrApp.controller("userCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     json = JSON.stringify( json_obj )
     jQuery.ajax({
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/perms" + id,
+      url: baseUrl + "/perms" + id,
       data: json,
       type: type,
       processData: false,
@@ -375,8 +406,7 @@ mgrApp.controller("userCtrl", function ($log, $modal, $scope, $http, baseUrl) {
     $http({
       method: 'POST',
       data: $scope.user,
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/users"
+      url: baseUrl + "/users"
     }).success( function(data, status, headers, config) {
       $scope.okmessage = "The user was added."
       // Write the user Permissions tab
@@ -446,8 +476,7 @@ mgrApp.controller("userCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/perms"
+      url: baseUrl + "/perms"
     }).success( function(data, status, headers, config) {
       $scope.users = data;
     }).error( function(data,status) {
@@ -478,8 +507,7 @@ mgrApp.controller("userCtrl", function ($log, $modal, $scope, $http, baseUrl) {
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/users"
+      url: baseUrl + "/users"
     }).success( function(data, status, headers, config) {
       $scope.users = data;
     }).error( function(data,status) {
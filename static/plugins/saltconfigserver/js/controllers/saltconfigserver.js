@@ -409,8 +409,7 @@ mgrApp.controller("saltconfigserverCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'POST',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltconfigserver/salthighstate"
+      url: baseUrl + "/saltconfigserver/salthighstate"
            + "?env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString(),
       data: saltids
@@ -505,8 +504,7 @@ mgrApp.controller("saltconfigserverCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/outputlines?job_id=" + id
+      url: baseUrl + "/outputlines?job_id=" + id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
 
@@ -575,8 +573,7 @@ mgrApp.controller("saltconfigserverCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'POST',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltconfigserver/grains?salt_id=" + saltid
+      url: baseUrl + "/saltconfigserver/grains?salt_id=" + saltid
            + "&env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString(),
       data: config
@@ -663,8 +660,7 @@ mgrApp.controller("saltconfigserverCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'POST',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltconfigserver/enc?salt_id=" + saltid
+      url: baseUrl + "/saltconfigserver/enc?salt_id=" + saltid
            + "&env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString(),
       data: config
@@ -820,8 +816,7 @@ mgrApp.controller("saltconfigserverCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/outputlines?job_id=" + id
+      url: baseUrl + "/outputlines?job_id=" + id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
 
@@ -896,8 +891,7 @@ mgrApp.controller("saltconfigserverCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/outputlines?job_id=" + id
+      url: baseUrl + "/outputlines?job_id=" + id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
 
@@ -950,8 +944,7 @@ mgrApp.controller("saltconfigserverCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/outputlines?job_id=" + id
+      url: baseUrl + "/outputlines?job_id=" + id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
 
@@ -1003,8 +996,7 @@ mgrApp.controller("saltconfigserverCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/outputlines?job_id=" + id
+      url: baseUrl + "/outputlines?job_id=" + id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
 
@@ -1071,8 +1063,7 @@ mgrApp.controller("saltconfigserverCtrl", function ($scope,$http,$modal,$log,
       $timeout( function() {
         $http({
           method: 'GET',
-          url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-               + "/jobs?job_id=" + id
+          url: baseUrl + "/jobs?job_id=" + id
 							 + '&time='+new Date().getTime().toString()
         }).success( function(data, status, headers, config) {
           job = data[0];
@@ -1205,8 +1196,7 @@ mgrApp.controller("saltconfigserverCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltconfigserver/enc?salt_id=" + saltid
+      url: baseUrl + "/saltconfigserver/enc?salt_id=" + saltid
            + "&env=" + $scope.env.SysName
            + "&version=" + grain.Version
            + "&dc=" + $scope.env.DcSysName
@@ -1253,8 +1243,7 @@ mgrApp.controller("saltconfigserverCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltconfigserver/enc?salt_id=" + saltid
+      url: baseUrl + "/saltconfigserver/enc?salt_id=" + saltid
            + "&version=" + grain.Version
            + "&env=" + $scope.env.SysName
            + "&dc=" + $scope.env.DcSysName
@@ -1312,8 +1301,7 @@ mgrApp.controller("saltconfigserverCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltconfigserver/grains?salt_id=" + saltid
+      url: baseUrl + "/saltconfigserver/grains?salt_id=" + saltid
            + "&env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
@@ -1350,8 +1338,7 @@ mgrApp.controller("saltconfigserverCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltconfigserver/grainscache?salt_id=" + saltid
+      url: baseUrl + "/saltconfigserver/grainscache?salt_id=" + saltid
            + "&env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
@@ -1388,8 +1375,7 @@ mgrApp.controller("saltconfigserverCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltconfigserver/versions?env_id=" + $scope.env.Id
+      url: baseUrl + "/saltconfigserver/versions?env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
       $scope.PollForJobFinish(data.JobId,50,0,$scope.GetVersionListOutputLine);
@@ -1426,8 +1412,7 @@ mgrApp.controller("saltconfigserverCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltconfigserver/servers?env_id=" + $scope.env.Id
+      url: baseUrl + "/saltconfigserver/servers?env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
       $scope.PollForJobFinish(data.JobId,50,0,$scope.GetServerListOutputLine);
@@ -1463,8 +1448,7 @@ mgrApp.controller("saltconfigserverCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/outputlines?job_id=" + id
+      url: baseUrl + "/outputlines?job_id=" + id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
 
@@ -1534,8 +1518,7 @@ mgrApp.controller("saltconfigserverCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltconfigserver/statedescs"
+      url: baseUrl + "/saltconfigserver/statedescs"
            + "?env_id=" + $scope.env.Id
            + "&version=" + grain.Version
            + '&time='+new Date().getTime().toString()
@@ -1573,8 +1556,7 @@ mgrApp.controller("saltconfigserverCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envs?writeable=1"
+      url: baseUrl + "/envs?writeable=1"
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
 
@@ -93,8 +93,7 @@ mgrApp.controller("saltjobviewerCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/outputlines?job_id=" + id
+      url: baseUrl + "/outputlines?job_id=" + id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
 
@@ -255,8 +254,7 @@ mgrApp.controller("saltjobviewerCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/outputlines?job_id=" + id
+      url: baseUrl + "/outputlines?job_id=" + id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
 
@@ -393,8 +391,7 @@ mgrApp.controller("saltjobviewerCtrl", function ($scope,$http,$modal,$log,
       $timeout( function() {
         $http({
           method: 'GET',
-          url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-               + "/jobs?job_id=" + id
+          url: baseUrl + "/jobs?job_id=" + id
                + '&time='+new Date().getTime().toString()
         }).success( function(data, status, headers, config) {
           job = data[0];
@@ -450,8 +447,7 @@ mgrApp.controller("saltjobviewerCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltjobviewer/saltresult?env_id=" + $scope.env.Id
+      url: baseUrl + "/saltjobviewer/saltresult?env_id=" + $scope.env.Id
            + "&salt_jid=" + jid
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
@@ -488,8 +484,7 @@ mgrApp.controller("saltjobviewerCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltjobviewer/saltjobs?env_id=" + $scope.env.Id
+      url: baseUrl + "/saltjobviewer/saltjobs?env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
       $scope.PollForJobFinish(data.JobId,50,0,$scope.GetJobListOutputLine);
@@ -525,8 +520,7 @@ mgrApp.controller("saltjobviewerCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envs?writeable=1"
+      url: baseUrl + "/envs?writeable=1"
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
       $scope.environments = data;
@@ -567,8 +561,7 @@ mgrApp.controller("saltjobviewerCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'DELETE',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltkeymanager/saltkeys/" + name
+      url: baseUrl + "/saltkeymanager/saltkeys/" + name
            + "?env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
@@ -99,8 +99,7 @@ mgrApp.controller("saltkeymgrCtrl", function ($scope,$http,$modal,$log,
   // ----------------------------------------------------------------------
     $http({
       method: 'POST',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltkeymanager/saltkeys?hostname=" + name
+      url: baseUrl + "/saltkeymanager/saltkeys?hostname=" + name
            + "&type=accept"
            + "&env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString()
@@ -137,8 +136,7 @@ mgrApp.controller("saltkeymgrCtrl", function ($scope,$http,$modal,$log,
   // ----------------------------------------------------------------------
     $http({
       method: 'POST',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltkeymanager/saltkeys?hostname=" + name
+      url: baseUrl + "/saltkeymanager/saltkeys?hostname=" + name
            + "&type=reject"
            + "&env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString()
@@ -176,8 +174,7 @@ mgrApp.controller("saltkeymgrCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'DELETE',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltkeymanager/saltkeys/" + name
+      url: baseUrl + "/saltkeymanager/saltkeys/" + name
            + "?env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
@@ -223,8 +220,7 @@ mgrApp.controller("saltkeymgrCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/outputlines?job_id=" + id
+      url: baseUrl + "/outputlines?job_id=" + id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
 
@@ -288,8 +284,7 @@ mgrApp.controller("saltkeymgrCtrl", function ($scope,$http,$modal,$log,
     //$scope.okmessage = "Server configuration was updated successfully.";
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/outputlines?job_id=" + id
+      url: baseUrl + "/outputlines?job_id=" + id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
 
@@ -345,8 +340,7 @@ mgrApp.controller("saltkeymgrCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'POST',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltkeymanager/grains?salt_id=" + saltid
+      url: baseUrl + "/saltkeymanager/grains?salt_id=" + saltid
            + "&env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString(),
       data: config
@@ -431,8 +425,7 @@ mgrApp.controller("saltkeymgrCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/outputlines?job_id=" + id
+      url: baseUrl + "/outputlines?job_id=" + id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
 
@@ -534,8 +527,7 @@ mgrApp.controller("saltkeymgrCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltkeymanager/grains?salt_id=" + saltid
+      url: baseUrl + "/saltkeymanager/grains?salt_id=" + saltid
            + "&env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
@@ -619,8 +611,7 @@ mgrApp.controller("saltkeymgrCtrl", function ($scope,$http,$modal,$log,
       $timeout( function() {
         $http({
           method: 'GET',
-          url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-               + "/jobs?job_id=" + id
+          url: baseUrl + "/jobs?job_id=" + id
 							 + '&time='+new Date().getTime().toString()
         }).success( function(data, status, headers, config) {
           job = data[0];
@@ -676,8 +667,7 @@ mgrApp.controller("saltkeymgrCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltkeymanager/saltkeys"
+      url: baseUrl + "/saltkeymanager/saltkeys"
            + "?env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
@@ -714,8 +704,7 @@ mgrApp.controller("saltkeymgrCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envs?writeable=1"
+      url: baseUrl + "/envs?writeable=1"
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
       $scope.environments = data;
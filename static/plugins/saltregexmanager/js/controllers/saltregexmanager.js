@@ -102,8 +102,7 @@ mgrApp.controller("saltregexmgrCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'DELETE',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltkeymanager/saltkeys/" + name
+      url: baseUrl + "/saltkeymanager/saltkeys/" + name
            + "?env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
@@ -150,8 +149,7 @@ mgrApp.controller("saltregexmgrCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'DELETE',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltregexmanager/regexes/" + id
+      url: baseUrl + "/saltregexmanager/regexes/" + id
            + "?env_id=" + $scope.env.Id,
     }).success( function(data, status, headers, config) {
         $scope.FillRegexListTable();
@@ -198,8 +196,7 @@ mgrApp.controller("saltregexmgrCtrl", function ($scope,$http,$modal,$log,
     $http({
       method: method,
       data: $scope.newregex,
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltregexmanager/regexes"
+      url: baseUrl + "/saltregexmanager/regexes"
            + "?env_id=" + $scope.env.Id,
     }).success( function(data, status, headers, config) {
       $scope.okmessage = "Regex configuration was updated successfully.";
@@ -284,8 +281,7 @@ mgrApp.controller("saltregexmgrCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'POST',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltregexmanager/regex_sls_maps"
+      url: baseUrl + "/saltregexmanager/regex_sls_maps"
            + "?env_id=" + $scope.env.Id,
       data: config
     }).success( function(data, status, headers, config) {
@@ -415,8 +411,7 @@ mgrApp.controller("saltregexmgrCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltregexmanager/regex_sls_maps?regex_id=" + regex_id
+      url: baseUrl + "/saltregexmanager/regex_sls_maps?regex_id=" + regex_id
            + "&env_id=" + $scope.env.Id
     }).success( function(data, status, headers, config) {
 
@@ -544,8 +539,7 @@ mgrApp.controller("saltregexmgrCtrl", function ($scope,$http,$modal,$log,
       $timeout( function() {
         $http({
           method: 'GET',
-          url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-               + "/jobs?job_id=" + id
+          url: baseUrl + "/jobs?job_id=" + id
         }).success( function(data, status, headers, config) {
           job = data[0];
           if(job.Status == 0 || job.Status == 1 || job.Status == 4) {
@@ -600,8 +594,7 @@ mgrApp.controller("saltregexmgrCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/outputlines?job_id=" + id
+      url: baseUrl + "/outputlines?job_id=" + id
     }).success( function(data, status, headers, config) {
 
       try {
@@ -662,8 +655,7 @@ mgrApp.controller("saltregexmgrCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltconfigserver/statedescs"
+      url: baseUrl + "/saltconfigserver/statedescs"
            + "?env_id=" + $scope.env.Id
            + "&version=0", // Zero version - use main unversioned branch name
     }).success( function(data, status, headers, config) {
@@ -740,8 +732,7 @@ mgrApp.controller("saltregexmgrCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltregexmanager/regexes"
+      url: baseUrl + "/saltregexmanager/regexes"
            + "?env_id=" + $scope.env.Id
     }).success( function(data, status, headers, config) {
 
@@ -792,8 +783,7 @@ mgrApp.controller("saltregexmgrCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envs?writeable=1"
+      url: baseUrl + "/envs?writeable=1"
     }).success( function(data, status, headers, config) {
       $scope.environments = data;
       if( data.length == 0 ) {
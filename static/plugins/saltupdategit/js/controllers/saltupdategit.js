@@ -181,8 +181,7 @@ mgrApp.controller("saltupdategitCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/outputlines?job_id=" + id
+      url: baseUrl + "/outputlines?job_id=" + id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
 
@@ -263,8 +262,7 @@ mgrApp.controller("saltupdategitCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'POST',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltupdategit/versions"
+      url: baseUrl + "/saltupdategit/versions"
            + "?env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString(),
       data: config
@@ -370,8 +368,7 @@ mgrApp.controller("saltupdategitCtrl", function ($scope,$http,$modal,$log,
       $timeout( function() {
         $http({
           method: 'GET',
-          url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-               + "/jobs?job_id=" + id
+          url: baseUrl + "/jobs?job_id=" + id
                + '&time='+new Date().getTime().toString()
         }).success( function(data, status, headers, config) {
           job = data[0];
@@ -427,8 +424,7 @@ mgrApp.controller("saltupdategitCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltupdategit/versions?env_id=" + $scope.env.Id
+      url: baseUrl + "/saltupdategit/versions?env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
       $scope.PollForJobFinish(data.JobId,50,0,$scope.GetVersionListOutputLine);
@@ -464,8 +460,7 @@ mgrApp.controller("saltupdategitCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envs?writeable=1"
+      url: baseUrl + "/envs?writeable=1"
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
       $scope.environments = data;
@@ -506,8 +501,7 @@ mgrApp.controller("saltupdategitCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'DELETE',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/saltkeymanager/saltkeys/" + name
+      url: baseUrl + "/saltkeymanager/saltkeys/" + name
            + "?env_id=" + $scope.env.Id
            + '&time='+new Date().getTime().toString()
     }).success( function(data, status, headers, config) {
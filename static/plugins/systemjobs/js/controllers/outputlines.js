@@ -49,8 +49,7 @@ mgrApp.controller("outputlinesCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/outputlines?job_id=" + id
+      url: baseUrl + "/outputlines?job_id=" + id
     }).success( function(data, status, headers, config) {
       $scope.outputlines = data;
     }).error( function(data,status) {
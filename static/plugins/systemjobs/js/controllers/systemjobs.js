@@ -157,8 +157,7 @@ mgrApp.controller("systemjobsCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/jobs"
+      url: baseUrl + "/jobs"
     }).success( function(data, status, headers, config) {
       // lookup the error codes and add as ErrText field.
       for( var i=0; i<data.length; i++ ) {
@@ -195,8 +194,7 @@ mgrApp.controller("systemjobsCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'DELETE',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/jobs/kill/" + id
+      url: baseUrl + "/jobs/kill/" + id
     }).success( function(data, status, headers, config) {
       $timeout( $scope.FillJobsTable, 2000 );
       //$timeout( $scope.FillJobsTable(), 4000 );
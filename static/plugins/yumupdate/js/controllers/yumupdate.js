@@ -44,8 +44,7 @@ mgrApp.controller("saltrolloutCtrl", function ($scope,$http,$modal,$log,
 
     $http({
       method: 'GET',
-      url: baseUrl + "/" + $scope.login.userid + "/" + $scope.login.guid
-           + "/envs?writeable=1"
+      url: baseUrl + "/envs?writeable=1"
     }).success( function(data, status, headers, config) {
       $scope.environments = data;
       if( data.length == 0 ) {